@@ -0,0 +1,138 @@
+// Package auth signs the requests of distributed clients with their tokens,
+// and checks them on the server. It also issues the TLS certificates of a
+// private cluster, whose client certificates can identify clients instead.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ClientHeader carries the id of the token a request is signed with.
+	ClientHeader = "X-Prime-Client"
+	// TimestampHeader carries the Unix time a request was signed at.
+	TimestampHeader = "X-Prime-Timestamp"
+	// NonceHeader carries a random value unique to each request, so that a
+	// request cannot be replayed while its timestamp is still accepted.
+	NonceHeader = "X-Prime-Nonce"
+	// SignatureHeader carries the HMAC-SHA256 of the request, in hex.
+	SignatureHeader = "X-Prime-Signature"
+	// MaxClockSkew bounds how far the time a request was signed at may be
+	// from the time the server receives it.
+	MaxClockSkew = 5 * time.Minute
+	// noncePruneInterval is how often the nonces of requests too old to be
+	// replayed are forgotten.
+	noncePruneInterval = 30 * time.Second
+)
+
+// ParseToken splits a token as printed by `server token create` into its
+// id and secret
+func ParseToken(token string) (string, string, error) {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("malformed token, want id:secret")
+	}
+	return parts[0], parts[1], nil
+}
+
+// Sign returns the signature of a request: the HMAC-SHA256, keyed by the
+// secret of a token, of its method, path, timestamp, nonce and body
+func Sign(secret string, method string, path string, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n", method, path, timestamp, nonce)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest signs a request whose body is body with token
+func SignRequest(r *http.Request, token string, body []byte) error {
+	id, secret, err := ParseToken(token)
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	timestamp, nonce := time.Now().Unix(), hex.EncodeToString(random)
+	r.Header.Set(ClientHeader, id)
+	r.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	r.Header.Set(NonceHeader, nonce)
+	r.Header.Set(SignatureHeader, Sign(secret, r.Method, r.URL.Path, timestamp, nonce, body))
+	return nil
+}
+
+// Verify checks the signature of a request against the tokens, returning
+// the name of the client it comes from. Requests with an unknown token or a
+// timestamp out of bounds are refused before their body is read. The body is
+// then read in full to be checked, and left in place for the handler to read
+// again. A request whose nonce was already seen is refused as a replay.
+func (t *Tokens) Verify(r *http.Request, maxBody int64) (string, error) {
+	id := r.Header.Get(ClientHeader)
+	if id == "" {
+		return "", fmt.Errorf("request is not signed")
+	}
+	token, ok := t.lookup(id)
+	if !ok {
+		return "", fmt.Errorf("unknown token %q", id)
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("request from %s has no timestamp", token.Name)
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return "", fmt.Errorf("request from %s was signed %s away from now", token.Name, skew)
+	}
+	nonce := r.Header.Get(NonceHeader)
+	if nonce == "" {
+		return "", fmt.Errorf("request from %s has no nonce", token.Name)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxBody))
+	if err != nil {
+		return "", err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	expected := Sign(token.Secret, r.Method, r.URL.Path, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(SignatureHeader))) {
+		return "", fmt.Errorf("request from %s has a bad signature", token.Name)
+	}
+	if !t.remember(id, nonce, time.Unix(timestamp, 0)) {
+		return "", fmt.Errorf("request from %s was already received", token.Name)
+	}
+	return token.Name, nil
+}
+
+// remember() records the nonce of a request signed with the token id at
+// signed, and reports whether it is new. A nonce is kept only until its
+// request would be refused for its timestamp anyway.
+func (t *Tokens) remember(id string, nonce string, signed time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.pruned) > noncePruneInterval {
+		for key, expires := range t.seen {
+			if now.After(expires) {
+				delete(t.seen, key)
+			}
+		}
+		t.pruned = now
+	}
+	key := id + "\n" + nonce
+	if _, ok := t.seen[key]; ok {
+		return false
+	}
+	t.seen[key] = signed.Add(MaxClockSkew)
+	return true
+}
@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+const (
+	// caValidity is how long the certificate authority of a cluster lasts.
+	caValidity = 10 * 365 * 24 * time.Hour
+	// certificateValidity is how long the certificates it issues last.
+	certificateValidity = 2 * 365 * 24 * time.Hour
+	// caName is the name of the files of the certificate authority.
+	caName = "ca"
+)
+
+// CertificateFiles returns the certificate and key files issued to name in
+// config.Certificates
+func CertificateFiles(name string) (string, string) {
+	return filepath.Join(config.Certificates, name+".pem"), filepath.Join(config.Certificates, name+"-key.pem")
+}
+
+// CAFile returns the certificate file of the certificate authority, which
+// clients pin and the server checks client certificates against
+func CAFile() string {
+	cert, _ := CertificateFiles(caName)
+	return cert
+}
+
+// IssueServerCertificate issues the server a certificate for hosts, which
+// may be names or IP addresses, creating the certificate authority first if
+// there is none yet. It returns the certificate and key files.
+func IssueServerCertificate(hosts []string) (string, string, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return issue("server", template)
+}
+
+// IssueClientCertificate issues the named client a certificate, which
+// identifies it to a server checking client certificates as its token would.
+// It returns the certificate and key files.
+func IssueClientCertificate(name string) (string, string, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return issue(name, template)
+}
+
+// issue() signs template with the certificate authority and writes the
+// certificate and its key to the files of name
+func issue(name string, template *x509.Certificate) (string, string, error) {
+	ca, caKey, err := loadOrCreateCA()
+	if err != nil {
+		return "", "", err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	if template.SerialNumber, err = serialNumber(); err != nil {
+		return "", "", err
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(certificateValidity)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", err
+	}
+	return writeCertificate(name, der, key)
+}
+
+// loadOrCreateCA() returns the certificate authority in config.Certificates,
+// creating it if there is none
+func loadOrCreateCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile, keyFile := CertificateFiles(caName)
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is not an ECDSA key", keyFile)
+		}
+		return ca, key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "PrimeNumberGenerator cluster CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := writeCertificate(caName, der, key); err != nil {
+		return nil, nil, err
+	}
+	config.Logger.Info("Created a certificate authority", "file", certFile)
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// serialNumber() returns a random certificate serial number
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// writeCertificate() writes a certificate and its key to the files of name,
+// the key readable by its owner only
+func writeCertificate(name string, der []byte, key *ecdsa.PrivateKey) (string, string, error) {
+	certFile, keyFile := CertificateFiles(name)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(config.Certificates, os.ModePerm); err != nil {
+		return "", "", err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		return "", "", err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPem, 0644); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// certPool() reads the certificates in file into a pool
+func certPool(file string) (*x509.CertPool, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		return nil, fmt.Errorf("%s holds no certificates", file)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig returns the TLS configuration of the server. Given the
+// file of a certificate authority, clients must present a certificate it
+// issued, which then identifies them instead of a token.
+func ServerTLSConfig(clientCA string) (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pool, err := certPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// ClientTLSConfig returns the TLS configuration of a client, trusting only
+// the certificate authority in the file ca if given, and otherwise the
+// system's, and presenting the certificate in cert and key if given
+func ClientTLSConfig(ca string, cert string, key string) (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		pool, err := certPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{pair}
+	}
+	return c, nil
+}
+
+// CertificateIdentity returns the name of the client a request comes from
+// if it presented a certificate the server verified
+func CertificateIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
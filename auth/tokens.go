@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+// Token is the credential of one client. Only the id travels with requests;
+// the secret keys their signatures.
+type Token struct {
+	Name    string
+	Id      string
+	Secret  string
+	Created time.Time
+}
+
+// String returns the token in the form clients are configured with
+func (t Token) String() string {
+	return t.Id + ":" + t.Secret
+}
+
+// Tokens holds the tokens in config.Tokens, reading the file again whenever
+// it changes so that tokens created while the server runs are accepted, and
+// the nonces of the requests it has verified recently.
+type Tokens struct {
+	mu      sync.Mutex
+	byId    map[string]Token
+	modTime time.Time
+	seen    map[string]time.Time
+	pruned  time.Time
+}
+
+// NewTokens returns the tokens in config.Tokens
+func NewTokens() *Tokens {
+	return &Tokens{byId: make(map[string]Token), seen: make(map[string]time.Time)}
+}
+
+// Count returns the number of tokens
+func (t *Tokens) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reload()
+	return len(t.byId)
+}
+
+// lookup() returns the token with the given id
+func (t *Tokens) lookup(id string) (Token, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reload()
+	token, ok := t.byId[id]
+	return token, ok
+}
+
+// reload() reads config.Tokens again if it changed. The caller must hold
+// t.mu.
+func (t *Tokens) reload() {
+	info, err := os.Stat(config.Tokens)
+	if err != nil || info.ModTime().Equal(t.modTime) {
+		return
+	}
+	tokens, err := readTokens()
+	if err != nil {
+		config.Logger.Warn("Keeping the tokens already loaded", "err", err)
+		return
+	}
+	t.byId = make(map[string]Token)
+	for _, token := range tokens {
+		t.byId[token.Id] = token
+	}
+	t.modTime = info.ModTime()
+}
+
+// readTokens() reads every token from config.Tokens
+func readTokens() ([]Token, error) {
+	var tokens []Token
+	contents, err := ioutil.ReadFile(config.Tokens)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %v", config.Tokens, err)
+	}
+	return tokens, nil
+}
+
+// randomHex() returns n random bytes in hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateToken issues a new token for the named client and adds it to
+// config.Tokens
+func CreateToken(name string) (Token, error) {
+	tokens, err := readTokens()
+	if err != nil {
+		return Token{}, err
+	}
+	for _, token := range tokens {
+		if token.Name == name {
+			return Token{}, fmt.Errorf("a token for %s already exists", name)
+		}
+	}
+	token := Token{Name: name, Created: time.Now()}
+	if token.Id, err = randomHex(8); err != nil {
+		return Token{}, err
+	}
+	if token.Secret, err = randomHex(32); err != nil {
+		return Token{}, err
+	}
+
+	contents, err := json.MarshalIndent(append(tokens, token), "", "  ")
+	if err != nil {
+		return Token{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(config.Tokens), os.ModePerm); err != nil {
+		return Token{}, err
+	}
+	temporary := config.Tokens + ".tmp"
+	if err := ioutil.WriteFile(temporary, contents, 0600); err != nil {
+		return Token{}, err
+	}
+	return token, os.Rename(temporary, config.Tokens)
+}
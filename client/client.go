@@ -2,265 +2,439 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"math/big"
 	"net/http"
-	"os"
-	"os/signal"
 	"sync"
 	"time"
 
+	"github.com/MaxTheMonster/PrimeNumberGenerator/auth"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/computation"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/metrics"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
 	app "github.com/urfave/cli"
 )
 
 var lock sync.Mutex
 
+var (
+	// httpClient and scheme are how requests reach the server, over TLS
+	// once ConfigureTLS is called.
+	httpClient = http.DefaultClient
+	scheme     = "http"
+)
+
+// ConfigureTLS makes the client reach the server over TLS, trusting only the
+// certificate authority in the file ca if given, and presenting the
+// certificate in cert and key if given
+func ConfigureTLS(ca string, cert string, key string) error {
+	tlsConfig, err := auth.ClientTLSConfig(ca, cert, key)
+	if err != nil {
+		return err
+	}
+	httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	scheme = "https"
+	return nil
+}
+
+// errRefused is returned when the server refuses the client, which trying
+// again will not fix.
+var errRefused = errors.New("server refused the client")
+
+// errorMessage returns the message of an error response, which the server
+// sends as JSON
+func errorMessage(body []byte) string {
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		return e.Error
+	}
+	return string(bytes.TrimSpace(body))
+}
+
+// request sends a request to an endpoint of the server, signed with the
+// token of the client unless it is identified by its certificate alone
+func request(method string, point string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, scheme+"://"+config.Address+point, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if config.Token != "" {
+		if err := auth.SignRequest(req, config.Token, body); err != nil {
+			return nil, fmt.Errorf("cannot sign requests: %v", err)
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		message, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", errRefused, errorMessage(message))
+	}
+	return resp, nil
+}
+
+// readAssignment reads work assigned by the server into v
+func readAssignment(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(errorMessage(body))
+	}
+	return json.Unmarshal(body, v)
+}
+
 // sendPrimeResult sends a JSON string through POST to the server
 // of the results of a computation
 func sendPrimeResult(p primes.Prime) error {
 	lock.Lock()
 	defer lock.Unlock()
-	url := "http://" + config.Address + config.ReturnPoint
-	log.Print(url)
 	json, err := json.Marshal(p)
 	if err != nil {
-		config.Logger.Print(err)
-	}
-	log.Print("Sending ", string(json))
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(json))
-	if err != nil {
-		config.Logger.Print(err)
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	config.Logger.Debug("Sending result", "result", string(json))
+	resp, err := request("POST", config.ReturnPoint, json)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		config.Logger.Warn("Server rejected result", "candidate", p.Value, "reason", errorMessage(body))
+	}
 	return nil
 }
 
 // fetchNextPrimeToPerform returns a computation hash given by
 // the server
 func fetchNextPrimeToPerform() (primes.Prime, error) {
-	url := "http://" + config.Address + config.AssignmentPoint
-	resp, err := http.Get(url)
+	resp, err := request("GET", config.AssignmentPoint, nil)
 	if err != nil {
-		log.Print("Cannot connect to server")
+		config.Logger.Warn("Cannot connect to server", "err", err)
 		return primes.Prime{}, err
 	}
-	config.Logger.Print("Received prime number from ", url)
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	prime := getUnMarshalledPrime(string(body))
-	return prime, nil
-}
-
-// getUnMarshalledPrime produces a computation from a JSON string
-func getUnMarshalledPrime(body string) primes.Prime {
-	var p primes.Prime
-	err := json.Unmarshal([]byte(body), &p)
-	if err != nil {
-		log.Fatal(err)
+	var prime primes.Prime
+	if err := readAssignment(resp, &prime); err != nil {
+		return primes.Prime{}, err
 	}
-	return p
+	config.Logger.Debug("Received candidate", "candidate", prime.Value, "server", config.Address)
+	return prime, nil
 }
 
 // sendComputationResult sends a JSON string through POST to the server
 // of the results of a computation
-func sendComputationResult(c computation.Computation) {
-	url := "http://" + config.Address + config.HeavyReturnPoint
+func sendComputationResult(c computation.Computation) error {
 	json, err := json.Marshal(c)
 	if err != nil {
-		config.Logger.Print(err)
+		return err
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(json))
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := request("POST", config.HeavyReturnPoint, json)
 	if err != nil {
-		config.Logger.Print(err)
+		return err
 	}
 	defer resp.Body.Close()
-}
-
-// getUnMarshalledComputation produces a computation from a JSON string
-func getUnMarshalledComputation(body string) computation.Computation {
-	var c computation.Computation
-	err := json.Unmarshal([]byte(body), &c)
-	if err != nil {
-		log.Fatal(err)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		config.Logger.Warn("Server rejected computation", "computation", c.ComputationId, "reason", errorMessage(body))
 	}
-	return c
+	return nil
 }
 
 // getNextComputation returns a computation hash given by
 // the server
 func fetchNextComputationToPerform() (computation.Computation, error) {
-	url := "http://" + config.Address + config.HeavyAssignmentPoint
-	resp, err := http.Get(url)
+	resp, err := request("GET", config.HeavyAssignmentPoint, nil)
 	if err != nil {
-		log.Print("Cannot connect to server")
+		config.Logger.Warn("Cannot connect to server", "err", err)
+		return computation.Computation{}, err
+	}
+	var c computation.Computation
+	if err := readAssignment(resp, &c); err != nil {
 		return computation.Computation{}, err
 	}
+	return c, nil
+}
+
+// fetchNextUnit returns a work unit leased by the server
+func fetchNextUnit() (computation.WorkUnit, error) {
+	resp, err := request("GET", config.UnitAssignmentPoint, nil)
+	if err != nil {
+		config.Logger.Warn("Cannot connect to server", "err", err)
+		return computation.WorkUnit{}, err
+	}
+	var u computation.WorkUnit
+	if err := readAssignment(resp, &u); err != nil {
+		return computation.WorkUnit{}, err
+	}
+	config.Logger.Info("Received unit", "unit", u.Id, "start", u.Start, "end", u.End, "server", config.Address)
+	return u, nil
+}
+
+// sendUnitResult sends the primes found in a work unit to the server
+func sendUnitResult(r computation.UnitResult) error {
+	json, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	resp, err := request("POST", config.UnitReturnPoint, json)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	computation := getUnMarshalledComputation(string(body))
-	return computation, nil
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		config.Logger.Warn("Server rejected unit", "unit", r.Id, "reason", errorMessage(body))
+	}
+	return nil
 }
 
-// LaunchClient launches the client application, and manages
-// goroutines
-func LaunchClient(c *app.Context) {
-	isHeavy := c.Bool("heavy")
-	sc := make(chan os.Signal, 1)
-	stemComputations := false
-	signal.Notify(sc, os.Interrupt)
-	go func() {
-		counter := 1
-		for sig := range sc {
-			stemComputations = true
-			if counter == 2 {
-				os.Exit(1)
-			}
-			fmt.Printf("\n\nCaptured %v, stemming acception of computations.. (Ctrl-C again to quit)\n\n", sig)
-			counter++
+// releaseToServer hands work the client will not finish back to the server,
+// so that it is reassigned without waiting for its lease to expire
+func releaseToServer(point string, work interface{}) {
+	json, err := json.Marshal(work)
+	if err != nil {
+		config.Logger.Error("Cannot encode work to hand back", "err", err)
+		return
+	}
+	resp, err := request("POST", point, json)
+	if err != nil {
+		config.Logger.Warn("Cannot hand work back to the server", "err", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// pause waits for d, or until ctx is cancelled, and reports whether d passed
+func pause(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sendWithRetries sends a result with send, trying again every second while
+// retry allows it and until ctx is cancelled, so that a client stopping
+// while the server is unreachable does not wait for it forever
+func sendWithRetries(ctx context.Context, retry func(error) bool, send func() error) {
+	err := send()
+	for err != nil && retry(err) && pause(ctx, 1*time.Second) {
+		config.Logger.Warn("Cannot send a result to the server, trying again", "err", err)
+		err = send()
+	}
+	if err != nil && ctx.Err() != nil {
+		config.Logger.Warn("Giving up on a result, as the client is stopping", "err", err)
+	}
+}
+
+// LaunchClient launches the client application, and manages goroutines
+// until ctx is cancelled. It then stops fetching work, finishes the work in
+// progress and sends back its results, and hands any work it had queued
+// back to the server. The client stops the same way if the server refuses
+// it, and returns why.
+func LaunchClient(ctx context.Context, c *app.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var refused error
+	var once sync.Once
+	retry := func(err error) bool {
+		if errors.Is(err, errRefused) {
+			once.Do(func() {
+				refused = err
+				cancel()
+			})
+			return false
 		}
-	}()
-	if isHeavy {
-		computationsToPerform := make(chan computation.Computation, 10)
-		validComputations := make(chan computation.Computation, 10)
-		invalidComputations := make(chan computation.Computation, 10)
+		return true
+	}
 
-		go func() {
-			for {
-				if stemComputations == false {
-					nextComputation, err := fetchNextComputationToPerform()
-					if err != nil {
-						time.Sleep(1 * time.Second)
-						log.Print("Retrying connection")
-						continue
-					}
-					computationsToPerform <- nextComputation
+	switch {
+	case c.Bool("heavy"):
+		runHeavyClient(ctx, retry)
+	case c.Bool("single"):
+		runSingleClient(ctx, retry)
+	default:
+		runUnitClient(ctx, retry)
+	}
+	config.Logger.Info("Client stopped")
+	return refused
+}
+
+// runHeavyClient performs computations of trial divisions. retry reports
+// whether to try again after a request to the server fails.
+func runHeavyClient(ctx context.Context, retry func(error) bool) {
+	computationsToPerform := make(chan computation.Computation, 10)
+	results := make(chan computation.Computation, 10)
+	metrics.ChannelDepths(map[string]func() int{
+		"computations": func() int { return len(computationsToPerform) },
+		"results":      func() int { return len(results) },
+	})
+
+	go func() {
+		defer close(computationsToPerform)
+		for ctx.Err() == nil {
+			nextComputation, err := fetchNextComputationToPerform()
+			if err != nil {
+				if !retry(err) {
+					break
 				}
+				pause(ctx, 1*time.Second)
+				config.Logger.Debug("Retrying connection")
+				continue
 			}
-		}()
+			computationsToPerform <- nextComputation
+		}
+	}()
 
-		go func() {
-			for c := range validComputations {
-				config.Logger.Printf("%s / %s valid.", c.Prime.Value, c.Divisor)
-				sendComputationResult(c)
+	var sending sync.WaitGroup
+	sending.Add(1)
+	go func() {
+		defer sending.Done()
+		for c := range results {
+			if c.IsValid {
+				config.Logger.Info("Candidate is divisible", "candidate", c.Prime.Value, "by", c.Factor)
+			} else {
+				config.Logger.Info("Candidate is not divisible", "candidate", c.Prime.Value, "from", c.Divisor, "to", c.DivisorEnd)
 			}
-		}()
-
-		go func() {
-			for c := range invalidComputations {
-				config.Logger.Printf("%s / %s invalid.", c.Prime.Value, c.Divisor)
-				sendComputationResult(c)
+			if err := sendComputationResult(c); err != nil {
+				config.Logger.Warn("Cannot send a computation", "err", err)
 			}
-		}()
+		}
+	}()
 
-		for c := range computationsToPerform {
-			i := c.Prime.Value
-			go func(i *big.Int, c computation.Computation) {
-				start := time.Now()
-				computationIsValid := computation.RunDistributedComputation(c)
-				duration := time.Now().Sub(start)
-				newPrimeDuration := c.Prime.TimeTaken + duration
-				if computationIsValid == true {
-					computationPrime := primes.Prime{
-						TimeTaken: newPrimeDuration,
-						Value:     i,
-						Id:        config.Id,
-					}
-					validComputations <- computation.Computation{
-						Prime:         computationPrime,
-						Divisor:       c.Divisor,
-						IsValid:       computationIsValid,
-						TimeTaken:     duration,
-						ComputationId: c.ComputationId,
-						Hash:          c.Hash,
-					}
-				} else {
-					computationPrime := primes.Prime{
-						TimeTaken: newPrimeDuration,
-						Value:     i,
-					}
-					invalidComputations <- computation.Computation{
-						Prime:         computationPrime,
-						Divisor:       c.Divisor,
-						IsValid:       computationIsValid,
-						TimeTaken:     duration,
-						ComputationId: c.ComputationId,
-						Hash:          c.Hash,
-					}
-				}
-			}(i, c)
+	var computing sync.WaitGroup
+	for c := range computationsToPerform {
+		if ctx.Err() != nil {
+			releaseToServer(config.HeavyReleasePoint, c)
+			continue
 		}
-	} else if !isHeavy {
-		primesToCompute := make(chan primes.Prime, 100)
-		validPrimes := make(chan primes.Prime, 100)
-		invalidPrimes := make(chan primes.Prime, 100)
+		computing.Add(1)
+		go func(c computation.Computation) {
+			defer computing.Done()
+			start := time.Now()
+			c.Factor = computation.RunDistributedComputation(c)
+			c.IsValid = c.Factor != nil
+			c.TimeTaken = time.Now().Sub(start)
+			results <- c
+		}(c)
+	}
+	computing.Wait()
+	close(results)
+	sending.Wait()
+}
 
-		go func() {
-			for {
-				if stemComputations == false {
-					nextPrime, err := fetchNextPrimeToPerform()
-					if err != nil {
-						time.Sleep(1 * time.Second)
-						log.Print("Retrying connection")
-						continue
-					}
-					primesToCompute <- nextPrime
+// runSingleClient tests one candidate per request
+func runSingleClient(ctx context.Context, retry func(error) bool) {
+	primesToCompute := make(chan primes.Prime, 100)
+	results := make(chan primes.Prime, 100)
+	metrics.ChannelDepths(map[string]func() int{
+		"candidates": func() int { return len(primesToCompute) },
+		"results":    func() int { return len(results) },
+	})
+
+	go func() {
+		defer close(primesToCompute)
+		for ctx.Err() == nil {
+			nextPrime, err := fetchNextPrimeToPerform()
+			if err != nil {
+				if !retry(err) {
+					break
 				}
+				pause(ctx, 1*time.Second)
+				config.Logger.Debug("Retrying connection")
+				continue
 			}
-		}()
+			primesToCompute <- nextPrime
+		}
+	}()
 
-		go func() {
-			for p := range validPrimes {
+	var sending sync.WaitGroup
+	sending.Add(1)
+	go func() {
+		defer sending.Done()
+		for p := range results {
+			if p.IsValid {
 				primes.DisplayPrimePretty(p.Value, p.TimeTaken)
-				err := sendPrimeResult(p)
-				for err != nil {
-					time.Sleep(1 * time.Second)
-					log.Print("Cannot send data back to server, trying again...")
-					err = sendPrimeResult(p)
-				}
+			} else {
+				primes.DisplayFailPretty(p.Value, p.TimeTaken)
 			}
-		}()
+			sendWithRetries(ctx, retry, func() error { return sendPrimeResult(p) })
+		}
+	}()
 
+	var computing sync.WaitGroup
+	for p := range primesToCompute {
+		if ctx.Err() != nil {
+			releaseToServer(config.ReleasePoint, p)
+			continue
+		}
+		computing.Add(1)
+		go func(p primes.Prime) {
+			defer computing.Done()
+			start := time.Now()
+			p.IsValid = primes.CheckPrimality(p.Value)
+			p.TimeTaken = time.Now().Sub(start)
+			metrics.CandidatesTested.Add(1)
+			metrics.TestDuration.Observe(p.TimeTaken)
+			if p.IsValid {
+				metrics.PrimesFound.Add(1)
+			}
+			results <- p
+		}(p)
+	}
+	computing.Wait()
+	close(results)
+	sending.Wait()
+}
+
+// runUnitClient decides ranges of candidates in config.Workers goroutines,
+// each fetching its next unit once it has sent back the last
+func runUnitClient(ctx context.Context, retry func(error) bool) {
+	var workers sync.WaitGroup
+	for w := 0; w < config.Workers; w++ {
+		workers.Add(1)
 		go func() {
-			for p := range invalidPrimes {
-				primes.DisplayFailPretty(p.Value, p.TimeTaken)
-				err := sendPrimeResult(p)
-				for err != nil {
-					time.Sleep(1 * time.Second)
-					log.Print("Cannot send data back to server, trying again...")
-					err = sendPrimeResult(p)
+			defer workers.Done()
+			for ctx.Err() == nil {
+				u, err := fetchNextUnit()
+				if err != nil {
+					if !retry(err) {
+						return
+					}
+					pause(ctx, 1*time.Second)
+					config.Logger.Debug("Retrying connection")
+					continue
+				}
+				r := computation.TestUnit(u)
+				found, _ := r.Found()
+				if candidates := u.Candidates(); candidates > 0 {
+					metrics.CandidatesTested.Add(candidates)
+					metrics.TestDuration.ObserveN(r.TimeTaken/time.Duration(candidates), candidates)
 				}
+				metrics.PrimesFound.Add(uint64(len(found)))
+				for _, p := range found {
+					primes.DisplayPrimePretty(p, r.TimeTaken/time.Duration(len(found)))
+				}
+				sendWithRetries(ctx, retry, func() error { return sendUnitResult(r) })
 			}
 		}()
-
-		for p := range primesToCompute {
-			i := p.Value
-			go func(i *big.Int, p primes.Prime) {
-				start := time.Now()
-				p.IsValid = primes.CheckPrimality(i)
-				duration := time.Now().Sub(start)
-				p.TimeTaken = duration
-				if p.IsValid == true {
-					validPrimes <- p
-				} else {
-					invalidPrimes <- p
-				}
-			}(i, p)
-		}
 	}
+	workers.Wait()
 }
@@ -0,0 +1,61 @@
+package computation
+
+import (
+	"math/big"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+)
+
+// Committer releases decided candidates in the order in which they were
+// generated, so that no prime is passed on to storage while a smaller
+// candidate is still undecided.
+type Committer struct {
+	next    uint64
+	pending map[uint64]primes.Prime
+}
+
+// candidate is a number to test, numbered in the order it was generated
+type candidate struct {
+	seq   uint64
+	value *big.Int
+}
+
+// decision is the outcome of testing a candidate
+type decision struct {
+	seq   uint64
+	prime primes.Prime
+}
+
+// NewCommitter returns a Committer expecting first as its first sequence number
+func NewCommitter(first uint64) *Committer {
+	return &Committer{next: first, pending: make(map[uint64]primes.Prime)}
+}
+
+// Decide records the outcome of candidate seq and returns, in order, every
+// outcome that no longer waits on an earlier candidate.
+func (c *Committer) Decide(seq uint64, p primes.Prime) []primes.Prime {
+	if seq < c.next {
+		return nil
+	}
+	c.pending[seq] = p
+	var committed []primes.Prime
+	for {
+		next, ok := c.pending[c.next]
+		if !ok {
+			return committed
+		}
+		delete(c.pending, c.next)
+		committed = append(committed, next)
+		c.next++
+	}
+}
+
+// Frontier returns the sequence number of the first undecided candidate
+func (c *Committer) Frontier() uint64 {
+	return c.next
+}
+
+// Pending returns the number of decided candidates held back by the frontier
+func (c *Committer) Pending() int {
+	return len(c.pending)
+}
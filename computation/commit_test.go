@@ -0,0 +1,61 @@
+package computation
+
+import (
+	"math/big"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+)
+
+func TestCommitterReleasesInCandidateOrder(t *testing.T) {
+	const candidates = 1000
+	committer := NewCommitter(0)
+	decisions := make(chan decision)
+	seqs := make(chan uint64, candidates)
+	for _, seq := range rand.Perm(candidates) {
+		seqs <- uint64(seq)
+	}
+	close(seqs)
+
+	// Workers decide candidates out of order, as the worker pool does.
+	var workers sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for seq := range seqs {
+				decisions <- decision{seq, primes.Prime{Value: new(big.Int).SetUint64(seq)}}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(decisions)
+	}()
+
+	decided := make(map[uint64]bool)
+	next := uint64(0)
+	for d := range decisions {
+		decided[d.seq] = true
+		for _, p := range committer.Decide(d.seq, d.prime) {
+			if p.Value.Uint64() != next {
+				t.Fatalf("Released candidate %s; want %d", p.Value, next)
+			}
+			next++
+		}
+		if next < candidates && decided[next] {
+			t.Fatalf("Candidate %d was decided but held back", next)
+		}
+		if committer.Frontier() != next || committer.Pending() != len(decided)-int(next) {
+			t.Fatalf("Frontier %d with %d pending; want %d with %d", committer.Frontier(), committer.Pending(), next, len(decided)-int(next))
+		}
+	}
+	if next != candidates {
+		t.Errorf("Released %d candidates; want %d", next, candidates)
+	}
+	if committer.Decide(3, primes.Prime{}) != nil {
+		t.Errorf("A candidate decided twice was released again")
+	}
+}
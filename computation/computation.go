@@ -1,87 +1,220 @@
 package computation
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"math/big"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/metrics"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
 
 	"github.com/satori/go.uuid"
 )
 
+// Computation is a range of trial divisions of one candidate handed to a
+// heavy client: the odd divisors from Divisor up to but not including
+// DivisorEnd. Every computation of a candidate carries the same Hash, and
+// ComputationId numbers it among them. IsValid is set on return when one of
+// the divisors divides the candidate, and Factor to that divisor, so that
+// the server can see for itself that the candidate is composite.
 type Computation struct {
 	Prime         primes.Prime
 	Divisor       *big.Int
+	DivisorEnd    *big.Int
 	IsValid       bool
+	Factor        *big.Int `json:",omitempty"`
 	TimeTaken     time.Duration
 	ComputationId *big.Int
 	Hash          uuid.UUID
 }
 
 // GetUnMarshalledPrime produces a computation from a JSON string
-func GetUnMarshalledPrime(body string) primes.Prime {
+func GetUnMarshalledPrime(body string) (primes.Prime, error) {
 	var c primes.Prime
-	err := json.Unmarshal([]byte(body), &c)
-	if err != nil {
-		config.Logger.Fatal(err)
+	if err := json.Unmarshal([]byte(body), &c); err != nil {
+		return primes.Prime{}, fmt.Errorf("cannot parse a prime: %v", err)
 	}
-	return c
+	return c, nil
 }
 
 // GenerateUUID generates a new, random UUID (v4)
-func GenerateUUID() uuid.UUID {
-	u, err := uuid.NewV4()
+func GenerateUUID() (uuid.UUID, error) {
+	return uuid.NewV4()
+}
+
+// commitWindowPerWorker bounds how many candidates each worker may run
+// ahead of the oldest undecided one
+const commitWindowPerWorker = 64
+
+// provePrimality proves whether i is prime. When no proof can be found,
+// such as when too little of i-1 factors, it falls back to CheckPrimality
+// and returns no certificate, so that generation carries on past i.
+func provePrimality(i *big.Int) (bool, *primes.Certificate) {
+	isPrime, certificate, err := primes.ProvePrimality(i)
 	if err != nil {
-		config.Logger.Fatal(err)
+		config.Logger.Warn("Cannot prove primality, testing it probabilistically instead", "n", i, "err", err)
+		return primes.CheckPrimality(i), nil
 	}
-	return u
+	return isPrime, certificate
 }
 
-// getComputation produces a Computation struct given its values
-func getComputation(prime primes.Prime, divisor *big.Int, computationId *big.Int) Computation {
-	nextUUID := GenerateUUID()
-	computationStruct := Computation{prime, divisor, prime.IsValid, 0 * time.Second, computationId, nextUUID}
-	return computationStruct
+// getMarshalledCertificate produces the JSON certificate of a prime, proving
+// it first if the engine that found it did not, or nil if it has none
+func getMarshalledCertificate(p primes.Prime) ([]byte, error) {
+	certificate := p.Certificate
+	if certificate == nil {
+		if _, certificate = provePrimality(p.Value); certificate == nil {
+			return nil, nil
+		}
+	}
+	return json.Marshal(certificate)
 }
 
-// ComputePrimes computes primes concurrently until KeyboardInterrupt
-func ComputePrimes(lastPrime *big.Int, writeToFile bool, toInfinity bool, maxNumber *big.Int) {
-	numbersToCheck := make(chan *big.Int, 100)
+// ComputePrimes computes primes above lastPrime concurrently until ctx is
+// cancelled, or until maxNumber unless toInfinity. Candidates are tested by a
+// pool of config.Workers goroutines, which block whenever the storage writer
+// falls behind, and primes reach storage strictly in order. Once ctx is
+// cancelled no more candidates are produced, the candidates already handed
+// to workers are decided, and the partly filled buffer is stored before
+// ComputePrimes returns. A prime that cannot be proven or stored stops the
+// computation the same way, without storing anything after it, and its
+// error is returned. A config.MaxBufferSize below 1 is refused, as the
+// buffer would never fill and nothing would be stored.
+func ComputePrimes(ctx context.Context, lastPrime *big.Int, writeToFile bool, toInfinity bool, maxNumber *big.Int) error {
+	if config.MaxBufferSize < 1 {
+		return fmt.Errorf("the maximum buffer size must be at least 1, not %d", config.MaxBufferSize)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failure error
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	numbersToCheck := make(chan candidate, config.Workers)
+	decisions := make(chan decision, config.Workers)
+	window := make(chan bool, config.Workers*commitWindowPerWorker)
 	validPrimes := make(chan primes.Prime, 100)
 	invalidPrimes := make(chan primes.Prime, 100)
 	var primeBuffer storage.BigIntSlice
+	var workers, outputs sync.WaitGroup
+	metrics.ChannelDepths(map[string]func() int{
+		"candidates":    func() int { return len(numbersToCheck) },
+		"decisions":     func() int { return len(decisions) },
+		"validPrimes":   func() int { return len(validPrimes) },
+		"invalidPrimes": func() int { return len(invalidPrimes) },
+	})
 
 	go func() {
-		if toInfinity {
-			for i := lastPrime; true; i.Add(i, big.NewInt(2)) {
-				numberToTest := big.NewInt(0).Set(i)
-				numbersToCheck <- numberToTest
+		defer close(numbersToCheck)
+		if config.Engine == EngineSieve {
+			lastPrime = runSieveEngine(ctx, lastPrime, toInfinity, maxNumber, validPrimes)
+			if lastPrime == nil {
+				return
+			}
+		}
+		seq := uint64(0)
+		send := func(i *big.Int) bool {
+			select {
+			case window <- true:
+			case <-ctx.Done():
+				return false
 			}
-		} else {
-			for i := lastPrime; i.Cmp(maxNumber) == -1; i.Add(i, big.NewInt(2)) {
-				numberToTest := big.NewInt(0).Set(i)
-				numbersToCheck <- numberToTest
+			numbersToCheck <- candidate{seq, big.NewInt(0).Set(i)}
+			seq++
+			return true
+		}
+		// 2 is the only even prime, which the odd candidates skip, and is
+		// where the sieve starts too.
+		two := big.NewInt(2)
+		if lastPrime.Cmp(two) < 0 && (toInfinity || two.Cmp(maxNumber) == -1) && !send(two) {
+			return
+		}
+		for i := nextOddNumber(lastPrime); toInfinity || i.Cmp(maxNumber) == -1; i.Add(i, big.NewInt(2)) {
+			if !send(i) {
+				return
+			}
+		}
+	}()
+
+	outputs.Add(3)
+	go func() {
+		defer outputs.Done()
+		committer := NewCommitter(0)
+		for d := range decisions {
+			for _, p := range committer.Decide(d.seq, d.prime) {
+				<-window
+				if p.IsValid {
+					validPrimes <- p
+				} else {
+					invalidPrimes <- p
+				}
 			}
 		}
+		close(validPrimes)
+		close(invalidPrimes)
 	}()
 
 	go func() {
+		defer outputs.Done()
+		certificates := make(map[string][]byte)
+		failed := false
+		flush := func() {
+			var err error
+			if writeToFile && config.Prove {
+				err = storage.AppendPrimes(primeBuffer, certificates)
+			} else if writeToFile {
+				err = storage.AppendPrimes(primeBuffer, nil)
+			}
+			if err != nil {
+				failed = true
+				fail(err)
+			}
+			primeBuffer = nil
+			certificates = make(map[string][]byte)
+		}
 		for elem := range validPrimes {
+			if failed {
+				continue
+			}
 			primeBuffer = append(primeBuffer, elem.Value)
-			if len(primeBuffer) == config.MaxBufferSize {
-				if writeToFile {
-					storage.FlushBufferToFile(primeBuffer)
+			if config.Prove {
+				certificate, err := getMarshalledCertificate(elem)
+				if err != nil {
+					// The primes before this one are still stored.
+					primeBuffer = primeBuffer[:len(primeBuffer)-1]
+					failed = true
+					fail(err)
+					continue
+				}
+				if certificate != nil {
+					certificates[elem.Value.String()] = certificate
 				}
-				primeBuffer = nil
 			}
+			if len(primeBuffer) == config.MaxBufferSize {
+				flush()
+			}
+			metrics.PrimesFound.Add(1)
 			primes.DisplayPrimePretty(elem.Value, elem.TimeTaken)
 		}
+		if len(primeBuffer) > 0 {
+			config.Logger.Info("Storing the last primes found", "primes", len(primeBuffer))
+			flush()
+		}
 	}()
 
 	go func() {
+		defer outputs.Done()
 		for elem := range invalidPrimes {
 			if config.ShowFails == true {
 				primes.DisplayFailPretty(elem.Value, elem.TimeTaken)
@@ -89,57 +222,73 @@ func ComputePrimes(lastPrime *big.Int, writeToFile bool, toInfinity bool, maxNum
 		}
 	}()
 
-	for i := range numbersToCheck {
-		go func(i *big.Int) {
-			start := time.Now()
-			isPrime := primes.CheckPrimality(i)
-			if isPrime == true {
-				validPrimes <- primes.Prime{
-					TimeTaken: time.Now().Sub(start),
-					Value:     i,
-					Id:        config.Id,
-				}
-			} else {
-				invalidPrimes <- primes.Prime{
-					TimeTaken: time.Now().Sub(start),
-					Value:     i,
-				}
+	for w := 0; w < config.Workers; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for c := range numbersToCheck {
+				p := testCandidate(c.value)
+				metrics.CandidatesTested.Add(1)
+				metrics.TestDuration.Observe(p.TimeTaken)
+				decisions <- decision{c.seq, p}
 			}
-		}(i)
+		}()
 	}
+
+	workers.Wait()
+	close(decisions)
+	outputs.Wait()
+	return failure
 }
 
-// RunDistributedComputation calculates the modulus of a given Computation
-func RunDistributedComputation(c Computation) bool {
-	var computationIsValid bool
-	modulus := big.NewInt(0).Mod(c.Prime.Value, c.Divisor)
-	if modulus.Cmp(big.NewInt(0)) == 0 {
-		computationIsValid = true
-	} else {
-		computationIsValid = false
+// nextOddNumber returns the smallest odd number greater than n
+func nextOddNumber(n *big.Int) *big.Int {
+	if n.Bit(0) == 0 {
+		return new(big.Int).Add(n, big.NewInt(1))
 	}
-	return computationIsValid
+	return new(big.Int).Add(n, big.NewInt(2))
 }
 
-// getDivisorsOfPrime returns a slice containing all good divisors of a prime
-func getDivisorsOfPrime(i *big.Int) storage.BigIntSlice {
-	var divisorsOfPrime storage.BigIntSlice
-	squareRoot := big.NewInt(0).Sqrt(i)
-	for n := big.NewInt(3); n.Cmp(squareRoot) == -1; n.Add(n, big.NewInt(2)) {
-		divisor := new(big.Int).Set(n)
-		divisorsOfPrime = append(divisorsOfPrime, divisor)
+// testCandidate decides whether i is prime
+func testCandidate(i *big.Int) primes.Prime {
+	start := time.Now()
+	var isPrime bool
+	var certificate *primes.Certificate
+	if config.Prove {
+		isPrime, certificate = provePrimality(i)
+	} else {
+		isPrime = primes.CheckPrimality(i)
+	}
+	if isPrime == true {
+		return primes.Prime{
+			TimeTaken:   time.Now().Sub(start),
+			Value:       i,
+			Id:          atomic.LoadUint64(&config.Id),
+			IsValid:     true,
+			Certificate: certificate,
+		}
+	}
+	return primes.Prime{
+		TimeTaken: time.Now().Sub(start),
+		Value:     i,
 	}
-	return divisorsOfPrime
 }
 
-// GetComputationsToPerform passes all computations needed to be performed to a channel
-func GetComputationsToPerform(prime primes.Prime) []Computation {
-	var computations []Computation
-	divisors := getDivisorsOfPrime(prime.Value)
-	for i, v := range divisors {
-		computationId := big.NewInt(int64(i))
-		nextComputation := getComputation(prime, v, computationId)
-		computations = append(computations, nextComputation)
+// RunDistributedComputation divides the candidate of a Computation by each
+// divisor in its range, stopping at the first that divides it, and returns
+// that divisor, or nil if none did
+func RunDistributedComputation(c Computation) *big.Int {
+	modulus := new(big.Int)
+	for d := new(big.Int).Set(c.Divisor); d.Cmp(c.DivisorEnd) < 0; d.Add(d, big.NewInt(2)) {
+		if modulus.Mod(c.Prime.Value, d).Sign() == 0 {
+			return d
+		}
 	}
-	return computations
+	return nil
+}
+
+// IsFactor reports whether d is a divisor of n other than 1 and n, which
+// shows that n is composite
+func IsFactor(d *big.Int, n *big.Int) bool {
+	return d != nil && n != nil && d.Cmp(big.NewInt(1)) > 0 && d.Cmp(n) < 0 && new(big.Int).Mod(n, d).Sign() == 0
 }
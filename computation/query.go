@@ -0,0 +1,141 @@
+package computation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+// getArchiveOffset returns the first stored prime and the number of primes
+// below it, and false if the archive is empty or starts too far along to use
+func getArchiveOffset() (*big.Int, uint64, bool, error) {
+	first, err := storage.GetFirstPrime()
+	if err != nil || first == nil {
+		return nil, 0, false, err
+	}
+	offset, ok := primes.CountPrimesBelow(first)
+	return first, offset, ok, nil
+}
+
+// ErrBeyondLimit is returned by NthPrime and PrimePi when answering would
+// take computing more primes past the archive than they were allowed.
+var ErrBeyondLimit = errors.New("too many primes to compute past the archive")
+
+// walkPrimesAfter passes every prime above from to fn, in ascending order,
+// until fn returns false, sieving while the primes fit in a uint64. It
+// gives up with ErrBeyondLimit once limit primes have been passed, or with
+// the error of ctx once it is done.
+func walkPrimesAfter(ctx context.Context, from *big.Int, limit uint64, fn func(p *big.Int) bool) error {
+	walked := uint64(0)
+	var err error
+	visit := func(p *big.Int) bool {
+		if walked == limit {
+			err = fmt.Errorf("%w: more than %d", ErrBeyondLimit, limit)
+			return false
+		}
+		if walked++; walked%1024 == 0 && ctx.Err() != nil {
+			err = ctx.Err()
+			return false
+		}
+		return fn(p)
+	}
+
+	next := new(big.Int).Set(from)
+	if from.IsUint64() {
+		stopped := false
+		reached := SievePrimes(from.Uint64(), 0, func(p uint64, timeTaken time.Duration) bool {
+			stopped = !visit(new(big.Int).SetUint64(p))
+			return !stopped
+		})
+		if stopped {
+			return err
+		}
+		next.SetUint64(reached - 1)
+	}
+	for i := nextOddNumber(next); ; i.Add(i, big.NewInt(2)) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if primes.CheckPrimality(i) && !visit(new(big.Int).Set(i)) {
+			return err
+		}
+	}
+}
+
+// NthPrime returns the n-th prime, the first being 2, looking it up in the
+// archive and computing on from the largest stored prime when it lies
+// beyond, for at most limit primes.
+func NthPrime(ctx context.Context, n uint64, limit uint64) (*big.Int, error) {
+	if n == 0 {
+		return nil, fmt.Errorf("there is no 0th prime")
+	}
+	from, found := big.NewInt(0), uint64(0)
+	_, offset, ok, err := getArchiveOffset()
+	if err != nil {
+		return nil, err
+	}
+	if ok && n > offset {
+		p, stored, err := storage.GetStoredPrime(n - offset - 1)
+		if err != nil || stored {
+			return p, err
+		}
+		count, err := storage.GetPrimeCount()
+		if err != nil {
+			return nil, err
+		}
+		if from, err = storage.GetLargestPrime(); err != nil {
+			return nil, err
+		}
+		found = offset + count
+		config.Logger.Info("Prime is beyond the archive, computing on", "n", n, "from", from)
+	}
+
+	var nth *big.Int
+	err = walkPrimesAfter(ctx, from, limit, func(p *big.Int) bool {
+		found++
+		if found == n {
+			nth = p
+			return false
+		}
+		return true
+	})
+	return nth, err
+}
+
+// PrimePi returns the number of primes that do not exceed x, counting the
+// archive and computing on from the largest stored prime when x lies
+// beyond, for at most limit primes.
+func PrimePi(ctx context.Context, x *big.Int, limit uint64) (uint64, error) {
+	from, count := big.NewInt(0), uint64(0)
+	first, offset, ok, err := getArchiveOffset()
+	if err != nil {
+		return 0, err
+	}
+	if ok && x.Cmp(first) >= 0 {
+		stored, err := storage.CountStoredPrimes(x)
+		if err != nil {
+			return 0, err
+		}
+		largest, err := storage.GetLargestPrime()
+		if err != nil || x.Cmp(largest) <= 0 {
+			return offset + stored, err
+		}
+		from, count = largest, offset+stored
+		config.Logger.Info("Number is beyond the archive, computing on", "x", x, "from", from)
+	}
+
+	err = walkPrimesAfter(ctx, from, limit, func(p *big.Int) bool {
+		if p.Cmp(x) > 0 {
+			return false
+		}
+		count++
+		return true
+	})
+	return count, err
+}
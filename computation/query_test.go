@@ -0,0 +1,37 @@
+package computation
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestWalkPrimesAfterStops(t *testing.T) {
+	for _, from := range []*big.Int{big.NewInt(0), new(big.Int).Lsh(big.NewInt(1), 64)} {
+		walked := 0
+		err := walkPrimesAfter(context.Background(), from, 10, func(p *big.Int) bool {
+			walked++
+			return true
+		})
+		if !errors.Is(err, ErrBeyondLimit) || walked != 10 {
+			t.Errorf("Walking from %s passed %d primes and returned %v; want 10 and ErrBeyondLimit", from, walked, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = walkPrimesAfter(ctx, from, 1<<40, func(p *big.Int) bool { return true })
+		if err != context.Canceled {
+			t.Errorf("Walking from %s after cancelling returned %v; want context.Canceled", from, err)
+		}
+	}
+
+	walked := 0
+	err := walkPrimesAfter(context.Background(), big.NewInt(0), 10, func(p *big.Int) bool {
+		walked++
+		return walked < 5
+	})
+	if err != nil || walked != 5 {
+		t.Errorf("Walking until fn stopped passed %d primes and returned %v; want 5 and nil", walked, err)
+	}
+}
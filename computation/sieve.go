@@ -0,0 +1,324 @@
+package computation
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+const (
+	// EngineProbable tests every odd candidate with ProbablyPrime.
+	EngineProbable = "probable"
+	// EngineSieve runs a segmented sieve of Eratosthenes.
+	EngineSieve = "sieve"
+
+	// wheelModulus is the product of the wheel primes 2, 3, 5 and 7.
+	wheelModulus = 210
+	// wheelSize is the number of residues coprime to wheelModulus.
+	wheelSize = 48
+
+	// sieveSegmentBytes keeps each segment inside a typical L1 data cache.
+	sieveSegmentBytes  = 32 * 1024
+	sieveSegmentBlocks = sieveSegmentBytes / wheelSize
+	sieveSegmentSpan   = sieveSegmentBlocks * wheelModulus
+
+	// sieveLimit is where the sieve stops so that no multiple it crosses
+	// off can overflow a uint64. ProbablyPrime takes over from there.
+	sieveLimit = math.MaxUint64 - 1<<40
+)
+
+var (
+	wheelPrimes   = []uint64{2, 3, 5, 7}
+	wheelResidues [wheelSize]uint64
+	wheelGaps     [wheelSize]uint64
+	wheelIndex    [wheelModulus]int
+
+	// basePrimes holds every prime above the wheel primes up to
+	// basePrimesLimit, used to cross off composites in each segment. The
+	// first ones needed are loaded from the archive if it passes
+	// loadBasePrimes' check, and the rest are sieved. Both are only
+	// extended, under basePrimesMu, so a copy of basePrimes taken under it
+	// stays valid.
+	basePrimes       []uint32
+	basePrimesLimit  uint64 = 10
+	basePrimesLoaded bool
+	basePrimesMu     sync.Mutex
+)
+
+// baseCheckLimit bounds the range that loadBasePrimes sieves to check the
+// archive against.
+const baseCheckLimit = 1 << 16
+
+func init() {
+	n := 0
+	for r := uint64(0); r < wheelModulus; r++ {
+		wheelIndex[r] = -1
+		if r%2 != 0 && r%3 != 0 && r%5 != 0 && r%7 != 0 {
+			wheelIndex[r] = n
+			wheelResidues[n] = r
+			n++
+		}
+	}
+	for i := 0; i < wheelSize-1; i++ {
+		wheelGaps[i] = wheelResidues[i+1] - wheelResidues[i]
+	}
+	wheelGaps[wheelSize-1] = wheelModulus + wheelResidues[0] - wheelResidues[wheelSize-1]
+}
+
+// isqrt returns the largest integer whose square does not exceed n
+func isqrt(n uint64) uint64 {
+	r := uint64(math.Sqrt(float64(n)))
+	for r > 0 && (r > math.MaxUint32 || r*r > n) {
+		r--
+	}
+	for r < math.MaxUint32 && (r+1)*(r+1) <= n {
+		r++
+	}
+	return r
+}
+
+// nextWheelNumber returns the smallest number not below k that is coprime
+// to the wheel, along with its position on the wheel.
+func nextWheelNumber(k uint64) (uint64, int) {
+	base, r := k-k%wheelModulus, k%wheelModulus
+	for wheelIndex[r] == -1 {
+		r++
+		if r == wheelModulus {
+			base, r = base+wheelModulus, 1
+		}
+	}
+	return base + r, wheelIndex[r]
+}
+
+// extendBasePrimes sieves the odd numbers above basePrimesLimit up to and
+// including limit, which must not exceed the square of basePrimesLimit.
+func extendBasePrimes(limit uint64) {
+	composite := make([]bool, sieveSegmentBytes)
+	for low := basePrimesLimit + 1; low <= limit; low += uint64(len(composite)) {
+		high := low + uint64(len(composite)) - 1
+		if high > limit {
+			high = limit
+		}
+		for i := range composite {
+			composite[i] = false
+		}
+		crossOff := func(p uint64) bool {
+			if p*p > high {
+				return false
+			}
+			start := (low + p - 1) / p * p
+			if start < p*p {
+				start = p * p
+			}
+			for m := start; m <= high; m += p {
+				composite[m-low] = true
+			}
+			return true
+		}
+		for _, p := range wheelPrimes[1:] {
+			crossOff(p)
+		}
+		for _, p := range basePrimes {
+			if !crossOff(uint64(p)) {
+				break
+			}
+		}
+		for n := low; n <= high; n++ {
+			if n > 7 && n%2 != 0 && !composite[n-low] {
+				basePrimes = append(basePrimes, uint32(n))
+			}
+		}
+	}
+	basePrimesLimit = limit
+}
+
+// sieveBasePrimes sieves every prime up to limit into basePrimes
+func sieveBasePrimes(limit uint64) {
+	for basePrimesLimit < limit {
+		next := limit
+		if basePrimesLimit*basePrimesLimit < next {
+			next = basePrimesLimit * basePrimesLimit
+		}
+		extendBasePrimes(next)
+	}
+}
+
+// loadBasePrimes replaces basePrimes with the stored primes up to limit, and
+// reports whether it did. The archive must reach limit and pass
+// checkBasePrimes, so that a damaged archive is caught before its gaps let
+// composites through.
+func loadBasePrimes(limit uint64) bool {
+	largest, err := storage.GetLargestPrime()
+	if err != nil || largest == nil || (largest.IsUint64() && largest.Uint64() < limit) {
+		return false
+	}
+	var stored []uint32
+	err = storage.WalkStoredPrimes(big.NewInt(11), new(big.Int).SetUint64(limit), func(position uint64, p *big.Int) bool {
+		stored = append(stored, uint32(p.Uint64()))
+		return true
+	})
+	if err != nil || !checkBasePrimes(stored, limit) {
+		config.Logger.Warn("Sieving the base primes, as the stored primes do not match them", "limit", limit, "err", err)
+		return false
+	}
+	basePrimes, basePrimesLimit = stored, limit
+	return true
+}
+
+// checkBasePrimes reports whether stored, the stored primes above the wheel
+// primes up to limit, rises strictly and holds exactly the primes that a
+// sieve finds up to limit or baseCheckLimit, whichever is lower.
+func checkBasePrimes(stored []uint32, limit uint64) bool {
+	checkLimit := limit
+	if checkLimit > baseCheckLimit {
+		checkLimit = baseCheckLimit
+	}
+	sieveBasePrimes(checkLimit)
+	sieved := basePrimes[:sort.Search(len(basePrimes), func(i int) bool {
+		return uint64(basePrimes[i]) > checkLimit
+	})]
+	for i, p := range stored {
+		switch {
+		case i > 0 && p <= stored[i-1]:
+			return false
+		case uint64(p) <= checkLimit && (i >= len(sieved) || sieved[i] != p):
+			return false
+		case uint64(p) > checkLimit && i < len(sieved):
+			return false
+		}
+	}
+	return len(stored) >= len(sieved)
+}
+
+// ensureBasePrimes makes sure every prime up to limit is in basePrimes,
+// loading them from the archive the first time. The caller must hold
+// basePrimesMu.
+func ensureBasePrimes(limit uint64) {
+	if basePrimesLimit >= limit {
+		return
+	}
+	if !basePrimesLoaded {
+		basePrimesLoaded = true
+		if loadBasePrimes(limit) {
+			return
+		}
+	}
+	sieveBasePrimes(limit)
+}
+
+// sieveSegment marks the composites among the wheel numbers of the segment
+// starting at low, which must be a multiple of wheelModulus.
+func sieveSegment(segment []bool, low uint64) {
+	high := low + uint64(len(segment)/wheelSize)*wheelModulus
+	for i := range segment {
+		segment[i] = false
+	}
+	basePrimesMu.Lock()
+	ensureBasePrimes(isqrt(high))
+	bases := basePrimes
+	basePrimesMu.Unlock()
+	for _, bp := range bases {
+		p := uint64(bp)
+		if p*p >= high {
+			break
+		}
+		k := (low + p - 1) / p
+		if k < p {
+			k = p
+		}
+		k, w := nextWheelNumber(k)
+		for m := p * k; m < high; m = p * k {
+			offset := m - low
+			segment[offset/wheelModulus*wheelSize+uint64(wheelIndex[offset%wheelModulus])] = true
+			k += wheelGaps[w]
+			if w++; w == wheelSize {
+				w = 0
+			}
+		}
+	}
+}
+
+// SievePrimes streams every prime p with from < p < to to fn, in ascending
+// order, until fn returns false. A to of 0 leaves the range unbounded. It
+// returns the point below which every number has been decided, which falls
+// short of to only when fn stops early or sieveLimit is reached.
+func SievePrimes(from, to uint64, fn func(p uint64, timeTaken time.Duration) bool) uint64 {
+	for _, p := range wheelPrimes {
+		if p > from && (to == 0 || p < to) && !fn(p, 0) {
+			return p + 1
+		}
+	}
+
+	segment := make([]bool, sieveSegmentBlocks*wheelSize)
+	for low := from - from%wheelModulus; ; low += sieveSegmentSpan {
+		if to != 0 && low >= to {
+			return to
+		}
+		if low > sieveLimit-sieveSegmentSpan {
+			return low
+		}
+		start := time.Now()
+		sieveSegment(segment, low)
+		found := 1
+		for _, isComposite := range segment {
+			if !isComposite {
+				found++
+			}
+		}
+		timeTaken := time.Now().Sub(start) / time.Duration(found)
+
+		for i, isComposite := range segment {
+			if isComposite {
+				continue
+			}
+			n := low + uint64(i/wheelSize)*wheelModulus + wheelResidues[i%wheelSize]
+			if n <= from || n == 1 {
+				continue
+			}
+			if to != 0 && n >= to {
+				return to
+			}
+			if !fn(n, timeTaken) {
+				return n + 1
+			}
+		}
+	}
+}
+
+// runSieveEngine feeds the primes above lastPrime into validPrimes using the
+// sieve. It returns the number above which ProbablyPrime must carry on, or
+// nil if the sieve covered the whole requested range or ctx was cancelled.
+func runSieveEngine(ctx context.Context, lastPrime *big.Int, toInfinity bool, maxNumber *big.Int, validPrimes chan<- primes.Prime) *big.Int {
+	if !lastPrime.IsUint64() {
+		return lastPrime
+	}
+	to := uint64(0)
+	if !toInfinity && maxNumber.IsUint64() {
+		to = maxNumber.Uint64()
+	}
+	next := SievePrimes(lastPrime.Uint64(), to, func(p uint64, timeTaken time.Duration) bool {
+		select {
+		case validPrimes <- primes.Prime{
+			TimeTaken: timeTaken,
+			Value:     new(big.Int).SetUint64(p),
+			Id:        atomic.LoadUint64(&config.Id),
+			IsValid:   true,
+		}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	if (to != 0 && next >= to) || ctx.Err() != nil {
+		return nil
+	}
+	return new(big.Int).SetUint64(next - 1)
+}
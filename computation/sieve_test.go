@@ -0,0 +1,138 @@
+package computation
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+// resetBasePrimes forgets every base prime, and whether they were loaded,
+// for the length of the test
+func resetBasePrimes(t *testing.T, loaded bool) {
+	basePrimesMu.Lock()
+	defer basePrimesMu.Unlock()
+	primes, limit, loaded0 := basePrimes, basePrimesLimit, basePrimesLoaded
+	t.Cleanup(func() {
+		basePrimesMu.Lock()
+		defer basePrimesMu.Unlock()
+		basePrimes, basePrimesLimit, basePrimesLoaded = primes, limit, loaded0
+	})
+	basePrimes, basePrimesLimit, basePrimesLoaded = nil, 10, loaded
+}
+
+// basePrimesBetween returns the primes p with from <= p < to
+func basePrimesBetween(from, to uint32) []uint32 {
+	var found []uint32
+	for n := from; n < to; n++ {
+		if big.NewInt(int64(n)).ProbablyPrime(20) {
+			found = append(found, n)
+		}
+	}
+	return found
+}
+
+func TestCheckBasePrimesCatchesADamagedArchive(t *testing.T) {
+	resetBasePrimes(t, true)
+	basePrimesMu.Lock()
+	defer basePrimesMu.Unlock()
+
+	good := basePrimesBetween(11, 2001)
+	missing := append(basePrimesBetween(11, 1009), basePrimesBetween(1010, 2001)...)
+	composite := append(basePrimesBetween(11, 1001), append([]uint32{1001}, basePrimesBetween(1002, 2001)...)...)
+	swapped := append([]uint32{}, good...)
+	swapped[10], swapped[11] = swapped[11], swapped[10]
+	for _, c := range []struct {
+		name   string
+		stored []uint32
+		limit  uint64
+		want   bool
+	}{
+		{"intact", good, 2000, true},
+		{"intact beyond the checked range", basePrimesBetween(11, 70001), 70000, true},
+		{"missing 1009", missing, 2000, false},
+		{"holding 1001", composite, 2000, false},
+		{"out of order", swapped, 2000, false},
+		{"stopping short", basePrimesBetween(11, 1500), 2000, false},
+	} {
+		if got := checkBasePrimes(c.stored, c.limit); got != c.want {
+			t.Errorf("Checking base primes %s returned %v; want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLoadBasePrimesFromTheArchive(t *testing.T) {
+	base, directory, journal, index, database := config.Base, config.Directory, config.Journal, config.Index, config.Database
+	format, store, maxFilesize := config.Format, config.Store, config.MaxFilesize
+	t.Cleanup(func() {
+		config.Base, config.Directory, config.Journal, config.Index, config.Database = base, directory, journal, index, database
+		config.Format, config.Store, config.MaxFilesize = format, store, maxFilesize
+	})
+	config.Base = t.TempDir() + "/"
+	config.Directory = config.Base + "directory.txt"
+	config.Journal = config.Base + "journal.txt"
+	config.Index = config.Base + "index.json"
+	config.Database = config.Base + "primes.db"
+	config.Format, config.Store, config.MaxFilesize = "text", "files", 100
+
+	var buffer storage.BigIntSlice
+	for _, p := range append([]uint32{2, 3, 5, 7}, basePrimesBetween(11, 3000)...) {
+		buffer = append(buffer, big.NewInt(int64(p)))
+	}
+	if err := storage.AppendPrimes(buffer, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resetBasePrimes(t, true)
+	basePrimesMu.Lock()
+	defer basePrimesMu.Unlock()
+	if loadBasePrimes(5000) {
+		t.Errorf("Loaded base primes up to 5000 from an archive that stops below 3000")
+	}
+	if !loadBasePrimes(1000) || basePrimesLimit != 1000 {
+		t.Fatalf("Did not load base primes up to 1000 from the archive")
+	}
+	want := basePrimesBetween(11, 1001)
+	if len(basePrimes) != len(want) {
+		t.Fatalf("Loaded %d base primes up to 1000; want %d", len(basePrimes), len(want))
+	}
+	for i := range want {
+		if basePrimes[i] != want[i] {
+			t.Fatalf("Loaded %d as base prime %d; want %d", basePrimes[i], i, want[i])
+		}
+	}
+}
+
+func TestSievePrimesConcurrently(t *testing.T) {
+	resetBasePrimes(t, true)
+	var wg sync.WaitGroup
+	counts := make([]int, 4)
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from := uint64(1)<<40 + uint64(i)<<32
+			SievePrimes(from, from+200000, func(p uint64, timeTaken time.Duration) bool {
+				counts[i]++
+				return true
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, count := range counts {
+		from := uint64(1)<<40 + uint64(i)<<32
+		want := 0
+		for n := from + 1; n < from+200000; n += 2 {
+			if new(big.Int).SetUint64(n).ProbablyPrime(20) {
+				want++
+			}
+		}
+		if count != want {
+			t.Errorf("Sieved %d primes above %d alongside other sieves; want %d", count, from, want)
+		}
+	}
+}
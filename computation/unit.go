@@ -0,0 +1,99 @@
+package computation
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+)
+
+// WorkUnit is a contiguous range of candidates handed to a client in one
+// round trip: the odd numbers n with Start <= n < End. Start is always odd.
+type WorkUnit struct {
+	Id    uint64
+	Start *big.Int
+	End   *big.Int
+}
+
+// UnitResult carries the primes a client found in a WorkUnit, either as a
+// list or as a bitmap with bit i set when Start+2i is prime, whichever is
+// smaller to send.
+type UnitResult struct {
+	Id        uint64
+	Start     *big.Int
+	End       *big.Int
+	Primes    []*big.Int `json:",omitempty"`
+	Bitmap    []byte     `json:",omitempty"`
+	TimeTaken time.Duration
+}
+
+// Candidates returns the number of odd numbers in the unit
+func (u WorkUnit) Candidates() uint64 {
+	span := new(big.Int).Sub(u.End, u.Start)
+	return new(big.Int).Rsh(span.Add(span, big.NewInt(1)), 1).Uint64()
+}
+
+// TestUnit decides every candidate of a unit with CheckPrimality
+func TestUnit(u WorkUnit) UnitResult {
+	start := time.Now()
+	candidates := u.Candidates()
+	bitmap := make([]byte, (candidates+7)/8)
+	var found []*big.Int
+	listSize := 0
+	n := new(big.Int).Set(u.Start)
+	for i := uint64(0); i < candidates; i++ {
+		if primes.CheckPrimality(n) {
+			bitmap[i/8] |= 1 << (i % 8)
+			found = append(found, new(big.Int).Set(n))
+			listSize += len(n.String()) + 1
+		}
+		n.Add(n, big.NewInt(2))
+	}
+
+	result := UnitResult{
+		Id:        u.Id,
+		Start:     u.Start,
+		End:       u.End,
+		TimeTaken: time.Now().Sub(start),
+	}
+	// The bitmap is sent as base64, a third larger than its bytes.
+	if len(bitmap)*4/3 < listSize {
+		result.Bitmap = bitmap
+	} else {
+		result.Primes = found
+	}
+	return result
+}
+
+// Found returns the primes in the result in ascending order, checking that
+// they all lie among the candidates of the unit
+func (r UnitResult) Found() ([]*big.Int, error) {
+	if r.Start == nil || r.End == nil || r.Start.Bit(0) == 0 {
+		return nil, fmt.Errorf("unit %d has no valid range", r.Id)
+	}
+	unit := WorkUnit{Id: r.Id, Start: r.Start, End: r.End}
+	candidates := unit.Candidates()
+	if r.Bitmap != nil {
+		if uint64(len(r.Bitmap)) != (candidates+7)/8 {
+			return nil, fmt.Errorf("unit %d has a bitmap of %d bytes for %d candidates", r.Id, len(r.Bitmap), candidates)
+		}
+		var found []*big.Int
+		for i := uint64(0); i < candidates; i++ {
+			if r.Bitmap[i/8]&(1<<(i%8)) != 0 {
+				offset := new(big.Int).SetUint64(2 * i)
+				found = append(found, offset.Add(offset, r.Start))
+			}
+		}
+		return found, nil
+	}
+
+	previous := new(big.Int).Sub(r.Start, big.NewInt(1))
+	for _, p := range r.Primes {
+		if p == nil || p.Cmp(previous) <= 0 || p.Cmp(r.End) >= 0 || p.Bit(0) == 0 {
+			return nil, fmt.Errorf("unit %d lists %s, which is not a candidate in order", r.Id, p)
+		}
+		previous = p
+	}
+	return r.Primes, nil
+}
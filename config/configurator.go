@@ -7,15 +7,25 @@
 //     maxfilesize: 10000000
 //     maxbuffersize: 300
 //     showfails: false
+//     workers: 0
+//     format: text
+//     store: files
+//     compression: none
+//     port: "8080"
+//
+// Every key can be overridden by an environment variable and a flag, as
+// listed by Settings.
 
 package config
 
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -29,6 +39,25 @@ var (
 	defaultMaxBufferSize = 300
 	defaultShowFails     = false
 	defaultServerIP      = "192.168.1.66"
+	defaultWorkers       = 0
+	defaultFormat        = "text"
+	defaultStore         = "files"
+	defaultCompression   = "none"
+	defaultPort          = Port
+	defaultEndpoints     = Endpoints{
+		Assignment:      AssignmentPoint,
+		Return:          ReturnPoint,
+		Release:         ReleasePoint,
+		HeavyAssignment: HeavyAssignmentPoint,
+		HeavyReturn:     HeavyReturnPoint,
+		HeavyRelease:    HeavyReleasePoint,
+		UnitAssignment:  UnitAssignmentPoint,
+		UnitReturn:      UnitReturnPoint,
+		Metrics:         MetricsPoint,
+		Status:          StatusPoint,
+		StatusEvents:    StatusEventsPoint,
+		Dashboard:       DashboardPoint,
+	}
 )
 
 type Config struct {
@@ -38,55 +67,117 @@ type Config struct {
 	MaxBufferSize int    `json:"maxbuffersize"`
 	ShowFails     bool   `json:"showfails"`
 	ServerIP      string `json:"serverip"`
+	Workers       int    `json:"workers"`
+	Format        string `json:"format"`
+	Store         string `json:"store"`
+	Compression   string `json:"compression"`
+	// Token is the credential a client signs its requests with, issued by
+	// `server token create` on the server. The wizard leaves it unset.
+	Token string `json:"token,omitempty"`
+	// The logging settings are left unset by the wizard too, for the
+	// defaults of config.LogLevel and the others.
+	LogLevel   string `json:"loglevel,omitempty"`
+	LogFormat  string `json:"logformat,omitempty"`
+	LogFile    string `json:"logfile,omitempty"`
+	LogMaxSize int    `json:"logmaxsize,omitempty"`
+	LogBackups int    `json:"logbackups,omitempty"`
+	// Display is always, never or auto, to show primes on stdout as they
+	// are found only when it is a terminal.
+	Display string `json:"display,omitempty"`
+	// Port is the port the server listens on and clients connect to.
+	Port      string    `json:"port,omitempty"`
+	Endpoints Endpoints `json:"endpoints"`
+}
+
+// Endpoints are the paths the server serves, which clients must agree on.
+type Endpoints struct {
+	Assignment      string `json:"assignment,omitempty"`
+	Return          string `json:"return,omitempty"`
+	Release         string `json:"release,omitempty"`
+	HeavyAssignment string `json:"heavyassignment,omitempty"`
+	HeavyReturn     string `json:"heavyreturn,omitempty"`
+	HeavyRelease    string `json:"heavyrelease,omitempty"`
+	UnitAssignment  string `json:"unitassignment,omitempty"`
+	UnitReturn      string `json:"unitreturn,omitempty"`
+	Metrics         string `json:"metrics,omitempty"`
+	Status          string `json:"status,omitempty"`
+	StatusEvents    string `json:"statusevents,omitempty"`
+	Dashboard       string `json:"dashboard,omitempty"`
+}
+
+// DefaultConfig returns the configuration used for every key missing from
+// the configuration file, or for all of them if there is no file
+func DefaultConfig() Config {
+	return Config{
+		Base:          defaultBaseDirectory,
+		StartingPrime: defaultStartingPrime,
+		MaxFilesize:   defaultMaxFilesize,
+		MaxBufferSize: defaultMaxBufferSize,
+		ShowFails:     defaultShowFails,
+		ServerIP:      defaultServerIP,
+		Workers:       defaultWorkers,
+		Format:        defaultFormat,
+		Store:         defaultStore,
+		Compression:   defaultCompression,
+		LogLevel:      defaultLogLevel,
+		LogFormat:     defaultLogFormat,
+		LogBackups:    defaultLogBackups,
+		Display:       defaultDisplay,
+		Port:          defaultPort,
+		Endpoints:     defaultEndpoints,
+	}
 }
 
 // GetUserHome returns the current user's home directory
-func GetUserHome() string {
+func GetUserHome() (string, error) {
 	currentUser, err := user.Current()
 	if err != nil {
-		Logger.Fatal(err)
+		return os.UserHomeDir()
 	}
-	return currentUser.HomeDir
+	return currentUser.HomeDir, nil
 }
 
-// GetUserConfig returns a Config object containing the user's configuration
-func GetUserConfig() Config {
-	Logger.Print("Searching for user's configuration")
-	config := Config{}
-	if IsConfigured() {
-		y, err := ioutil.ReadFile(configurationFile)
-		if err != nil {
-			Logger.Fatal(err)
-		}
-		err = yaml.Unmarshal(y, &config)
-		if err != nil {
-			Logger.Fatal(err)
-		}
-		Logger.Print("Found user's already existing configuration")
-		return config
-	} else {
-		Logger.Print("No configuration found")
-		EnsureUserWantsNewConfig()
-		Logger.Fatal("Restart the program in order to apply this configuration.")
-	}
-	return config
+// configurationFileGiven is set once the configuration file is chosen
+// explicitly, so that it missing is worth a warning.
+var configurationFileGiven bool
+
+// SetConfigurationFile reads and writes the configuration in path instead
+// of ~/.primegenerator.yaml
+func SetConfigurationFile(path string) {
+	configurationFile, configurationFileGiven = path, true
 }
 
-// EnsureUserWantsNewConfig ensures user wants a new config and if so, runs the
-// configurator
-func EnsureUserWantsNewConfig() {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("A configuration file could not be found.\nWould you like to generate one now? [y/n] ")
-	choice, err := reader.ReadString('\n')
+// ConfigurationFile returns the path of the configuration file
+func ConfigurationFile() string {
+	return configurationFile
+}
+
+// GetUserConfig returns a Config object containing the user's configuration,
+// with the defaults for every key it leaves out. Without a configuration
+// file, the defaults are used as they are.
+func GetUserConfig() (Config, error) {
+	if homeErr != nil && !configurationFileGiven {
+		return Config{}, fmt.Errorf("cannot find the home directory: %v", homeErr)
+	}
+	Logger.Debug("Searching for user's configuration", "file", configurationFile)
+	config := DefaultConfig()
+	if !IsConfigured() {
+		if configurationFileGiven {
+			Logger.Warn("No configuration found, using the defaults", "file", configurationFile)
+		} else {
+			Logger.Debug("No configuration found, using the defaults")
+		}
+		return config, nil
+	}
+	y, err := ioutil.ReadFile(configurationFile)
 	if err != nil {
-		Logger.Fatal(err)
+		return config, fmt.Errorf("cannot read the configuration: %v", err)
 	}
-	choice = strings.Trim(choice, " \n")
-	if strings.ToLower(choice) == "y" {
-		RunConfigurator()
-	} else {
-		os.Exit(1)
+	if err := yaml.Unmarshal(y, &config); err != nil {
+		return config, fmt.Errorf("cannot parse %s: %v", configurationFile, err)
 	}
+	Logger.Debug("Found user's already existing configuration")
+	return config, nil
 }
 
 // IsConfigured returns whether the program is configured already
@@ -99,142 +190,174 @@ func IsConfigured() bool {
 }
 
 // RunConfigurator generates a program configuration according to
-// user input
-func RunConfigurator() {
+// user input, keeping the current configuration for the keys it does not
+// ask about
+func RunConfigurator() error {
 	fmt.Printf("A config will now be generated in %s\n", configurationFile)
-	base := getBaseDirectory()
-	startingPrime := getStartingPrime()
-	maxFilesize := getMaxFilesize()
-	maxBufferSize := getMaxBufferSize()
-	showFails := getShowFails()
-	serverIP := getServerIP()
-
-	generateConfig(base, startingPrime, maxFilesize, maxBufferSize, showFails, serverIP)
+	c := LocalConfig
+	var err error
+	if c.Base, err = getBaseDirectory(); err != nil {
+		return err
+	}
+	if c.StartingPrime, err = getStartingPrime(); err != nil {
+		return err
+	}
+	if c.MaxFilesize, err = getMaxFilesize(); err != nil {
+		return err
+	}
+	if c.MaxBufferSize, err = getMaxBufferSize(); err != nil {
+		return err
+	}
+	if c.ShowFails, err = getShowFails(); err != nil {
+		return err
+	}
+	if c.ServerIP, err = getServerIP(); err != nil {
+		return err
+	}
+	if c.Workers, err = getWorkers(); err != nil {
+		return err
+	}
+	if c.Format, err = getFormat(); err != nil {
+		return err
+	}
+	if c.Store, err = getStore(); err != nil {
+		return err
+	}
+	if c.Compression, err = getCompression(); err != nil {
+		return err
+	}
+
+	if err := WriteConfig(c); err != nil {
+		return err
+	}
 	fmt.Println("Your configuration has now been generated.")
+	return nil
 }
 
-// getBaseDirectory returns the user's preference for a base directory
-func getBaseDirectory() string {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("Base directory (default: %s/.primes/): ", home)
-	userChoice, err := reader.ReadString('\n')
+// stdin reads the answers to the configurator's questions
+var stdin = bufio.NewReader(os.Stdin)
+
+// readAnswer returns the next line the user typed, trimmed
+func readAnswer() (string, error) {
+	answer, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return "", fmt.Errorf("cannot read the answer: %v", err)
+	}
+	return strings.Trim(answer, " \r\n"), nil
+}
+
+// readWholeNumber returns the next whole number the user typed, or
+// otherwise if they typed nothing
+func readWholeNumber(otherwise int) (int, error) {
+	answer, err := readAnswer()
+	if err != nil || answer == "" {
+		return otherwise, err
+	}
+	n, err := strconv.Atoi(answer)
 	if err != nil {
-		Logger.Fatal(err)
+		return 0, fmt.Errorf("%q is not a whole number", answer)
 	}
-	userChoice = strings.Trim(userChoice, " \n")
-	if userChoice == "" {
-		userChoice = defaultBaseDirectory
+	return n, nil
+}
+
+// readString returns the next line the user typed, or otherwise if they
+// typed nothing
+func readString(otherwise string) (string, error) {
+	answer, err := readAnswer()
+	if err != nil || answer == "" {
+		return otherwise, err
 	}
-	return userChoice
+	return answer, nil
+}
+
+// getBaseDirectory returns the user's preference for a base directory
+func getBaseDirectory() (string, error) {
+	fmt.Printf("Base directory (default: %s/.primes/): ", home)
+	return readString(defaultBaseDirectory)
 }
 
 // getStartingPrime returns the user's preference for the prime to begin on
-func getStartingPrime() string {
-	reader := bufio.NewReader(os.Stdin)
+func getStartingPrime() (string, error) {
 	fmt.Print("Prime to begin generation at (default: 1): ")
-	userChoice, err := reader.ReadString('\n')
-	if err != nil {
-		Logger.Fatal(err)
-	}
-	userChoice = strings.Trim(userChoice, " \n")
-	if userChoice == "" {
-		userChoice = defaultStartingPrime
-	}
-	return userChoice
+	return readString(defaultStartingPrime)
 }
 
 // getMaxFilesize returns the user's preference for the maximum
 // filesize
-func getMaxFilesize() int {
-	var userChoice int
-	reader := bufio.NewReader(os.Stdin)
+func getMaxFilesize() (int, error) {
 	fmt.Print("Maximum number of prime numbers in a file (default: 10000000): ")
-	userChoiceString, err := reader.ReadString('\n')
-	if err != nil {
-		Logger.Fatal(err)
-	}
-	userChoiceString = strings.Trim(userChoiceString, " \n")
-	if userChoiceString == "" {
-		userChoice = defaultMaxFilesize
-	} else {
-		userChoice, err = strconv.Atoi(userChoiceString)
-		if err != nil {
-			Logger.Fatal(err)
-		}
-	}
-	return userChoice
+	return readWholeNumber(defaultMaxFilesize)
 }
 
 // getMaxBufferSize returns the user's preference for a maximum buffer
 // size
-func getMaxBufferSize() int {
-	var userChoice int
-	reader := bufio.NewReader(os.Stdin)
+func getMaxBufferSize() (int, error) {
 	fmt.Print("Maximum number of prime numbers in a buffer before flushing (default: 300): ")
-	userChoiceString, err := reader.ReadString('\n')
-	if err != nil {
-		Logger.Fatal(err)
+	n, err := readWholeNumber(defaultMaxBufferSize)
+	if err == nil && n < 1 {
+		return 0, fmt.Errorf("the maximum buffer size must be at least 1, not %d", n)
 	}
-	userChoiceString = strings.Trim(userChoiceString, " \n")
-	if userChoiceString == "" {
-		userChoice = defaultMaxBufferSize
-	} else {
-		userChoice, err = strconv.Atoi(userChoiceString)
-		if err != nil {
-			Logger.Fatal(err)
-		}
-	}
-	return userChoice
+	return n, err
 }
 
 // getShowFails returns the user's preference for whether to show fails or not
-func getShowFails() bool {
-	var userChoiceBoolean bool
-	reader := bufio.NewReader(os.Stdin)
+func getShowFails() (bool, error) {
 	fmt.Print("Show failed numbers (default: n) [y/n]: ")
-	userChoice, err := reader.ReadString('\n')
+	userChoice, err := readAnswer()
 	if err != nil {
-		Logger.Fatal(err)
-	}
-	if strings.ToLower(userChoice) == "y" {
-		userChoiceBoolean = true
-	} else if strings.ToLower(userChoice) == "n" {
-		userChoiceBoolean = false
+		return false, err
 	}
-	userChoice = strings.Trim(userChoice, " \n")
 	if userChoice == "" {
-		userChoiceBoolean = defaultShowFails
+		return defaultShowFails, nil
 	}
-	return userChoiceBoolean
+	return strings.ToLower(userChoice) == "y", nil
 }
 
 // getserverIP returns the user's preference for the ip to
 // connect to as the server
-func getServerIP() string {
-	reader := bufio.NewReader(os.Stdin)
+func getServerIP() (string, error) {
 	fmt.Print("Address to connect to as server (default: 192.168.1.66): ")
-	userChoice, err := reader.ReadString('\n')
-	if err != nil {
-		Logger.Fatal(err)
-	}
-	userChoice = strings.Trim(userChoice, " \n")
-	if userChoice == "" {
-		userChoice = defaultServerIP
-	}
-	return userChoice
+	return readString(defaultServerIP)
 }
 
-// generateConfig concatinates the user's preferences into YAML format
-func generateConfig(base string, startingPrime string, maxFilesize int, maxBufferSize int, showFails bool, serverIP string) {
-	config, err := os.Create(home + "/.primegenerator.yaml")
-	defer config.Close()
-	if err != nil {
-		Logger.Fatal(err)
-	}
-	c := Config{base, startingPrime, maxFilesize, maxBufferSize, showFails, serverIP}
+// getWorkers returns the user's preference for the number of goroutines
+// testing candidates, where 0 means one per available CPU
+func getWorkers() (int, error) {
+	fmt.Print("Number of workers testing candidates (default: 0, one per CPU): ")
+	return readWholeNumber(defaultWorkers)
+}
+
+// getFormat returns the user's preference for the storage format new files
+// are written in
+func getFormat() (string, error) {
+	fmt.Print("Storage format, text or delta (default: text): ")
+	return readString(defaultFormat)
+}
+
+// getStore returns the user's preference for where the archive is kept
+func getStore() (string, error) {
+	fmt.Print("Store primes in files or a bolt database (default: files): ")
+	return readString(defaultStore)
+}
+
+// getCompression returns the user's preference for compressing files once
+// they are full
+func getCompression() (string, error) {
+	fmt.Print("Compress full files with none, gzip or zstd (default: none): ")
+	return readString(defaultCompression)
+}
+
+// WriteConfig writes c to the configuration file in YAML format
+func WriteConfig(c Config) error {
 	yaml, err := yaml.Marshal(c)
 	if err != nil {
-		Logger.Fatal(err)
+		return fmt.Errorf("cannot encode the configuration: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(configurationFile), os.ModePerm); err != nil {
+		return fmt.Errorf("cannot create the configuration: %v", err)
+	}
+	if err := ioutil.WriteFile(configurationFile, yaml, 0600); err != nil {
+		return fmt.Errorf("cannot create the configuration: %v", err)
 	}
-	config.Write(yaml)
+	return nil
 }
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ConfigureLogging replaces Logger with one logging at LogLevel and above,
+// as LogFormat, to LogFile, or to stderr if LogFile is empty. The file is
+// rotated once it grows past LogMaxSize megabytes, keeping LogBackups old
+// files, unless LogMaxSize is 0.
+func ConfigureLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(LogLevel)); err != nil {
+		return fmt.Errorf("unknown log level %q, want debug, info, warn or error", LogLevel)
+	}
+
+	var w io.Writer = os.Stderr
+	if LogFile != "" {
+		file, err := openRotatingFile(LogFile, int64(LogMaxSize)<<20, LogBackups)
+		if err != nil {
+			return err
+		}
+		w = file
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(LogFormat) {
+	case "text":
+		Logger = slog.New(slog.NewTextHandler(w, options))
+	case "json":
+		Logger = slog.New(slog.NewJSONHandler(w, options))
+	default:
+		return fmt.Errorf("unknown log format %q, want text or json", LogFormat)
+	}
+	return nil
+}
+
+// rotatingFile is a log file that is moved aside to name.1, name.2 and so
+// on whenever it would grow past maxSize bytes.
+type rotatingFile struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// openRotatingFile opens the log file name for appending
+func openRotatingFile(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open() opens the file, carrying on from its current size
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+// rotate() moves every old file one place along, dropping the oldest, and
+// starts a new file
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	if r.backups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.name, r.backups))
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+		}
+		if err := os.Rename(r.name, r.name+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.name); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the name of every environment variable overriding a
+// configuration key.
+const EnvPrefix = "PRIMEGEN_"
+
+// Setting is a configuration key that can be overridden by a flag of the
+// same name or by its environment variable.
+type Setting struct {
+	Name  string
+	Usage string
+	value interface{}
+}
+
+// EnvVar returns the environment variable overriding the setting, such as
+// PRIMEGEN_MAX_FILE_SIZE for max-file-size
+func (s Setting) EnvVar() string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(s.Name, "-", "_", -1))
+}
+
+// Set parses value into the key of the Config the setting came from
+func (s Setting) Set(value string) error {
+	switch v := s.value.(type) {
+	case *string:
+		*v = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a whole number", s.Name, value)
+		}
+		*v = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not true or false", s.Name, value)
+		}
+		*v = b
+	}
+	return nil
+}
+
+// Settings returns every key of c that can be overridden
+func (c *Config) Settings() []Setting {
+	return []Setting{
+		{"base", "Directory the archive is kept in", &c.Base},
+		{"starting-prime", "Prime to begin generation at", &c.StartingPrime},
+		{"max-file-size", "Maximum number of primes in a file", &c.MaxFilesize},
+		{"max-buffer-size", "Maximum number of primes in a buffer before flushing", &c.MaxBufferSize},
+		{"show-fails", "Show failed numbers, true or false", &c.ShowFails},
+		{"server-ip", "Address of the server to connect to", &c.ServerIP},
+		{"workers", "Number of workers testing candidates, 0 for one per CPU", &c.Workers},
+		{"format", "Storage format of new files, text or delta", &c.Format},
+		{"store", "Store primes in files or a bolt database", &c.Store},
+		{"compression", "Compress full files with none, gzip or zstd", &c.Compression},
+		{"token", "Credential the client signs its requests with", &c.Token},
+		{"log-level", "Least severe log level shown: debug, info, warn or error", &c.LogLevel},
+		{"log-format", "Log format, text or json", &c.LogFormat},
+		{"log-file", "Write logs to this file instead of stderr", &c.LogFile},
+		{"log-max-size", "Rotate the log file once it grows past this many megabytes, 0 to never", &c.LogMaxSize},
+		{"log-backups", "Number of rotated log files kept", &c.LogBackups},
+		{"display", "Show primes on stdout as they are found: always, never or auto", &c.Display},
+		{"port", "Port the server listens on and clients connect to", &c.Port},
+		{"endpoint-assignment", "Path assigning primes to check", &c.Endpoints.Assignment},
+		{"endpoint-return", "Path receiving checked primes", &c.Endpoints.Return},
+		{"endpoint-release", "Path releasing unchecked primes", &c.Endpoints.Release},
+		{"endpoint-heavy-assignment", "Path assigning heavy computations", &c.Endpoints.HeavyAssignment},
+		{"endpoint-heavy-return", "Path receiving heavy computations", &c.Endpoints.HeavyReturn},
+		{"endpoint-heavy-release", "Path releasing heavy computations", &c.Endpoints.HeavyRelease},
+		{"endpoint-unit-assignment", "Path assigning units", &c.Endpoints.UnitAssignment},
+		{"endpoint-unit-return", "Path receiving units", &c.Endpoints.UnitReturn},
+		{"endpoint-metrics", "Path serving the metrics", &c.Endpoints.Metrics},
+		{"endpoint-status", "Path serving the status", &c.Endpoints.Status},
+		{"endpoint-status-events", "Path streaming the status", &c.Endpoints.StatusEvents},
+		{"endpoint-dashboard", "Path serving the status page", &c.Endpoints.Dashboard},
+	}
+}
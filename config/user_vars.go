@@ -1,15 +1,30 @@
 package config
 
 import (
-	"log"
+	"log/slog"
 	"math/big"
 	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLogLevel   = "info"
+	defaultLogFormat  = "text"
+	defaultLogBackups = 3
+	defaultDisplay    = "auto"
 )
 
 var (
-	home              = GetUserHome()
+	home, homeErr     = GetUserHome()
 	Base              = home + "/.primes/"
 	Directory         = Base + "directory.txt"
+	Journal           = Base + "journal.txt"
+	Index             = Base + "index.json"
+	Database          = Base + "primes.db"
+	ServerState       = Base + "server.json"
+	Tokens            = Base + "tokens.json"
+	Certificates      = Base + "tls/"
 	configurationFile = home + "/.primegenerator.yaml"
 
 	LocalConfig   = Config{}
@@ -17,17 +32,62 @@ var (
 	MaxFilesize   int
 	MaxBufferSize int
 	ShowFails     bool
+	Workers       int
 	Host          string
+	Engine        = "probable"
+	Prove         bool
+	Format        = "text"
+	Store         = "files"
+	Compression   = "none"
 
 	Port                 = "8080"
 	Address              string
+	Token                string
+	TLS                  bool
+	TLSCert              string
+	TLSKey               string
+	TLSCA                string
+	StatusAddr           string
 	AssignmentPoint      = "/"
 	ReturnPoint          = "/finished"
+	ReleasePoint         = "/release"
 	HeavyAssignmentPoint = "/heavy"
 	HeavyReturnPoint     = "/heavy/finished"
+	HeavyReleasePoint    = "/heavy/release"
+	UnitAssignmentPoint  = "/unit"
+	UnitReturnPoint      = "/unit/finished"
+	MetricsPoint         = "/metrics"
+	StatusPoint          = "/status"
+	StatusEventsPoint    = "/status/events"
+	DashboardPoint       = "/dashboard"
+	LeaseTimeout         = time.Minute
+	Recheck              = true
+	DoubleCheck          = 0.05
 
 	Id                 uint64
 	LastPrimeGenerated *big.Int
 
-	Logger = log.New(os.Stdout, "", log.LstdFlags)
+	LogLevel   = defaultLogLevel
+	LogFormat  = defaultLogFormat
+	LogFile    string
+	LogMaxSize int
+	LogBackups = defaultLogBackups
+	Display    = defaultDisplay
+
+	Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
 )
+
+// SetBase moves the archive and every file kept beside it to base
+func SetBase(base string) {
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	Base = base
+	Directory = Base + "directory.txt"
+	Journal = Base + "journal.txt"
+	Index = Base + "index.json"
+	Database = Base + "primes.db"
+	ServerState = Base + "server.json"
+	Tokens = Base + "tokens.json"
+	Certificates = Base + "tls/"
+}
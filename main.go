@@ -3,15 +3,24 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	//      "io/ioutil"
 	"math/big"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 
+	"github.com/MaxTheMonster/PrimeNumberGenerator/auth"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/client"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/computation"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/metrics"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/server"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
@@ -24,11 +33,21 @@ const (
 	appName  = "PrimeNumberGenerator"
 	appUsage = "Generate prime numbers forever"
 
-	descConfigure = "Runs auto-configuration wizard"
-	descCount     = "Displays the estimated curren n prime numbers"
-	descRun       = "Begins computation of primes"
-	descClient    = "Launches a new instance of a client"
-	descServer    = "Launches a new instance of a server"
+	descConfigure   = "Runs auto-configuration wizard"
+	descInit        = "Writes a configuration file, optionally without asking"
+	descCount       = "Displays the estimated curren n prime numbers"
+	descRun         = "Begins computation of primes"
+	descVerifyCert  = "Re-checks the primality certificates of stored primes"
+	descNth         = "Displays the n-th prime"
+	descPi          = "Displays the number of primes not exceeding x"
+	descExport      = "Exports a range of stored primes"
+	descMigrate     = "Converts every storage file to another storage format"
+	descVerify      = "Checks the stored primes for damage, and optionally repairs it"
+	descClient      = "Launches a new instance of a client"
+	descServer      = "Launches a new instance of a server"
+	descToken       = "Manages the tokens clients authenticate with"
+	descTokenCreate = "Issues a token for a new client, to be set as token in its configuration"
+	descGenCerts    = "Issues TLS certificates for the server or a client from a certificate authority for the cluster, creating it if need be"
 
 	appHelpTemplate = `{{if .VisibleCommands}}COMMANDS:{{range .VisibleCategories}}{{if .Name}}
    {{.Name}}:{{end}}{{range .VisibleCommands}}
@@ -40,25 +59,275 @@ GLOBAL OPTIONS:
 `
 )
 
+// Exit codes of the commands, telling scripts what kind of failure stopped
+// them
+const (
+	// exitFailure is any failure not listed below, such as an archive
+	// failing verification.
+	exitFailure = 1
+	// exitUsage is a wrong flag or argument.
+	exitUsage = 2
+	// exitConfig is a configuration that cannot be read or is invalid.
+	exitConfig = 3
+	// exitStorage is an archive that cannot be read or written.
+	exitStorage = 4
+	// exitServer is a server that cannot serve, or that refuses the client.
+	exitServer = 5
+)
+
+// readConfiguration returns the defaults, overridden by the configuration
+// file, then by the PRIMEGEN_* environment variables, then by the global
+// flags
+func readConfiguration(c *cli.Context) (config.Config, error) {
+	if c.IsSet("config") {
+		config.SetConfigurationFile(c.String("config"))
+	}
+	local, err := config.GetUserConfig()
+	if err != nil {
+		return local, err
+	}
+	for _, setting := range local.Settings() {
+		if c.IsSet(setting.Name) {
+			if err := setting.Set(c.String(setting.Name)); err != nil {
+				return local, err
+			}
+		}
+	}
+	return local, nil
+}
+
 // SetConfiguration sets the global configuration variables
-func SetConfiguration() {
-	config.LocalConfig = config.GetUserConfig()
+func SetConfiguration(c *cli.Context) error {
+	var err error
+	if config.LocalConfig, err = readConfiguration(c); err != nil {
+		return err
+	}
+	config.SetBase(config.LocalConfig.Base)
+	setEndpoints(config.LocalConfig)
 	config.StartingPrime = config.LocalConfig.StartingPrime
 	config.MaxFilesize = config.LocalConfig.MaxFilesize
 	config.MaxBufferSize = config.LocalConfig.MaxBufferSize
+	if config.MaxBufferSize < 1 {
+		return fmt.Errorf("max-buffer-size must be at least 1, not %d", config.MaxBufferSize)
+	}
 	config.ShowFails = config.LocalConfig.ShowFails
+	config.Workers = config.LocalConfig.Workers
+	if config.Workers < 1 {
+		config.Workers = runtime.GOMAXPROCS(0)
+	}
+	if config.LocalConfig.Format != "" {
+		config.Format = config.LocalConfig.Format
+	}
+	if _, err := storage.GetBackend(config.Format); err != nil {
+		return err
+	}
+	if config.LocalConfig.Store != "" {
+		config.Store = config.LocalConfig.Store
+	}
+	if config.Store != storage.StoreFiles && config.Store != storage.StoreBolt {
+		return fmt.Errorf("unknown store %q", config.Store)
+	}
+	if config.LocalConfig.Compression != "" {
+		config.Compression = config.LocalConfig.Compression
+	}
+	if !storage.IsValidCompression(config.Compression) {
+		return fmt.Errorf("unknown compression %q", config.Compression)
+	}
 	config.Host = config.LocalConfig.ServerIP
+	if config.LocalConfig.Port != "" {
+		config.Port = config.LocalConfig.Port
+	}
 	config.Address = config.Host + ":" + config.Port
+	config.Token = config.LocalConfig.Token
+	if config.LocalConfig.LogLevel != "" {
+		config.LogLevel = config.LocalConfig.LogLevel
+	}
+	if config.LocalConfig.LogFormat != "" {
+		config.LogFormat = config.LocalConfig.LogFormat
+	}
+	config.LogFile = config.LocalConfig.LogFile
+	config.LogMaxSize = config.LocalConfig.LogMaxSize
+	if config.LocalConfig.LogBackups != 0 {
+		config.LogBackups = config.LocalConfig.LogBackups
+	}
+	if config.LocalConfig.Display != "" {
+		config.Display = config.LocalConfig.Display
+	}
+	return nil
+}
+
+// setEndpoints sets the paths the server serves from the configuration,
+// keeping the default for any left empty
+func setEndpoints(local config.Config) {
+	for point, path := range map[*string]string{
+		&config.AssignmentPoint:      local.Endpoints.Assignment,
+		&config.ReturnPoint:          local.Endpoints.Return,
+		&config.ReleasePoint:         local.Endpoints.Release,
+		&config.HeavyAssignmentPoint: local.Endpoints.HeavyAssignment,
+		&config.HeavyReturnPoint:     local.Endpoints.HeavyReturn,
+		&config.HeavyReleasePoint:    local.Endpoints.HeavyRelease,
+		&config.UnitAssignmentPoint:  local.Endpoints.UnitAssignment,
+		&config.UnitReturnPoint:      local.Endpoints.UnitReturn,
+		&config.MetricsPoint:         local.Endpoints.Metrics,
+		&config.StatusPoint:          local.Endpoints.Status,
+		&config.StatusEventsPoint:    local.Endpoints.StatusEvents,
+		&config.DashboardPoint:       local.Endpoints.Dashboard,
+	} {
+		if path != "" {
+			*point = path
+		}
+	}
+}
+
+// setUp reads the configuration, and sets up the logger and prime display
+// accordingly
+func setUp(c *cli.Context) error {
+	if err := SetConfiguration(c); err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	if err := config.ConfigureLogging(); err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	if err := primes.SetDisplay(config.Display); err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	return nil
 }
 
 // SetId sets the gloabl id variable
-func SetId() {
-	config.Id = primes.GetCurrentId()
+func SetId() error {
+	var err error
+	config.Id, err = primes.GetCurrentId()
+	return err
 }
 
 // SetLastPrimeGenerated sets the global lastprimegenerated variable
-func SetLastPrimeGenerated() {
-	config.LastPrimeGenerated = getLastPrime()
+func SetLastPrimeGenerated() error {
+	var err error
+	config.LastPrimeGenerated, err = getLastPrime()
+	return err
+}
+
+// repairArchive repairs any flush to the storage files that a crash
+// interrupted. It must run before anything reads the index, which a torn
+// flush can leave unreadable.
+func repairArchive() error {
+	if config.Store != storage.StoreFiles {
+		return nil
+	}
+	if _, err := storage.RepairJournal(); err != nil {
+		return fmt.Errorf("cannot repair the storage files: %v", err)
+	}
+	return nil
+}
+
+// repairBefore repairs the archive before a command that only reads it, as
+// openArchive does for those that add to it
+func repairBefore(c *cli.Context) error {
+	if err := repairArchive(); err != nil {
+		return cli.NewExitError(err.Error(), exitStorage)
+	}
+	return nil
+}
+
+// openArchive repairs the archive, then sets the id and the last prime
+// generated from it
+func openArchive() error {
+	if err := repairArchive(); err != nil {
+		return cli.NewExitError(err.Error(), exitStorage)
+	}
+	if err := SetId(); err != nil {
+		return cli.NewExitError(err.Error(), exitStorage)
+	}
+	if err := SetLastPrimeGenerated(); err != nil {
+		return cli.NewExitError(err.Error(), exitStorage)
+	}
+	return nil
+}
+
+// startCompressor compresses full storage files in the background, when the
+// configuration asks for it
+func startCompressor() {
+	if config.Store == storage.StoreFiles && config.Compression != storage.CompressionNone {
+		storage.StartCompressor(config.Compression)
+	}
+}
+
+// validClientName matches the names tokens can be issued for
+var validClientName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// createToken issues a token for the client named by the first argument
+func createToken(c *cli.Context) error {
+	name := c.Args().First()
+	if !validClientName.MatchString(name) {
+		return cli.NewExitError("Name the client with letters, digits, dots, dashes and underscores", exitUsage)
+	}
+	token, err := auth.CreateToken(name)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitFailure)
+	}
+	fmt.Fprintf(os.Stderr, "Created a token for %s. Set it as token in the configuration of the client:\n", name)
+	fmt.Println(token)
+	return nil
+}
+
+// generateCertificates issues a certificate for the server, valid for the
+// hosts given and for the configured server address, or for a client
+func generateCertificates(c *cli.Context) error {
+	var cert, key string
+	var err error
+	if name := c.String("client"); name != "" {
+		if !validClientName.MatchString(name) || name == "ca" || name == "server" {
+			return cli.NewExitError("Name the client with letters, digits, dots, dashes and underscores, other than ca and server", exitUsage)
+		}
+		cert, key, err = auth.IssueClientCertificate(name)
+	} else {
+		hosts := append([]string{"localhost", "127.0.0.1"}, c.Args()...)
+		if config.Host != "" {
+			hosts = append(hosts, config.Host)
+		}
+		cert, key, err = auth.IssueServerCertificate(hosts)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitFailure)
+	}
+	fmt.Printf("Certificate authority: %s\nCertificate: %s\nKey: %s\n", auth.CAFile(), cert, key)
+	return nil
+}
+
+// serveMetrics serves the metrics on the address given by --metrics-addr,
+// if any, until ctx is cancelled
+func serveMetrics(ctx context.Context, c *cli.Context) {
+	if addr := c.String("metrics-addr"); addr != "" {
+		go metrics.Serve(ctx, addr)
+	}
+}
+
+// interruptContext returns a context cancelled by the first SIGINT or
+// SIGTERM, after which a second one stops the program at once
+func interruptContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		config.Logger.Info("Finishing the work in progress, interrupt again to quit at once")
+	}()
+	return ctx
+}
+
+// limitFlag bounds how far nth and pi compute past the archive.
+var limitFlag = cli.Uint64Flag{
+	Name:  "limit",
+	Value: 100000000,
+	Usage: "Give up after computing `N` primes past the archive",
+}
+
+// queryError maps the failure of nth or pi to its exit code
+func queryError(err error) error {
+	if errors.Is(err, computation.ErrBeyondLimit) || errors.Is(err, context.Canceled) {
+		return cli.NewExitError(err.Error(), exitFailure)
+	}
+	return cli.NewExitError(err.Error(), exitStorage)
 }
 
 // showHelp shows help to the user.
@@ -73,37 +342,104 @@ func showHelp() {
 	os.Exit(1)
 }
 
-// showProgramDetails prints details about the program to STDOUT
+// showProgramDetails prints details about the program to STDERR, keeping
+// STDOUT clean for commands such as export
 func showProgramDetails() {
-	fmt.Printf("PrimeNumberGenerator %s LITE", version)
-	fmt.Println("\nCopyright (C) 2017-2018 by Max Ungless")
-	fmt.Println("This program comes with ABSOLUTELY NO WARRANTY.\nThis is free software, and you are welcome to redistribute it\nunder the condiditions set in the GNU General Public License version 3.\nSee the file named LICENSE for details.")
-	fmt.Println("\nFor bugs, send mail to max@maxungless.com")
-	fmt.Println()
+	fmt.Fprintf(os.Stderr, "PrimeNumberGenerator %s LITE", version)
+	fmt.Fprintln(os.Stderr, "\nCopyright (C) 2017-2018 by Max Ungless")
+	fmt.Fprintln(os.Stderr, "This program comes with ABSOLUTELY NO WARRANTY.\nThis is free software, and you are welcome to redistribute it\nunder the condiditions set in the GNU General Public License version 3.\nSee the file named LICENSE for details.")
+	fmt.Fprintln(os.Stderr, "\nFor bugs, send mail to max@maxungless.com")
+	fmt.Fprintln(os.Stderr)
+}
+
+// getLastPrime() returns the largest prime stored, from the index
+func getLastPrime() (*big.Int, error) {
+	lastPrimeGenerated, err := storage.GetLargestPrime()
+	if err != nil {
+		return nil, err
+	}
+	if lastPrimeGenerated == nil {
+		lastPrimeGenerated = new(big.Int)
+		if _, ok := lastPrimeGenerated.SetString(config.StartingPrime, 10); !ok {
+			return nil, fmt.Errorf("startingprime %q is not a whole number", config.StartingPrime)
+		}
+	}
+	return lastPrimeGenerated, nil
+}
+
+// exportPrimes streams the range of stored primes given on the command line
+// to a file or standard output
+func exportPrimes(c *cli.Context) error {
+	from, ok := new(big.Int).SetString(c.String("from"), 10)
+	if !ok {
+		return cli.NewExitError("--from needs a whole number", exitUsage)
+	}
+	var to *big.Int
+	if c.String("to") != "" {
+		if to, ok = new(big.Int).SetString(c.String("to"), 10); !ok {
+			return cli.NewExitError("--to needs a whole number", exitUsage)
+		}
+	}
+	if !primes.IsValidExportFormat(c.String("format")) {
+		return cli.NewExitError(fmt.Sprintf("Unknown export format %q, want one of %s", c.String("format"), strings.Join(primes.ExportFormats, ", ")), exitUsage)
+	}
+
+	output := os.Stdout
+	if c.String("output") != "-" {
+		file, err := os.Create(c.String("output"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitFailure)
+		}
+		defer file.Close()
+		output = file
+	}
+	if err := primes.ExportPrimes(output, from, to, c.String("format")); err != nil {
+		return cli.NewExitError(err.Error(), exitStorage)
+	}
+	return nil
+}
+
+// settingFlags returns the global flags: --config, and one overriding each
+// configuration setting, which its PRIMEGEN_* environment variable also sets
+func settingFlags() []cli.Flag {
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "Read the configuration from `FILE` instead of ~/.primegenerator.yaml",
+			EnvVar: config.EnvPrefix + "CONFIG",
+		},
+	}
+	for _, setting := range (&config.Config{}).Settings() {
+		flags = append(flags, cli.StringFlag{
+			Name:   setting.Name,
+			Usage:  setting.Usage,
+			EnvVar: setting.EnvVar(),
+		})
+	}
+	return flags
 }
 
-// getLastPrime() searches for last generated prime
-// in all prime storage files.
-func getLastPrime() *big.Int {
-	latestFile := storage.OpenLatestFile(os.O_RDONLY, 0666)
-	defer latestFile.Close()
-	var lastPrimeGenerated string
-	scanner := bufio.NewScanner(latestFile)
-	for scanner.Scan() {
-		lastPrimeGenerated = scanner.Text()
+// initConfiguration writes the configuration file, asking for each setting
+// unless --non-interactive is set
+func initConfiguration(c *cli.Context) error {
+	if config.IsConfigured() && !c.Bool("force") {
+		return cli.NewExitError(fmt.Sprintf("%s already exists, use --force to overwrite it", config.ConfigurationFile()), exitConfig)
+	}
+	if !c.Bool("non-interactive") {
+		if err := config.RunConfigurator(); err != nil {
+			return cli.NewExitError(err.Error(), exitConfig)
+		}
+		return nil
 	}
-	if lastPrimeGenerated == "0" || lastPrimeGenerated == "" {
-		lastPrimeGenerated = config.StartingPrime
+	if err := config.WriteConfig(config.LocalConfig); err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
 	}
-	foundPrime := new(big.Int)
-	foundPrime.SetString(lastPrimeGenerated, 10)
-	return foundPrime
+	fmt.Println("Configuration written to", config.ConfigurationFile())
+	return nil
 }
 
 func init() {
-	//      config.Logger.SetOutput(ioutil.Discard)
 	showProgramDetails()
-	SetConfiguration()
 }
 
 func main() {
@@ -112,6 +448,8 @@ func main() {
 	app.Usage = appUsage
 	app.Version = version
 	cli.AppHelpTemplate = appHelpTemplate
+	app.Before = setUp
+	app.Flags = settingFlags()
 
 	app.Commands = []cli.Command{
 		{
@@ -119,20 +457,36 @@ func main() {
 			Aliases: []string{"cn"},
 			Usage:   descConfigure,
 			Action: func(c *cli.Context) error {
-				config.RunConfigurator()
+				if err := config.RunConfigurator(); err != nil {
+					return cli.NewExitError(err.Error(), exitConfig)
+				}
 				return nil
 			},
 		},
+		{
+			Name:   "init",
+			Usage:  descInit,
+			Action: initConfiguration,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "non-interactive",
+					Usage: "Write the defaults, with the environment and global flags applied, without asking",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Overwrite an existing configuration file",
+				},
+			},
+		},
 		{
 			Name:    "count",
 			Aliases: []string{"ct"},
 			Usage:   descCount,
-			Before: func(c *cli.Context) error {
-				SetId()
-				return nil
-			},
+			Before:  repairBefore,
 			Action: func(c *cli.Context) error {
-				primes.ShowCurrentCount()
+				if err := primes.ShowCurrentCount(); err != nil {
+					return cli.NewExitError(err.Error(), exitStorage)
+				}
 				return nil
 			},
 		},
@@ -141,12 +495,205 @@ func main() {
 			Aliases: []string{"r"},
 			Usage:   descRun,
 			Before: func(c *cli.Context) error {
-				SetId()
-				SetLastPrimeGenerated()
+				config.Engine = c.String("engine")
+				config.Prove = c.Bool("prove")
+				if c.IsSet("workers") {
+					if c.Int("workers") < 1 {
+						return cli.NewExitError("--workers must be at least 1", exitUsage)
+					}
+					config.Workers = c.Int("workers")
+				}
+				if config.Engine != computation.EngineProbable && config.Engine != computation.EngineSieve {
+					return cli.NewExitError(fmt.Sprintf("Unknown engine %q", config.Engine), exitUsage)
+				}
+				if err := openArchive(); err != nil {
+					return err
+				}
+				startCompressor()
+				return nil
+			},
+			Action: func(c *cli.Context) error {
+				ctx := interruptContext()
+				serveMetrics(ctx, c)
+				if err := computation.ComputePrimes(ctx, config.LastPrimeGenerated, true, true, big.NewInt(0)); err != nil {
+					return cli.NewExitError(err.Error(), exitStorage)
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "engine",
+					Value: computation.EngineProbable,
+					Usage: "Primality engine to use: probable (ProbablyPrime per candidate) or sieve (segmented sieve)",
+				},
+				cli.BoolFlag{
+					Name:  "prove",
+					Usage: "Prove every prime deterministically and store its certificate",
+				},
+				cli.IntFlag{
+					Name:  "workers",
+					Usage: "Number of goroutines testing candidates (default: workers from the configuration, or one per CPU)",
+				},
+				cli.StringFlag{
+					Name:  "metrics-addr",
+					Usage: "Serve metrics for Prometheus at /metrics on `ADDRESS`, such as :9100",
+				},
+			},
+		},
+		{
+			Name:      "nth",
+			Usage:     descNth,
+			Before:    repairBefore,
+			ArgsUsage: "<n>",
+			Action: func(c *cli.Context) error {
+				n, err := strconv.ParseUint(c.Args().First(), 10, 64)
+				if err != nil || n == 0 {
+					return cli.NewExitError("nth needs a positive whole number", exitUsage)
+				}
+				nth, err := computation.NthPrime(interruptContext(), n, c.Uint64("limit"))
+				if err != nil {
+					return queryError(err)
+				}
+				fmt.Println(nth)
+				return nil
+			},
+			Flags: []cli.Flag{limitFlag},
+		},
+		{
+			Name:      "pi",
+			Usage:     descPi,
+			Before:    repairBefore,
+			ArgsUsage: "<x>",
+			Action: func(c *cli.Context) error {
+				x, ok := new(big.Int).SetString(c.Args().First(), 10)
+				if !ok || x.Sign() < 0 {
+					return cli.NewExitError("pi needs a non-negative whole number", exitUsage)
+				}
+				count, err := computation.PrimePi(interruptContext(), x, c.Uint64("limit"))
+				if err != nil {
+					return queryError(err)
+				}
+				fmt.Println(count)
+				return nil
+			},
+			Flags: []cli.Flag{limitFlag},
+		},
+		{
+			Name:    "export",
+			Aliases: []string{"e"},
+			Usage:   descExport,
+			Before:  repairBefore,
+			Action:  exportPrimes,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Value: "0",
+					Usage: "Smallest prime to export",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "Largest prime to export (default: the end of the archive)",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: primes.ExportText,
+					Usage: "Output format: " + strings.Join(primes.ExportFormats, ", "),
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "-",
+					Usage: "File to write to, or - for standard output",
+				},
+			},
+		},
+		{
+			Name:  "migrate",
+			Usage: descMigrate,
+			Before: func(c *cli.Context) error {
+				return openArchive()
+			},
+			Action: func(c *cli.Context) error {
+				target, err := storage.GetBackend(c.String("to"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), exitUsage)
+				}
+				converted, err := storage.Migrate(target)
+				if err != nil {
+					return cli.NewExitError(err.Error(), exitStorage)
+				}
+				fmt.Printf("Migrated %d files to %s.\n", converted, target.Name())
+				if target.Name() != config.Format {
+					fmt.Printf("New files are still written as %s; set format: %s in the configuration to keep the archive in one format.\n", config.Format, target.Name())
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "to",
+					Value: "delta",
+					Usage: "Storage format to convert every file to: text or delta",
+				},
+			},
+		},
+		{
+			Name:  "verify",
+			Usage: descVerify,
+			Before: func(c *cli.Context) error {
+				if config.Store != storage.StoreFiles {
+					return cli.NewExitError("verify checks the files store only", exitUsage)
+				}
+				if c.Float64("sample") < 0 || c.Float64("sample") > 1 {
+					return cli.NewExitError("--sample must be between 0 and 1", exitUsage)
+				}
+				// Missing files are for verify to find and repair.
+				if _, err := storage.RepairJournal(); err != nil && !errors.Is(err, storage.ErrMissingFiles) {
+					return cli.NewExitError(err.Error(), exitStorage)
+				}
 				return nil
 			},
 			Action: func(c *cli.Context) error {
-				computation.ComputePrimes(config.LastPrimeGenerated, true, true, big.NewInt(0))
+				sound, err := primes.VerifyArchive(primes.VerifyOptions{
+					Sample: c.Float64("sample"),
+					All:    c.Bool("all"),
+					Repair: c.Bool("repair"),
+				})
+				if err != nil {
+					return cli.NewExitError(err.Error(), exitStorage)
+				}
+				if !sound {
+					return cli.NewExitError("Archive verification failed", exitFailure)
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.Float64Flag{
+					Name:  "sample",
+					Value: 0.01,
+					Usage: "Fraction of primes to re-test for primality, along with the gap below each",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "Re-test every prime and every gap",
+				},
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "Rewrite damaged files and the directory with the problems removed",
+				},
+			},
+		},
+		{
+			Name:    "verify-cert",
+			Aliases: []string{"vc"},
+			Usage:   descVerifyCert,
+			Before:  repairBefore,
+			Action: func(c *cli.Context) error {
+				verified, err := primes.VerifyStoredCertificates()
+				if err != nil {
+					return cli.NewExitError(err.Error(), exitStorage)
+				}
+				if !verified {
+					return cli.NewExitError("Certificate verification failed", exitFailure)
+				}
 				return nil
 			},
 		},
@@ -154,12 +701,65 @@ func main() {
 			Name:    "client",
 			Aliases: []string{"cl"},
 			Usage:   descClient,
-			Action:  client.LaunchClient,
+			Action: func(c *cli.Context) error {
+				if c.IsSet("token") {
+					config.Token = c.String("token")
+				}
+				config.TLSCA, config.TLSCert, config.TLSKey = c.String("tls-ca"), c.String("tls-cert"), c.String("tls-key")
+				config.TLS = c.Bool("tls") || config.TLSCA != "" || config.TLSCert != ""
+				if (config.TLSCert == "") != (config.TLSKey == "") {
+					return cli.NewExitError("--tls-cert and --tls-key must be given together", exitUsage)
+				}
+				if config.TLSCert == "" {
+					if _, _, err := auth.ParseToken(config.Token); err != nil {
+						return cli.NewExitError("A token is needed to connect, from `server token create` on the server: "+err.Error(), exitUsage)
+					}
+				}
+				if config.TLS {
+					if err := client.ConfigureTLS(config.TLSCA, config.TLSCert, config.TLSKey); err != nil {
+						return cli.NewExitError("Cannot set up TLS: "+err.Error(), exitConfig)
+					}
+				}
+				ctx := interruptContext()
+				serveMetrics(ctx, c)
+				if err := client.LaunchClient(ctx, c); err != nil {
+					return cli.NewExitError(err.Error(), exitServer)
+				}
+				return nil
+			},
 			Flags: []cli.Flag{
 				cli.BoolFlag{
 					Name:  "heavy",
 					Usage: "Distribute individual divisions instead of distributing entire primes",
 				},
+				cli.StringFlag{
+					Name:  "token",
+					Usage: "Token to sign requests with, overriding the configured one",
+				},
+				cli.BoolFlag{
+					Name:  "single",
+					Usage: "Fetch one candidate per request instead of a range of candidates, for servers without work units",
+				},
+				cli.StringFlag{
+					Name:  "metrics-addr",
+					Usage: "Serve metrics for Prometheus at /metrics on `ADDRESS`, such as :9100",
+				},
+				cli.BoolFlag{
+					Name:  "tls",
+					Usage: "Connect to the server over TLS, implied by the other TLS flags",
+				},
+				cli.StringFlag{
+					Name:  "tls-ca",
+					Usage: "Trust only the server certificates issued by the certificate authority in `FILE`, such as the ca.pem of `server gen-certs`",
+				},
+				cli.StringFlag{
+					Name:  "tls-cert",
+					Usage: "Present the client certificate in `FILE` to a server checking client certificates, which then needs no token",
+				},
+				cli.StringFlag{
+					Name:  "tls-key",
+					Usage: "Key of the client certificate, in `FILE`",
+				},
 			},
 		},
 		{
@@ -167,12 +767,98 @@ func main() {
 			Aliases: []string{"s"},
 			Usage:   descServer,
 			Before: func(c *cli.Context) error {
-				SetId()
-				SetLastPrimeGenerated()
+				if c.Duration("lease-timeout") <= 0 {
+					return cli.NewExitError("--lease-timeout must be positive", exitUsage)
+				}
+				config.LeaseTimeout = c.Duration("lease-timeout")
+				if c.Float64("double-check") < 0 || c.Float64("double-check") > 1 {
+					return cli.NewExitError("--double-check must be between 0 and 1", exitUsage)
+				}
+				config.Recheck = c.BoolT("recheck")
+				config.DoubleCheck = c.Float64("double-check")
+				config.TLSCert, config.TLSKey, config.TLSCA = c.String("tls-cert"), c.String("tls-key"), c.String("tls-client-ca")
+				config.StatusAddr = c.String("status-addr")
+				if (config.TLSCert == "") != (config.TLSKey == "") {
+					return cli.NewExitError("--tls-cert and --tls-key must be given together", exitUsage)
+				}
+				if config.TLSCA != "" && config.TLSCert == "" {
+					return cli.NewExitError("--tls-client-ca needs --tls-cert and --tls-key", exitUsage)
+				}
 				return nil
 			},
-			Action: server.LaunchServer,
+			Action: func(c *cli.Context) error {
+				if err := openArchive(); err != nil {
+					return err
+				}
+				startCompressor()
+				if err := server.LaunchServer(interruptContext(), c); err != nil {
+					return cli.NewExitError(err.Error(), exitServer)
+				}
+				return nil
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "token",
+					Usage: descToken,
+					Subcommands: []cli.Command{
+						{
+							Name:      "create",
+							Usage:     descTokenCreate,
+							ArgsUsage: "NAME",
+							Action:    createToken,
+						},
+					},
+				},
+				{
+					Name:      "gen-certs",
+					Usage:     descGenCerts,
+					ArgsUsage: "[HOST...]",
+					Action:    generateCertificates,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "client",
+							Usage: "Issue a certificate for the client `NAME` instead of the server",
+						},
+					},
+				},
+			},
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "lease-timeout",
+					Value: config.LeaseTimeout,
+					Usage: "How long a client has to return a candidate before it is given to another client",
+				},
+				cli.BoolTFlag{
+					Name:  "recheck",
+					Usage: "Check every prime reported by a client, and every single candidate reported as composite, before storing it, use --recheck=false to trust clients",
+				},
+				cli.Float64Flag{
+					Name:  "double-check",
+					Value: config.DoubleCheck,
+					Usage: "Fraction of work units also given to a second client, and of single candidates checked by the server, to catch clients leaving out primes",
+				},
+				cli.StringFlag{
+					Name:  "tls-cert",
+					Usage: "Serve over TLS with the certificate in `FILE`, such as the server.pem of `server gen-certs`",
+				},
+				cli.StringFlag{
+					Name:  "tls-key",
+					Usage: "Key of the server certificate, in `FILE`",
+				},
+				cli.StringFlag{
+					Name:  "tls-client-ca",
+					Usage: "Require client certificates issued by the certificate authority in `FILE`, identifying clients instead of tokens",
+				},
+				cli.StringFlag{
+					Name:  "status-addr",
+					Usage: "Serve the dashboard, /status and /metrics, which need no token, on `ADDR` over plain HTTP rather than alongside the client endpoints, where --tls-client-ca keeps browsers out",
+				},
+			},
 		},
 	}
-	app.Run(os.Args)
+	// Errors returned as cli.ExitCoder exit with their own code before
+	// Run returns, so what is left is a command line that cannot be parsed.
+	if err := app.Run(os.Args); err != nil {
+		os.Exit(exitUsage)
+	}
 }
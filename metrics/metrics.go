@@ -0,0 +1,286 @@
+// Package metrics counts the work of the program and serves the counts in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+// metric is anything written out when the metrics are scraped.
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	mu         sync.Mutex
+	registered = make(map[string]metric)
+)
+
+// register() adds m to the metrics served, replacing any metric of the same
+// name, so that a computation started again reports on itself
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	registered[m.name()] = m
+}
+
+// writeHeader() writes the help and type lines of a metric
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// formatValue() formats a sample value as the exposition format expects
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// Counter is a count that only goes up.
+type Counter struct {
+	metricName string
+	help       string
+	value      uint64
+}
+
+// NewCounter returns a registered counter
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	register(c)
+	return c
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the count
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) name() string { return c.metricName }
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.metricName, c.Value())
+}
+
+// Sample is one value of a gauge, with the value of its label if it has one.
+type Sample struct {
+	Label string
+	Value float64
+}
+
+// gaugeFunc is a gauge whose samples are read when the metrics are scraped.
+type gaugeFunc struct {
+	metricName string
+	help       string
+	label      string
+	samples    func() []Sample
+}
+
+// NewGaugeFunc registers a gauge read from samples whenever the metrics are
+// scraped. label names the label distinguishing the samples, and is empty
+// for a gauge with a single unlabelled sample.
+func NewGaugeFunc(name string, help string, label string, samples func() []Sample) {
+	register(&gaugeFunc{metricName: name, help: help, label: label, samples: samples})
+}
+
+func (g *gaugeFunc) name() string { return g.metricName }
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	samples := g.samples()
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Label < samples[j].Label })
+	for _, s := range samples {
+		if g.label == "" {
+			fmt.Fprintf(w, "%s %s\n", g.metricName, formatValue(s.Value))
+		} else {
+			fmt.Fprintf(w, "%s{%s=%q} %s\n", g.metricName, g.label, s.Label, formatValue(s.Value))
+		}
+	}
+}
+
+// Histogram counts observations into buckets by their upper bounds.
+type Histogram struct {
+	metricName string
+	help       string
+	mu         sync.Mutex
+	bounds     []float64
+	counts     []uint64
+	count      uint64
+	sum        float64
+}
+
+// NewHistogram returns a registered histogram with the given ascending
+// bucket bounds
+func NewHistogram(name string, help string, bounds []float64) *Histogram {
+	h := &Histogram{metricName: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds))}
+	register(h)
+	return h
+}
+
+// Observe records a duration
+func (h *Histogram) Observe(d time.Duration) {
+	h.ObserveN(d, 1)
+}
+
+// ObserveN records n observations of the same duration, such as the average
+// time taken over a batch
+func (h *Histogram) ObserveN(d time.Duration, n uint64) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i] += n
+			break
+		}
+	}
+	h.count += n
+	h.sum += v * float64(n)
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.metricName, h.help, "histogram")
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.metricName, formatValue(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, h.count)
+}
+
+// rateWindow is how far back the rate of a counter is measured.
+const rateWindow = time.Minute
+
+// rateSample is the value of a counter at some time.
+type rateSample struct {
+	at    time.Time
+	value uint64
+}
+
+// rate measures how fast a counter has gone up over the last rateWindow,
+// from the values seen at each scrape.
+type rate struct {
+	mu      sync.Mutex
+	counter *Counter
+	samples []rateSample
+}
+
+// perSecond() returns the rate of the counter since the oldest value within
+// rateWindow, or since the program started if it has not been scraped yet
+func (r *rate) perSecond() []Sample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := rateSample{time.Now(), r.counter.Value()}
+	for len(r.samples) > 1 && now.at.Sub(r.samples[1].at) > rateWindow {
+		r.samples = r.samples[1:]
+	}
+	oldest := r.samples[0]
+	r.samples = append(r.samples, now)
+	elapsed := now.at.Sub(oldest.at).Seconds()
+	if elapsed <= 0 {
+		return []Sample{{Value: 0}}
+	}
+	return []Sample{{Value: float64(now.value-oldest.value) / elapsed}}
+}
+
+// durationBuckets are the bucket bounds, in seconds, of the histograms of
+// durations, from a microsecond to a minute.
+var durationBuckets = []float64{1e-6, 1e-5, 1e-4, 1e-3, 1e-2, 0.1, 1, 10, 60}
+
+var (
+	// CandidatesTested counts the candidates decided prime or composite, by
+	// this process or, on the server, by its clients.
+	CandidatesTested = NewCounter("primegenerator_candidates_tested_total", "Candidates decided prime or composite.")
+	// PrimesFound counts the primes found.
+	PrimesFound = NewCounter("primegenerator_primes_found_total", "Primes found.")
+	// TestDuration is the time taken to decide a candidate, from
+	// Prime.TimeTaken.
+	TestDuration = NewHistogram("primegenerator_primality_test_duration_seconds", "Time taken to decide whether a candidate is prime.", durationBuckets)
+	// FlushDuration is the time taken to store a buffer of primes.
+	FlushDuration = NewHistogram("primegenerator_flush_duration_seconds", "Time taken to store a buffer of primes.", durationBuckets)
+)
+
+func init() {
+	primesRate := &rate{counter: PrimesFound, samples: []rateSample{{at: time.Now()}}}
+	NewGaugeFunc("primegenerator_primes_per_second", "Primes found per second over the last minute.", "", primesRate.perSecond)
+}
+
+// ChannelDepths registers the number of items waiting in each of the named
+// channels, given as functions returning their lengths
+func ChannelDepths(channels map[string]func() int) {
+	NewGaugeFunc("primegenerator_channel_depth", "Items waiting in a channel between stages of the computation.", "channel", func() []Sample {
+		var samples []Sample
+		for name, depth := range channels {
+			samples = append(samples, Sample{Label: name, Value: float64(depth())})
+		}
+		return samples
+	})
+}
+
+// Handler serves the registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		names := make([]string, 0, len(registered))
+		for name := range registered {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		metrics := make([]metric, len(names))
+		for i, name := range names {
+			metrics[i] = registered[name]
+		}
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		var b strings.Builder
+		for _, m := range metrics {
+			m.write(&b)
+		}
+		io.WriteString(w, b.String())
+	})
+}
+
+// Serve serves the metrics at /metrics on addr until ctx is cancelled. It is
+// meant to run in its own goroutine, and logs rather than stops the program
+// if addr cannot be listened on.
+func Serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle(config.MetricsPoint, Handler())
+	s := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	config.Logger.Info("Serving metrics", "addr", addr, "path", config.MetricsPoint)
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		config.Logger.Error("Cannot serve metrics", "err", err)
+	}
+}
@@ -1,8 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/auth"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/computation"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/metrics"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/server"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+
+	"github.com/satori/go.uuid"
+	"github.com/urfave/cli"
 )
 
 type test struct {
@@ -20,7 +41,7 @@ var tests = []test{
 func TestCorrectPrimeNumberOutput(t *testing.T) {
 	for _, test := range tests {
 		value, expected := big.NewInt(test.test), test.expecting
-		isPrime := checkPrimality(value)
+		isPrime := primes.CheckPrimality(value)
 		if isPrime != expected {
 			t.Errorf("Expected checkPrime(%d) to be %t, instead got %t", value, expected, isPrime)
 		}
@@ -28,13 +49,818 @@ func TestCorrectPrimeNumberOutput(t *testing.T) {
 }
 
 func TestFormatFilename(t *testing.T) {
-	value, expected := "0-1000000", "/home/max/.primes/0-1000000.txt"
-	formatFilePath := formatFilePath(value)
+	value, expected := "0-1000000", config.Base+"0-1000000.txt"
+	formatFilePath := storage.FormatFilePath(value)
 	if formatFilePath != expected {
 		t.Errorf("Expected %s, got %s, with %s.", expected, formatFilePath, value)
 	}
 }
 
+// useTemporaryArchive points the storage paths at a fresh directory, with
+// files small enough that buffers are split across them
+func useTemporaryArchive(t *testing.T) {
+	base, directory, journal, index, database := config.Base, config.Directory, config.Journal, config.Index, config.Database
+	serverState, tokens, certificates, maxFilesize := config.ServerState, config.Tokens, config.Certificates, config.MaxFilesize
+	t.Cleanup(func() {
+		config.Base, config.Directory, config.Journal, config.Index, config.Database = base, directory, journal, index, database
+		config.ServerState, config.Tokens, config.Certificates, config.MaxFilesize = serverState, tokens, certificates, maxFilesize
+	})
+	config.Base = t.TempDir() + "/"
+	config.Directory = config.Base + "directory.txt"
+	config.Journal = config.Base + "journal.txt"
+	config.Index = config.Base + "index.json"
+	config.Database = config.Base + "primes.db"
+	config.ServerState = config.Base + "server.json"
+	config.Tokens = config.Base + "tokens.json"
+	config.Certificates = config.Base + "tls/"
+	config.MaxFilesize = 7
+}
+
+var conformancePrimes = []int64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97}
+
+// testStoreConformance checks the behaviour every storage.Store shares,
+// starting from an empty store
+func testStoreConformance(t *testing.T, store storage.Store) {
+	if count, err := store.Count(); err != nil || count != 0 {
+		t.Fatalf("Count() of an empty store = %d, %v; want 0", count, err)
+	}
+	if last, err := store.Last(); err != nil || last != nil {
+		t.Fatalf("Last() of an empty store = %v, %v; want nil", last, err)
+	}
+	if _, ok, err := store.Nth(0); err != nil || ok {
+		t.Fatalf("Nth(0) of an empty store found a prime, %v", err)
+	}
+
+	// Buffers arrive unsorted and overflow the files they are written to.
+	for _, buffer := range [][]int64{{7, 2, 5, 3}, conformancePrimes[4:15], conformancePrimes[15:]} {
+		var chunk storage.BigIntSlice
+		for i := len(buffer) - 1; i >= 0; i-- {
+			chunk = append(chunk, big.NewInt(buffer[i]))
+		}
+		if err := store.Append(chunk, nil); err != nil {
+			t.Fatalf("Append(%v) failed: %v", buffer, err)
+		}
+	}
+
+	if count, err := store.Count(); err != nil || count != uint64(len(conformancePrimes)) {
+		t.Errorf("Count() = %d, %v; want %d", count, err, len(conformancePrimes))
+	}
+	if last, err := store.Last(); err != nil || last == nil || last.Int64() != 97 {
+		t.Errorf("Last() = %v, %v; want 97", last, err)
+	}
+	for k, want := range conformancePrimes {
+		if p, ok, err := store.Nth(uint64(k)); err != nil || !ok || p.Int64() != want {
+			t.Errorf("Nth(%d) = %v, %t, %v; want %d", k, p, ok, err, want)
+		}
+	}
+	if _, ok, err := store.Nth(uint64(len(conformancePrimes))); err != nil || ok {
+		t.Errorf("Nth(%d) found a prime past the end, %v", len(conformancePrimes), err)
+	}
+
+	var walked []int64
+	err := store.Range(big.NewInt(10), big.NewInt(50), func(position uint64, p *big.Int) bool {
+		if conformancePrimes[position] != p.Int64() {
+			t.Errorf("Range passed %s at position %d", p, position)
+		}
+		walked = append(walked, p.Int64())
+		return true
+	})
+	if err != nil || len(walked) != 11 || walked[0] != 11 || walked[10] != 47 {
+		t.Errorf("Range(10, 50) = %v, %v; want 11 to 47", walked, err)
+	}
+	walked = nil
+	err = store.Range(big.NewInt(60), nil, func(position uint64, p *big.Int) bool {
+		walked = append(walked, p.Int64())
+		return len(walked) < 3
+	})
+	if err != nil || len(walked) != 3 || walked[0] != 61 || walked[2] != 71 {
+		t.Errorf("Range(60, nil) stopped after three = %v, %v; want 61 to 71", walked, err)
+	}
+}
+
+func TestFileStoreConformance(t *testing.T) {
+	for _, format := range []string{"text", "delta"} {
+		t.Run(format, func(t *testing.T) {
+			useTemporaryArchive(t)
+			previous := config.Format
+			defer func() { config.Format = previous }()
+			config.Format = format
+			testStoreConformance(t, storage.NewFileStore())
+		})
+	}
+}
+
+func TestBoltStoreConformance(t *testing.T) {
+	useTemporaryArchive(t)
+	store, err := storage.OpenBoltStore(config.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(io.Closer).Close()
+	testStoreConformance(t, store)
+}
+
+func TestComputePrimesReturnsStorageErrors(t *testing.T) {
+	useTemporaryArchive(t)
+	format, bufferSize, workers := config.Format, config.MaxBufferSize, config.Workers
+	defer func() { config.Format, config.MaxBufferSize, config.Workers = format, bufferSize, workers }()
+	config.Format, config.MaxBufferSize, config.Workers = "unknown", 10, 2
+
+	failed := make(chan error)
+	go func() {
+		failed <- computation.ComputePrimes(context.Background(), big.NewInt(1), true, true, nil)
+	}()
+	select {
+	case err := <-failed:
+		if err == nil || !strings.Contains(err.Error(), "unknown") {
+			t.Errorf("ComputePrimes returned %v; want the unknown format", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ComputePrimes kept going after the primes could not be stored")
+	}
+	if count, err := storage.GetPrimeCount(); err != nil || count != 0 {
+		t.Errorf("%d primes stored, %v; want none", count, err)
+	}
+}
+
+func TestComputePrimesRefusesAnEmptyBuffer(t *testing.T) {
+	useTemporaryArchive(t)
+	bufferSize := config.MaxBufferSize
+	defer func() { config.MaxBufferSize = bufferSize }()
+	for _, size := range []int{0, -1} {
+		config.MaxBufferSize = size
+		if err := computation.ComputePrimes(context.Background(), big.NewInt(1), true, true, nil); err == nil {
+			t.Errorf("ComputePrimes ran with a maximum buffer size of %d", size)
+		}
+	}
+	if count, err := storage.GetPrimeCount(); err != nil || count != 0 {
+		t.Errorf("%d primes stored, %v; want none", count, err)
+	}
+}
+
+func TestSieveAgreesWithProbablyPrime(t *testing.T) {
+	for _, r := range [][2]uint64{{0, 200000}, {1 << 40, 1<<40 + 200000}} {
+		var sieved []uint64
+		computation.SievePrimes(r[0], r[1], func(p uint64, timeTaken time.Duration) bool {
+			sieved = append(sieved, p)
+			return true
+		})
+		var want []uint64
+		for n := r[0] + 1; n < r[1]; n++ {
+			if new(big.Int).SetUint64(n).ProbablyPrime(20) {
+				want = append(want, n)
+			}
+		}
+		if len(sieved) != len(want) {
+			t.Fatalf("Sieved %d primes between %d and %d; want %d", len(sieved), r[0], r[1], len(want))
+		}
+		for i := range want {
+			if sieved[i] != want[i] {
+				t.Fatalf("Sieved %d as prime %d between %d and %d; want %d", sieved[i], i, r[0], r[1], want[i])
+			}
+		}
+	}
+}
+
+func TestEnginesStoreTheSamePrimes(t *testing.T) {
+	engine, bufferSize, workers, id := config.Engine, config.MaxBufferSize, config.Workers, config.Id
+	defer func() {
+		config.Engine, config.MaxBufferSize, config.Workers, config.Id = engine, bufferSize, workers, id
+	}()
+	config.MaxBufferSize, config.Workers = 10, 2
+
+	stored := make(map[string][]string)
+	for _, engine := range []string{computation.EngineProbable, computation.EngineSieve} {
+		useTemporaryArchive(t)
+		storage.NewFileStore()
+		config.Engine, config.Id = engine, 0
+		if err := computation.ComputePrimes(context.Background(), big.NewInt(1), true, false, big.NewInt(1000)); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.ReadPrimes(func(p *big.Int) bool {
+			stored[engine] = append(stored[engine], p.String())
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	probable, sieve := strings.Join(stored[computation.EngineProbable], " "), strings.Join(stored[computation.EngineSieve], " ")
+	if probable != sieve || !strings.HasPrefix(probable, "2 3 5 7 11 ") || len(stored[computation.EngineSieve]) != 168 {
+		t.Errorf("The probable engine stored %s\nand the sieve %s; want the 168 primes below 1000 from both", probable, sieve)
+	}
+}
+
+func TestCertificates(t *testing.T) {
+	mersenne := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 89), big.NewInt(1))
+	for _, n := range []*big.Int{big.NewInt(2), big.NewInt(1000003), mersenne} {
+		isPrime, certificate, err := primes.ProvePrimality(n)
+		if err != nil || !isPrime {
+			t.Fatalf("ProvePrimality(%s) = %v, %v; want a proof", n, isPrime, err)
+		}
+		if err := primes.VerifyCertificate(certificate); err != nil {
+			t.Errorf("The certificate of %s does not verify: %v", n, err)
+		}
+	}
+
+	_, certificate, _ := primes.ProvePrimality(mersenne)
+	if certificate.Method != primes.MethodPocklington || len(certificate.Factors) == 0 {
+		t.Fatalf("%s was certified by %s; want %s", mersenne, certificate.Method, primes.MethodPocklington)
+	}
+	certificate.Factors[0].Witness = new(big.Int).Add(certificate.Factors[0].Witness, big.NewInt(1))
+	if primes.VerifyCertificate(certificate) == nil {
+		t.Errorf("A certificate with a tampered witness verified")
+	}
+	_, certificate, _ = primes.ProvePrimality(mersenne)
+	certificate.N = new(big.Int).Add(mersenne, big.NewInt(2))
+	if primes.VerifyCertificate(certificate) == nil {
+		t.Errorf("A certificate moved to %s verified", certificate.N)
+	}
+	if primes.VerifyCertificate(&primes.Certificate{N: big.NewInt(561), Method: primes.MethodMillerRabin}) == nil {
+		t.Errorf("A certificate of the composite 561 verified")
+	}
+
+	for _, n := range []*big.Int{big.NewInt(1), big.NewInt(561), new(big.Int).Mul(mersenne, big.NewInt(3))} {
+		if isPrime, certificate, err := primes.ProvePrimality(n); err != nil || isPrime || certificate != nil {
+			t.Errorf("ProvePrimality(%s) = %v, %v, %v; want composite", n, isPrime, certificate, err)
+		}
+	}
+}
+
+func TestExportRejectsUnknownFormat(t *testing.T) {
+	useTemporaryArchive(t)
+	storage.NewFileStore()
+	var output strings.Builder
+	if err := primes.ExportPrimes(&output, big.NewInt(0), nil, "bogus"); err == nil || output.Len() != 0 {
+		t.Errorf("Exporting an empty archive as bogus wrote %q, %v; want nothing and an error", output.String(), err)
+	}
+}
+
+func TestLeasesReassignExpiredCandidates(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(3), 20*time.Millisecond)
+	lost := leases.Assign("crashed")
+	second := leases.Assign("steady")
+	third := leases.Assign("steady")
+	if lost.Start.Int64() != 3 || second.Start.Int64() != 5 || third.Start.Int64() != 7 {
+		t.Fatalf("Assigned %s, %s, %s; want 3, 5, 7", lost.Start, second.Start, third.Start)
+	}
+
+	for _, lease := range []server.Lease{second, third} {
+		released, err := leases.Return("steady", primes.Prime{Id: lease.Seq, Value: lease.Start, IsValid: true})
+		if err != nil || len(released) != 0 {
+			t.Fatalf("Return(%s) released %v, %v; want nothing while 3 is outstanding", lease.Start, released, err)
+		}
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	reassigned := leases.Assign("steady")
+	if reassigned.Seq != lost.Seq || reassigned.Client != "steady" {
+		t.Fatalf("Assigned %s to %s after the lease expired; want 3 to steady", reassigned.Start, reassigned.Client)
+	}
+	released, err := leases.Return("steady", primes.Prime{Id: reassigned.Seq, Value: reassigned.Start, IsValid: true})
+	if err != nil || len(released) != 3 || leases.Frontier() != 3 || leases.Outstanding() != 0 {
+		t.Fatalf("Return(3) released %v, %v; want 3, 5 and 7", released, err)
+	}
+	if _, err := leases.Return("crashed", primes.Prime{Id: lost.Seq, Value: lost.Start, IsValid: true}); err == nil {
+		t.Errorf("A late result for 3 from the crashed client was accepted twice")
+	}
+}
+
+func TestLeasesWorkUnits(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(3), time.Minute)
+	single := leases.Assign("legacy")
+	first := leases.AssignUnit("fast")
+	if first.Start.Int64() != 5 || first.End.Int64() != 5+2*64 {
+		t.Fatalf("Assigned unit %s to %s; want 5 to 133", first.Start, first.End)
+	}
+
+	result := computation.TestUnit(computation.WorkUnit{Id: first.Seq, Start: first.Start, End: first.End})
+	if released, err := leases.ReturnUnit("fast", result); err != nil || len(released) != 0 {
+		t.Fatalf("ReturnUnit released %v, %v; want nothing while 3 is outstanding", released, err)
+	}
+	released, err := leases.Return("legacy", primes.Prime{Id: single.Seq, Value: single.Start, IsValid: true})
+	if err != nil || len(released) != 31 || released[0].Value.Int64() != 3 || released[30].Value.Int64() != 131 {
+		t.Fatalf("Return(3) released %d primes, %v; want the 31 primes from 3 to 131", len(released), err)
+	}
+
+	second := leases.AssignUnit("fast")
+	if second.Start.Cmp(first.End) != 0 || second.End.Int64()-second.Start.Int64() <= 2*64 {
+		t.Errorf("Assigned unit %s to %s after a fast return; want a larger unit from %s", second.Start, second.End, first.End)
+	}
+	if _, err := leases.ReturnUnit("fast", computation.UnitResult{Id: second.Seq, Start: second.Start, End: second.End, Primes: []*big.Int{big.NewInt(9)}}); err == nil {
+		t.Errorf("A unit listing a number outside its range was accepted")
+	}
+}
+
+func TestLeasesVerifyClients(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(3), time.Minute)
+	leases.SetVerification(true, 1)
+	unit := leases.AssignUnit("liar")
+	honest := computation.TestUnit(computation.WorkUnit{Id: unit.Seq, Start: unit.Start, End: unit.End})
+	found, _ := honest.Found()
+
+	withNine := append(append(append([]*big.Int(nil), found[:3]...), big.NewInt(9)), found[3:]...)
+	composite := computation.UnitResult{Id: unit.Seq, Start: unit.Start, End: unit.End, Primes: withNine}
+	if _, err := leases.ReturnUnit("liar", composite); err == nil {
+		t.Fatalf("A unit listing 9 as prime was accepted")
+	}
+	if again := leases.AssignUnit("liar"); again.Seq != unit.Seq {
+		t.Fatalf("Assigned unit %d after a rejected result; want %d again", again.Seq, unit.Seq)
+	}
+
+	// Leaving out 3 goes unnoticed until the second client finds it.
+	hiding := computation.UnitResult{Id: unit.Seq, Start: unit.Start, End: unit.End, Primes: found[1:]}
+	if released, err := leases.ReturnUnit("liar", hiding); err != nil || len(released) != 0 {
+		t.Fatalf("ReturnUnit released %v, %v; want the first result held back", released, err)
+	}
+	if next := leases.AssignUnit("liar"); next.Seq == unit.Seq {
+		t.Fatalf("Unit %d was double-checked by the client that returned it", unit.Seq)
+	}
+	if check := leases.AssignUnit("honest"); check.Seq != unit.Seq {
+		t.Fatalf("Assigned unit %d to the second client; want %d", check.Seq, unit.Seq)
+	}
+	released, err := leases.ReturnUnit("honest", honest)
+	if err != nil || len(released) != len(found) || released[0].Value.Int64() != 3 {
+		t.Fatalf("Double-checked unit released %v, %v; want every prime from 3", released, err)
+	}
+
+	clients := leases.State().Clients
+	if clients["liar"].Reputation >= 0 || clients["honest"].Reputation <= 0 {
+		t.Errorf("Reputations are %d for the liar and %d for the honest client", clients["liar"].Reputation, clients["honest"].Reputation)
+	}
+	// A prime reported as composite is caught the same way.
+	hidden := server.NewLeases(big.NewInt(7), time.Minute)
+	seven := hidden.Assign("liar")
+	if _, err := hidden.Return("liar", primes.Prime{Id: seven.Seq, Value: seven.Start}); err == nil {
+		t.Errorf("7 was accepted as composite")
+	}
+	for i := 0; !leases.Banned("liar"); i++ {
+		if i == 10 {
+			t.Fatalf("The liar was not banned after reporting every candidate as prime")
+		}
+		p := leases.Assign("liar")
+		leases.Return("liar", primes.Prime{Id: p.Seq, Value: p.Start, IsValid: true})
+	}
+
+	// A client working alone has its results accepted unchecked once no
+	// other client has checked them for a lease timeout.
+	alone := server.NewLeases(big.NewInt(3), 10*time.Millisecond)
+	alone.SetVerification(true, 1)
+	for i := 0; i < 2; i++ {
+		unit := alone.AssignUnit("alone")
+		released, err := alone.ReturnUnit("alone", computation.TestUnit(computation.WorkUnit{Id: unit.Seq, Start: unit.Start, End: unit.End}))
+		if i == 1 && (err != nil || len(released) == 0 || released[0].Value.Int64() != 3) {
+			t.Errorf("ReturnUnit released %v, %v a lease timeout after an unchecked unit; want the primes from 3", released, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLeasesSettleOnlyWhatIsStillOutstanding(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(3), 10*time.Millisecond)
+	unit := leases.AssignUnit("slow")
+	result := computation.TestUnit(computation.WorkUnit{Id: unit.Seq, Start: unit.Start, End: unit.End})
+	checked, err := leases.CheckUnit("slow", result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The unit expires and is returned by another client while the first
+	// result is checked.
+	time.Sleep(20 * time.Millisecond)
+	if again := leases.AssignUnit("fast"); again.Seq != unit.Seq {
+		t.Fatalf("Assigned unit %d after the lease expired; want %d", again.Seq, unit.Seq)
+	}
+	if released, err := leases.ReturnUnit("fast", result); err != nil || len(released) == 0 {
+		t.Fatalf("ReturnUnit released %v, %v; want the primes of the unit", released, err)
+	}
+	if released, err := leases.SettleUnit(checked); err == nil {
+		t.Errorf("Settled a unit returned while it was checked, releasing %v", released)
+	}
+}
+
+func TestLeasesRejectResultsReturnedTwice(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(3), time.Minute)
+	single := leases.Assign("client")
+	unit := leases.AssignUnit("client")
+	p := primes.Prime{Id: single.Seq, Value: single.Start, IsValid: true}
+	result := computation.TestUnit(computation.WorkUnit{Id: unit.Seq, Start: unit.Start, End: unit.End})
+	for i := 0; i < 3; i++ {
+		_, singleErr := leases.Return("client", p)
+		_, unitErr := leases.ReturnUnit("client", result)
+		if i > 0 && (singleErr == nil || unitErr == nil) {
+			t.Fatalf("Results returned again were accepted: %v, %v", singleErr, unitErr)
+		}
+	}
+
+	assigned := make(chan server.Lease)
+	go func() {
+		leases.Assign("client")
+		assigned <- leases.AssignUnit("client")
+	}()
+	select {
+	case next := <-assigned:
+		if next.Start.Cmp(unit.End) < 0 {
+			t.Errorf("Assigned unit %s to %s after the rejected returns; want new work from %s on", next.Start, next.End, unit.End)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Leases stopped assigning work after results were returned twice")
+	}
+}
+
+func TestRestoreLeasesFromSavedState(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(3), time.Minute)
+	three, five, seven := leases.Assign("a"), leases.Assign("b"), leases.Assign("c")
+	leases.Return("b", primes.Prime{Id: five.Seq, Value: five.Start, IsValid: true})
+	saved, err := json.Marshal(leases.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state server.LeasesState
+	if err := json.Unmarshal(saved, &state); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, released := server.RestoreLeases(state, big.NewInt(3), time.Minute)
+	if len(released) != 0 || restored.Outstanding() != 2 {
+		t.Fatalf("Restored %d outstanding leases releasing %v; want 3 and 7 outstanding", restored.Outstanding(), released)
+	}
+	released, err = restored.Return("a", primes.Prime{Id: three.Seq, Value: three.Start, IsValid: true})
+	if err != nil || len(released) != 2 || released[1].Value.Int64() != 5 {
+		t.Errorf("Return(3) after restoring released %v, %v; want 3 and 5", released, err)
+	}
+	if next := restored.Assign("d"); next.Start.Int64() != 9 {
+		t.Errorf("Assigned %s after restoring; want 9", next.Start)
+	}
+
+	// An archive that has moved past 3 and 5 since the state was saved
+	// leaves only 7 outstanding.
+	restored, released = server.RestoreLeases(state, big.NewInt(7), time.Minute)
+	if len(released) != 0 || restored.Outstanding() != 1 || restored.Frontier() != seven.Seq {
+		t.Errorf("Restored %d leases from frontier %d below an archive ending at 5; want only 7", restored.Outstanding(), restored.Frontier())
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	useTemporaryArchive(t)
+	token, err := auth.CreateToken("worker-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := auth.NewTokens()
+	signed := func(token string, body string) *http.Request {
+		r := httptest.NewRequest("POST", config.ReturnPoint, strings.NewReader(body))
+		if err := auth.SignRequest(r, token, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	if client, err := tokens.Verify(signed(token.String(), `{"Id":1}`), 1024); err != nil || client != "worker-1" {
+		t.Errorf("Verify() of a signed request = %q, %v; want worker-1", client, err)
+	}
+	tampered := signed(token.String(), `{"Id":1}`)
+	tampered.Body = ioutil.NopCloser(strings.NewReader(`{"Id":2}`))
+	if _, err := tokens.Verify(tampered, 1024); err == nil {
+		t.Errorf("A request whose body was changed after signing was accepted")
+	}
+	if _, err := tokens.Verify(signed(token.Id+":forged", `{"Id":1}`), 1024); err == nil {
+		t.Errorf("A request signed with the wrong secret was accepted")
+	}
+	if _, err := tokens.Verify(httptest.NewRequest("GET", config.AssignmentPoint, nil), 1024); err == nil {
+		t.Errorf("An unsigned request was accepted")
+	}
+
+	original := signed(token.String(), `{"Id":1}`)
+	replayed := httptest.NewRequest("POST", config.ReturnPoint, strings.NewReader(`{"Id":1}`))
+	replayed.Header = original.Header.Clone()
+	if _, err := tokens.Verify(original, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Verify(replayed, 1024); err == nil {
+		t.Errorf("A replayed request was accepted")
+	}
+	unnonced := signed(token.String(), `{"Id":1}`)
+	unnonced.Header.Del(auth.NonceHeader)
+	if _, err := tokens.Verify(unnonced, 1024); err == nil {
+		t.Errorf("A request without a nonce was accepted")
+	}
+
+	unknown := signed("stranger:secret", `{"Id":1}`)
+	unknown.Body = ioutil.NopCloser(unreadable{t})
+	if _, err := tokens.Verify(unknown, 1024); err == nil {
+		t.Errorf("A request with an unknown token was accepted")
+	}
+}
+
+// unreadable is a request body that fails the test if it is read.
+type unreadable struct {
+	t *testing.T
+}
+
+func (u unreadable) Read(p []byte) (int, error) {
+	u.t.Errorf("The body of a request with an unknown token was read")
+	return 0, io.EOF
+}
+
+func TestClientCertificates(t *testing.T) {
+	useTemporaryArchive(t)
+	serverCert, serverKey, err := auth.IssueServerCertificate([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey, err := auth.IssueClientCertificate("worker-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _ := auth.CertificateIdentity(r)
+		io.WriteString(w, name)
+	}))
+	if s.TLS, err = auth.ServerTLSConfig(auth.CAFile()); err != nil {
+		t.Fatal(err)
+	}
+	s.TLS.Certificates = []tls.Certificate{pair}
+	s.StartTLS()
+	defer s.Close()
+
+	get := func(cert string, key string) (string, error) {
+		tlsConfig, err := auth.ClientTLSConfig(auth.CAFile(), cert, key)
+		if err != nil {
+			return "", err
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := c.Get(s.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		name, err := ioutil.ReadAll(resp.Body)
+		return string(name), err
+	}
+	if name, err := get(clientCert, clientKey); err != nil || name != "worker-1" {
+		t.Errorf("A client presenting its certificate was identified as %q, %v; want worker-1", name, err)
+	}
+	if _, err := get("", ""); err == nil {
+		t.Errorf("A client without a certificate was accepted")
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	counter := metrics.NewCounter("test_candidates_total", "Candidates.")
+	counter.Add(3)
+	histogram := metrics.NewHistogram("test_duration_seconds", "Durations.", []float64{0.001, 1})
+	histogram.ObserveN(time.Millisecond/2, 2)
+	histogram.Observe(2 * time.Second)
+	metrics.NewGaugeFunc("test_held", "Held.", "client", func() []metrics.Sample {
+		return []metrics.Sample{{Label: "b", Value: 2}, {Label: "a", Value: 1}}
+	})
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", config.MetricsPoint, nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE test_candidates_total counter\ntest_candidates_total 3\n",
+		"test_duration_seconds_bucket{le=\"0.001\"} 2\ntest_duration_seconds_bucket{le=\"1\"} 2\ntest_duration_seconds_bucket{le=\"+Inf\"} 3\ntest_duration_seconds_sum 2.001\ntest_duration_seconds_count 3\n",
+		"test_held{client=\"a\"} 1\ntest_held{client=\"b\"} 2\n",
+		"# TYPE primegenerator_primes_per_second gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics are missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	logger, level, format, file, maxSize, backups := config.Logger, config.LogLevel, config.LogFormat, config.LogFile, config.LogMaxSize, config.LogBackups
+	defer func() {
+		config.Logger, config.LogLevel, config.LogFormat, config.LogFile, config.LogMaxSize, config.LogBackups = logger, level, format, file, maxSize, backups
+	}()
+	config.LogLevel, config.LogFormat, config.LogFile, config.LogMaxSize, config.LogBackups = "warn", "json", t.TempDir()+"/primes.log", 1, 2
+	if err := config.ConfigureLogging(); err != nil {
+		t.Fatal(err)
+	}
+	config.Logger.Info("Left out below the level")
+	padding := strings.Repeat("x", 100<<10)
+	for i := 0; i < 40; i++ {
+		config.Logger.Warn("Filling the log", "i", i, "padding", padding)
+	}
+
+	for _, name := range []string{"", ".1", ".2"} {
+		contents, err := ioutil.ReadFile(config.LogFile + name)
+		if err != nil || len(contents) > 1<<20 {
+			t.Fatalf("%s holds %d bytes, %v; want at most a megabyte", config.LogFile+name, len(contents), err)
+		}
+		var line map[string]interface{}
+		if err := json.Unmarshal(contents[:strings.IndexByte(string(contents), '\n')], &line); err != nil || line["msg"] != "Filling the log" {
+			t.Errorf("%s starts with %v, %v; want a JSON warning", config.LogFile+name, line, err)
+		}
+	}
+	if _, err := ioutil.ReadFile(config.LogFile + ".3"); err == nil {
+		t.Errorf("More than 2 old log files were kept")
+	}
+}
+
+func TestLayeredConfiguration(t *testing.T) {
+	configurationFile := config.ConfigurationFile()
+	defer config.SetConfigurationFile(configurationFile)
+	file := t.TempDir() + "/primegenerator.yaml"
+	if err := ioutil.WriteFile(file, []byte("maxfilesize: 5\nport: \"9000\"\nworkers: 4\nendpoints:\n  status: /health\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PRIMEGEN_PORT", "9100")
+	t.Setenv("PRIMEGEN_WORKERS", "3")
+
+	var local config.Config
+	app := cli.NewApp()
+	app.Flags = settingFlags()
+	app.Action = func(c *cli.Context) (err error) {
+		local, err = readConfiguration(c)
+		return err
+	}
+	if err := app.Run([]string{appName, "--config", file, "--workers", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if local.MaxFilesize != 5 || local.Endpoints.Status != "/health" {
+		t.Errorf("The file gave maxfilesize %d and status endpoint %q; want 5 and /health", local.MaxFilesize, local.Endpoints.Status)
+	}
+	if local.Port != "9100" || local.Workers != 2 {
+		t.Errorf("Got port %q and %d workers; want the environment's 9100 and the flag's 2", local.Port, local.Workers)
+	}
+	if local.MaxBufferSize != 300 || local.Endpoints.Return != "/finished" {
+		t.Errorf("Got maxbuffersize %d and return endpoint %q; want the defaults 300 and /finished", local.MaxBufferSize, local.Endpoints.Return)
+	}
+
+	config.SetConfigurationFile(t.TempDir() + "/missing.yaml")
+	if defaults, err := config.GetUserConfig(); err != nil || defaults != config.DefaultConfig() {
+		t.Errorf("A missing configuration file gave %+v, %v; want the defaults", defaults, err)
+	}
+}
+
+func TestHeavyAgreesWithProbablyPrime(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(3), time.Minute)
+	heavy := server.NewHeavy(leases, 2)
+	var decided []primes.Prime
+	composite := make(map[uuid.UUID]bool)
+	for len(decided) < 1000 {
+		// Results come back in reverse order, as if from several clients.
+		var batch []computation.Computation
+		for i := 0; i < 7; i++ {
+			c, ok, err := heavy.Assign("client")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			batch = append(batch, c)
+		}
+		if len(batch) == 0 {
+			t.Fatalf("No computation available with %d candidates decided", len(decided))
+		}
+		for i := len(batch) - 1; i >= 0; i-- {
+			c := batch[i]
+			c.Factor = computation.RunDistributedComputation(c)
+			c.IsValid = c.Factor != nil
+			released, err := heavy.Return("client", c)
+			if err != nil && !composite[c.Hash] {
+				t.Fatal(err)
+			}
+			composite[c.Hash] = composite[c.Hash] || c.IsValid
+			decided = append(decided, released...)
+		}
+	}
+
+	for i, p := range decided {
+		if want := int64(3 + 2*i); p.Value.Int64() != want {
+			t.Fatalf("Candidate %d decided as %s; want %d", i, p.Value, want)
+		}
+		if p.IsValid != p.Value.ProbablyPrime(20) {
+			t.Errorf("Heavy mode decided %s as %v", p.Value, p.IsValid)
+		}
+	}
+}
+
+func TestHeavyRefutesTheClientHidingADivisor(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(3*1009), time.Minute)
+	heavy := server.NewHeavy(leases, 1<<10)
+	c, _, _ := heavy.Assign("hider")
+	if _, err := heavy.Return("hider", c); err == nil {
+		t.Fatalf("%s was settled as prime with its divisor 3 hidden", c.Prime.Value)
+	}
+	clients := leases.State().Clients
+	if clients["hider"].Rejected != 1 || clients["hider"].Reputation >= 0 || clients["(heavy)"].Rejected != 0 {
+		t.Errorf("Refuted %+v and the heavy pseudo-client %+v; want the hider refuted", clients["hider"], clients["(heavy)"])
+	}
+}
+
+func TestHeavyCancelsAfterDivisorFound(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(3*1009), time.Minute)
+	heavy := server.NewHeavy(leases, 1)
+	first, _, _ := heavy.Assign("client")
+	second, _, _ := heavy.Assign("client")
+	if first.Hash != second.Hash || first.Divisor.Int64() != 3 {
+		t.Fatalf("Assigned divisors from %s and %s; want 3 and 5 of %s", first.Divisor, second.Divisor, first.Prime.Value)
+	}
+
+	first.Factor = computation.RunDistributedComputation(first)
+	first.IsValid = first.Factor != nil
+	released, err := heavy.Return("client", first)
+	if err != nil || len(released) != 1 || released[0].IsValid {
+		t.Fatalf("Return of divisor 3 released %v, %v; want %s as composite", released, err, first.Prime.Value)
+	}
+	if next, _, _ := heavy.Assign("client"); next.Hash == first.Hash {
+		t.Errorf("Assigned divisor %s of %s after it was found composite", next.Divisor, next.Prime.Value)
+	}
+	if _, err := heavy.Return("client", second); err == nil {
+		t.Errorf("A late computation for a composite candidate was accepted")
+	}
+}
+
+func TestHeavyRequiresTheDivisor(t *testing.T) {
+	leases := server.NewLeases(big.NewInt(1009), time.Minute)
+	heavy := server.NewHeavy(leases, 1)
+	c, _, _ := heavy.Assign("client")
+	for _, factor := range []*big.Int{nil, big.NewInt(1), big.NewInt(3), big.NewInt(1009)} {
+		forged := c
+		forged.IsValid, forged.Factor = true, factor
+		if released, err := heavy.Return("forger", forged); err == nil {
+			t.Errorf("Return with the divisor %v of 1009 released %v; want it rejected", factor, released)
+		}
+	}
+	if forger := leases.State().Clients["forger"]; forger.Reputation >= 0 || forger.Rejected != 4 {
+		t.Errorf("The forger has reputation %d with %d rejected results; want it refuted for each", forger.Reputation, forger.Rejected)
+	}
+	if again, _, _ := heavy.Assign("client"); again.Hash != c.Hash || again.ComputationId.Cmp(c.ComputationId) != 0 {
+		t.Errorf("Assigned computation %s of %s after a forged result; want %s of %s again", again.ComputationId, again.Prime.Value, c.ComputationId, c.Prime.Value)
+	}
+}
+
 func BenchmarkPrimeAssertion(b *testing.B) {
-	ComputePrimes(big.NewInt(1), false, false, big.NewInt(int64(b.N)))
+	computation.ComputePrimes(context.Background(), big.NewInt(1), false, false, big.NewInt(int64(b.N)))
+}
+
+// computePrimesGoroutinePerCandidate tests the odd numbers below maxNumber
+// the way ComputePrimes did before it had a worker pool, with one goroutine
+// per candidate.
+func computePrimesGoroutinePerCandidate(maxNumber *big.Int) {
+	validPrimes := make(chan primes.Prime, 100)
+	invalidPrimes := make(chan primes.Prime, 100)
+	done := make(chan bool)
+
+	go func() {
+		for elem := range validPrimes {
+			primes.DisplayPrimePretty(elem.Value, elem.TimeTaken)
+		}
+		done <- true
+	}()
+	go func() {
+		for range invalidPrimes {
+		}
+		done <- true
+	}()
+
+	remaining := new(big.Int).Rsh(maxNumber, 1).Int64()
+	finished := make(chan bool, 100)
+	for i := big.NewInt(1); i.Cmp(maxNumber) == -1; i.Add(i, big.NewInt(2)) {
+		go func(i *big.Int) {
+			start := time.Now()
+			if primes.CheckPrimality(i) {
+				validPrimes <- primes.Prime{TimeTaken: time.Now().Sub(start), Value: i}
+			} else {
+				invalidPrimes <- primes.Prime{TimeTaken: time.Now().Sub(start), Value: i}
+			}
+			finished <- true
+		}(new(big.Int).Set(i))
+	}
+	for ; remaining > 0; remaining-- {
+		<-finished
+	}
+	close(validPrimes)
+	close(invalidPrimes)
+	<-done
+	<-done
+}
+
+// benchmarkCandidatesBelow bounds the candidates each iteration of the
+// worker pool benchmarks tests.
+var benchmarkCandidatesBelow = big.NewInt(1 << 16)
+
+func BenchmarkGoroutinePerCandidate(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		computePrimesGoroutinePerCandidate(benchmarkCandidatesBelow)
+	}
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	workers := config.Workers
+	defer func() { config.Workers = workers }()
+	config.Workers = runtime.GOMAXPROCS(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		computation.ComputePrimes(context.Background(), big.NewInt(1), false, false, benchmarkCandidatesBelow)
+	}
 }
@@ -0,0 +1,190 @@
+package primes
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+const (
+	// MethodMillerRabin certifies a prime below millerRabinBound, for which
+	// Miller-Rabin with the bases in millerRabinBases is deterministic.
+	MethodMillerRabin = "miller-rabin"
+	// MethodPocklington certifies a prime n with the Pocklington N-1 test
+	// over a fully factored part of n-1 larger than its square root.
+	MethodPocklington = "pocklington"
+)
+
+var (
+	// millerRabinBound is 3.317e24, below which the first thirteen primes
+	// are known to be a deterministic set of Miller-Rabin bases.
+	millerRabinBound, _ = new(big.Int).SetString("3317044064679887385961981", 10)
+	millerRabinBases    = []int64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41}
+)
+
+// Certificate is a proof that N is prime which can be checked without
+// trusting whatever produced it.
+type Certificate struct {
+	N       *big.Int            `json:"n"`
+	Method  string              `json:"method"`
+	Factors []PocklingtonFactor `json:"factors,omitempty"`
+}
+
+// PocklingtonFactor is one prime power Q^Exponent of the factored part of
+// N-1, with the witness satisfying Pocklington's conditions for Q. Factors
+// at or above millerRabinBound carry a certificate of their own.
+type PocklingtonFactor struct {
+	Q           *big.Int     `json:"q"`
+	Exponent    int          `json:"exponent"`
+	Witness     *big.Int     `json:"witness"`
+	Certificate *Certificate `json:"certificate,omitempty"`
+}
+
+// isPrimeMillerRabin runs Miller-Rabin over millerRabinBases, which is a
+// proof of primality for every n below millerRabinBound.
+func isPrimeMillerRabin(n *big.Int) bool {
+	one := big.NewInt(1)
+	if n.Cmp(big.NewInt(2)) < 0 {
+		return false
+	}
+	for _, b := range millerRabinBases {
+		base := big.NewInt(b)
+		if n.Cmp(base) == 0 {
+			return true
+		}
+		if new(big.Int).Mod(n, base).Sign() == 0 {
+			return false
+		}
+	}
+
+	nMinusOne := new(big.Int).Sub(n, one)
+	d := new(big.Int).Set(nMinusOne)
+	s := 0
+	for d.Bit(0) == 0 {
+		d.Rsh(d, 1)
+		s++
+	}
+
+	for _, b := range millerRabinBases {
+		x := new(big.Int).Exp(big.NewInt(b), d, n)
+		if x.Cmp(one) == 0 || x.Cmp(nMinusOne) == 0 {
+			continue
+		}
+		passed := false
+		for r := 1; r < s; r++ {
+			x.Exp(x, big.NewInt(2), n)
+			if x.Cmp(nMinusOne) == 0 {
+				passed = true
+				break
+			}
+		}
+		if !passed {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyCertificate checks that c is a valid proof that c.N is prime.
+func VerifyCertificate(c *Certificate) error {
+	if c == nil || c.N == nil {
+		return fmt.Errorf("empty certificate")
+	}
+	n := c.N
+	switch c.Method {
+	case MethodMillerRabin:
+		if n.Cmp(millerRabinBound) >= 0 {
+			return fmt.Errorf("%s is too large to be certified by %s", n, c.Method)
+		}
+		if !isPrimeMillerRabin(n) {
+			return fmt.Errorf("%s fails %s", n, c.Method)
+		}
+		return nil
+
+	case MethodPocklington:
+		return verifyPocklington(c)
+	}
+	return fmt.Errorf("%s: unknown method %q", n, c.Method)
+}
+
+// verifyPocklington checks that every factor listed in c is prime, divides
+// N-1 to the given power, has a valid witness, and that together the
+// factors exceed the square root of N.
+func verifyPocklington(c *Certificate) error {
+	one := big.NewInt(1)
+	n := c.N
+	if n.Cmp(big.NewInt(3)) < 0 || n.Bit(0) == 0 {
+		return fmt.Errorf("%s cannot be certified by %s", n, c.Method)
+	}
+	nMinusOne := new(big.Int).Sub(n, one)
+	factored := big.NewInt(1)
+	for _, f := range c.Factors {
+		if f.Q == nil || f.Witness == nil || f.Exponent < 1 {
+			return fmt.Errorf("%s: incomplete factor", n)
+		}
+		if f.Q.Cmp(millerRabinBound) < 0 {
+			if !isPrimeMillerRabin(f.Q) {
+				return fmt.Errorf("%s: factor %s is not prime", n, f.Q)
+			}
+		} else {
+			if f.Certificate == nil || f.Certificate.N.Cmp(f.Q) != 0 {
+				return fmt.Errorf("%s: factor %s has no certificate", n, f.Q)
+			}
+			if err := VerifyCertificate(f.Certificate); err != nil {
+				return fmt.Errorf("%s: factor %s: %v", n, f.Q, err)
+			}
+		}
+
+		if new(big.Int).Exp(f.Witness, nMinusOne, n).Cmp(one) != 0 {
+			return fmt.Errorf("%s: witness %s fails Fermat's test", n, f.Witness)
+		}
+		exponent := new(big.Int).Div(nMinusOne, f.Q)
+		power := new(big.Int).Exp(f.Witness, exponent, n)
+		if new(big.Int).GCD(nil, nil, power.Sub(power, one), n).Cmp(one) != 0 {
+			return fmt.Errorf("%s: witness %s fails for factor %s", n, f.Witness, f.Q)
+		}
+		factored.Mul(factored, new(big.Int).Exp(f.Q, big.NewInt(int64(f.Exponent)), nil))
+	}
+
+	if new(big.Int).Mod(nMinusOne, factored).Sign() != 0 {
+		return fmt.Errorf("%s: factors do not divide n-1", n)
+	}
+	if new(big.Int).Mul(factored, factored).Cmp(n) <= 0 {
+		return fmt.Errorf("%s: factored part of n-1 is below the square root of n", n)
+	}
+	return nil
+}
+
+// VerifyStoredCertificates re-checks the certificate of every stored prime
+// and reports whether all of them are valid, or an error if the
+// certificates cannot be read.
+func VerifyStoredCertificates() (bool, error) {
+	verified, failed, missing := 0, 0, 0
+	err := storage.WalkCertificates(func(p *big.Int, certificate []byte) bool {
+		if certificate == nil {
+			fmt.Printf("%s has no certificate\n", p)
+			missing++
+			return true
+		}
+		var c Certificate
+		if err := json.Unmarshal(certificate, &c); err != nil || c.N == nil || c.N.Cmp(p) != 0 {
+			fmt.Printf("%s: unreadable certificate %q\n", p, certificate)
+			failed++
+			return true
+		}
+		if err := VerifyCertificate(&c); err != nil {
+			fmt.Println(err)
+			failed++
+			return true
+		}
+		verified++
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("%d certificates verified, %d failed, %d missing\n", verified, failed, missing)
+	return failed == 0 && missing == 0, nil
+}
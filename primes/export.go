@@ -0,0 +1,86 @@
+package primes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+const (
+	// ExportText writes one prime per line, as the storage files do.
+	ExportText = "text"
+	// ExportCSV writes an index,prime row per prime under a header.
+	ExportCSV = "csv"
+	// ExportJSONLines writes one {"index":..,"prime":..} object per line.
+	ExportJSONLines = "jsonl"
+	// ExportBinary writes each prime as a packed little-endian uint64.
+	ExportBinary = "binary"
+)
+
+// ExportFormats lists every format ExportPrimes accepts
+var ExportFormats = []string{ExportText, ExportCSV, ExportJSONLines, ExportBinary}
+
+// IsValidExportFormat reports whether ExportPrimes accepts format
+func IsValidExportFormat(format string) bool {
+	for _, f := range ExportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportPrimes streams the stored primes from from to to, inclusive, to w in
+// the given format. The index column counts from 1 for the prime 2 when the
+// archive starts at the beginning of the primes, and from the first stored
+// prime otherwise. A nil to exports to the end of the archive.
+func ExportPrimes(w io.Writer, from *big.Int, to *big.Int, format string) error {
+	if !IsValidExportFormat(format) {
+		return fmt.Errorf("unknown export format %q", format)
+	}
+	var offset uint64
+	first, err := storage.GetFirstPrime()
+	if err != nil {
+		return err
+	}
+	if first != nil {
+		offset, _ = CountPrimesBelow(first)
+	}
+
+	out := bufio.NewWriter(w)
+	if format == ExportCSV {
+		out.WriteString("index,prime\n")
+	}
+	packed := make([]byte, 8)
+	var writeErr error
+	err = storage.WalkStoredPrimes(from, to, func(position uint64, p *big.Int) bool {
+		index := offset + position + 1
+		switch format {
+		case ExportText:
+			_, writeErr = fmt.Fprintf(out, "%s\n", p)
+		case ExportCSV:
+			_, writeErr = fmt.Fprintf(out, "%d,%s\n", index, p)
+		case ExportJSONLines:
+			_, writeErr = fmt.Fprintf(out, "{\"index\":%d,\"prime\":%s}\n", index, p)
+		case ExportBinary:
+			if !p.IsUint64() {
+				writeErr = fmt.Errorf("%s does not fit in a uint64", p)
+				break
+			}
+			binary.LittleEndian.PutUint64(packed, p.Uint64())
+			_, writeErr = out.Write(packed)
+		}
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return out.Flush()
+}
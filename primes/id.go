@@ -1,72 +1,61 @@
 package primes
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
-	"io"
-	"os"
+	"math/big"
 
-	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
 )
 
-// Round() is used to round numbers to the nearest x
-func Round(x, unit float64) float64 {
-	return float64(int64(x/unit+0.5)) * unit
+// GetCurrentId returns the current id, the exact number of primes stored
+func GetCurrentId() (uint64, error) {
+	return GetTotalPrimeCount()
 }
 
-// GetCurrentId returns the current id, rounded to nearest hundred
-func GetCurrentId() uint64 {
-	maximumId := GetTotalPrimeCount()
-	currentId := uint64(Round(float64(maximumId), float64(config.MaxBufferSize)))
-	return currentId
+// GetTotalPrimeCount returns the number of primes stored
+func GetTotalPrimeCount() (uint64, error) {
+	return storage.GetPrimeCount()
 }
 
-// GetTotalPrimeCount finds the number of lines in each file
-func GetTotalPrimeCount() uint64 {
-	var maximumId uint64
-	openDirectory := storage.OpenDirectory(os.O_RDONLY, 0600)
-	defer openDirectory.Close()
-	scanner := bufio.NewScanner(openDirectory)
-	for scanner.Scan() {
-		filename := scanner.Text()
-		file, err := os.Open(storage.FormatFilePath(filename))
-		if err != nil {
-			break
-		}
-
-		r := bufio.NewReader(file)
-		linesInFile, err := getLinesInFile(r)
-		if err != nil {
-			config.Logger.Fatal(err)
-		}
-		maximumId += uint64(linesInFile)
+// CountPrimesBelow counts the primes below the first stored prime, so that
+// stored counts can be turned into pi(N) when the archive starts near the
+// beginning. It returns false when the archive starts too far along for that.
+func CountPrimesBelow(first *big.Int) (uint64, bool) {
+	if first.Cmp(big.NewInt(1000)) > 0 {
+		return 0, false
 	}
-	return maximumId
-}
-
-// getLinesInFile counts the lines of a given file
-func getLinesInFile(r io.Reader) (int, error) {
-	buf := make([]byte, 32*1024)
-	count := 0
-	lineSep := []byte{'\n'}
-
-	for {
-		c, err := r.Read(buf)
-		count += bytes.Count(buf[:c], lineSep)
-
-		switch {
-		case err == io.EOF:
-			return count, nil
-
-		case err != nil:
-			return count, err
+	var count uint64
+	for n := big.NewInt(2); n.Cmp(first) < 0; n.Add(n, big.NewInt(1)) {
+		if CheckPrimality(n) {
+			count++
 		}
 	}
+	return count, true
 }
 
-// ShowCurrentCount displays the n number of primes calculated
-func ShowCurrentCount() {
-	fmt.Printf("Total (to the nearest hundred) prime numbers calculated and stored: #%d\n", config.Id)
+// ShowCurrentCount displays the exact number of primes stored and the
+// largest of them
+func ShowCurrentCount() error {
+	largest, err := storage.GetLargestPrime()
+	if err != nil {
+		return err
+	}
+	if largest == nil {
+		fmt.Println("No prime numbers have been stored yet.")
+		return nil
+	}
+	count, err := GetTotalPrimeCount()
+	if err != nil {
+		return err
+	}
+	first, err := storage.GetFirstPrime()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Prime numbers calculated and stored: #%d\n", count)
+	fmt.Printf("Largest prime stored: %s\n", largest)
+	if below, ok := CountPrimesBelow(first); ok {
+		fmt.Printf("pi(%s) = %d\n", largest, count+below)
+	}
+	return nil
 }
@@ -3,6 +3,7 @@ package primes
 import (
 	"fmt"
 	"math/big"
+	"os"
 	"time"
 )
 
@@ -11,6 +12,8 @@ type Prime struct {
 	Value     *big.Int
 	TimeTaken time.Duration
 	IsValid   bool
+
+	Certificate *Certificate `json:",omitempty"`
 }
 
 // ChecknPrimality checks whether number is a prime.
@@ -18,8 +21,38 @@ func CheckPrimality(number *big.Int) bool {
 	return number.ProbablyPrime(0)
 }
 
+// display is whether primes are shown on stdout as they are found. It is
+// separate from logging, and off unless stdout is a terminal until
+// SetDisplay says otherwise.
+var display = isTerminal(os.Stdout)
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// SetDisplay sets whether primes are shown on stdout as they are found:
+// always, never, or auto to show them only when stdout is a terminal
+func SetDisplay(mode string) error {
+	switch mode {
+	case "always":
+		display = true
+	case "never":
+		display = false
+	case "auto":
+		display = isTerminal(os.Stdout)
+	default:
+		return fmt.Errorf("unknown display %q, want always, never or auto", mode)
+	}
+	return nil
+}
+
 // DisplayPrimePretty displays successful prime generations nicely.
 func DisplayPrimePretty(number *big.Int, timeTaken time.Duration) {
+	if !display {
+		return
+	}
 	fmt.Printf("\033[1;93mTesting \033[0m\033[1;32m%s\033[0m\t\x1b[4;30;42mSuccess\x1b[0m\t%s\x1b[0m\n",
 		number,
 		timeTaken,
@@ -28,6 +61,9 @@ func DisplayPrimePretty(number *big.Int, timeTaken time.Duration) {
 
 // DisplayFailPretty displays failed prime generations nicely.
 func DisplayFailPretty(number *big.Int, timeTaken time.Duration) {
+	if !display {
+		return
+	}
 	fmt.Printf("\033[1;93mTesting \033[0m\033[1;32m%s\033[0m\t\x1b[2;1;41mFail\x1b[0m\t%s\t\x1b[0m\n",
 		number,
 		timeTaken,
@@ -0,0 +1,152 @@
+package primes
+
+import (
+	"fmt"
+	"math/big"
+)
+
+const (
+	// trialDivisionLimit bounds the small factors of n-1 found by trial
+	// division before Pollard's rho takes over.
+	trialDivisionLimit = 1 << 16
+	// pollardRhoIterations bounds each attempt at splitting a cofactor.
+	pollardRhoIterations = 1 << 16
+	// maxWitnessSearch bounds the search for a Pocklington witness.
+	maxWitnessSearch = 1000
+)
+
+// ProvePrimality decides deterministically whether number is prime and, if
+// it is, returns a certificate proving it.
+func ProvePrimality(number *big.Int) (bool, *Certificate, error) {
+	n := new(big.Int).Set(number)
+	if n.Cmp(millerRabinBound) < 0 {
+		if !isPrimeMillerRabin(n) {
+			return false, nil, nil
+		}
+		return true, &Certificate{N: n, Method: MethodMillerRabin}, nil
+	}
+	// ProbablyPrime never reports a prime as composite, so only its
+	// positive answers need a proof.
+	if !n.ProbablyPrime(20) {
+		return false, nil, nil
+	}
+	return provePocklington(n)
+}
+
+// provePocklington builds a Pocklington certificate for n by factoring
+// enough of n-1 to exceed the square root of n.
+func provePocklington(n *big.Int) (bool, *Certificate, error) {
+	one := big.NewInt(1)
+	nMinusOne := new(big.Int).Sub(n, one)
+	factored := big.NewInt(1)
+	certificate := &Certificate{N: n, Method: MethodPocklington}
+	added := make(map[string]bool)
+
+	isEnough := func() bool {
+		return new(big.Int).Mul(factored, factored).Cmp(n) > 0
+	}
+	addFactor := func(q *big.Int) (bool, error) {
+		if added[q.String()] {
+			return true, nil
+		}
+		added[q.String()] = true
+		factor := PocklingtonFactor{Q: q}
+		if q.Cmp(millerRabinBound) >= 0 {
+			isPrime, c, err := ProvePrimality(q)
+			if err != nil || !isPrime {
+				return false, err
+			}
+			factor.Certificate = c
+		}
+		for rest := new(big.Int).Set(nMinusOne); new(big.Int).Mod(rest, q).Sign() == 0; rest.Div(rest, q) {
+			factor.Exponent++
+			factored.Mul(factored, q)
+		}
+
+		exponent := new(big.Int).Div(nMinusOne, q)
+		for a := int64(2); a < maxWitnessSearch; a++ {
+			witness := big.NewInt(a)
+			if new(big.Int).Exp(witness, nMinusOne, n).Cmp(one) != 0 {
+				return false, fmt.Errorf("%s fails Fermat's test to base %d", n, a)
+			}
+			power := new(big.Int).Exp(witness, exponent, n)
+			gcd := new(big.Int).GCD(nil, nil, power.Sub(power, one), n)
+			if gcd.Cmp(one) == 0 {
+				factor.Witness = witness
+				certificate.Factors = append(certificate.Factors, factor)
+				return true, nil
+			}
+			if gcd.Cmp(n) != 0 {
+				return false, fmt.Errorf("%s has the factor %s", n, gcd)
+			}
+		}
+		return false, fmt.Errorf("no Pocklington witness found for %s", n)
+	}
+
+	remaining := new(big.Int).Set(nMinusOne)
+	for d := int64(2); d < trialDivisionLimit && !isEnough(); d++ {
+		divisor := big.NewInt(d)
+		if new(big.Int).Mod(remaining, divisor).Sign() != 0 {
+			continue
+		}
+		for new(big.Int).Mod(remaining, divisor).Sign() == 0 {
+			remaining.Div(remaining, divisor)
+		}
+		if _, err := addFactor(divisor); err != nil {
+			return false, nil, err
+		}
+	}
+
+	cofactors := []*big.Int{remaining}
+	for len(cofactors) > 0 && !isEnough() {
+		m := cofactors[len(cofactors)-1]
+		cofactors = cofactors[:len(cofactors)-1]
+		if m.Cmp(one) == 0 {
+			continue
+		}
+		if m.ProbablyPrime(20) {
+			if _, err := addFactor(m); err != nil {
+				return false, nil, err
+			}
+			continue
+		}
+		if d := pollardRho(m); d != nil {
+			cofactors = append(cofactors, d, new(big.Int).Div(m, d))
+		}
+	}
+
+	if !isEnough() {
+		return false, nil, fmt.Errorf("could not factor enough of %s-1 to prove it prime", n)
+	}
+	return true, certificate, nil
+}
+
+// pollardRho looks for a non-trivial factor of the composite m, returning
+// nil if none turns up within its iteration budget.
+func pollardRho(m *big.Int) *big.Int {
+	one := big.NewInt(1)
+	for c := int64(1); c <= 20; c++ {
+		constant := big.NewInt(c)
+		step := func(v *big.Int) {
+			v.Mul(v, v)
+			v.Add(v, constant)
+			v.Mod(v, m)
+		}
+		x, y := big.NewInt(2), big.NewInt(2)
+		for i := 0; i < pollardRhoIterations; i++ {
+			step(x)
+			step(y)
+			step(y)
+			difference := new(big.Int).Sub(x, y)
+			d := new(big.Int).GCD(nil, nil, difference.Abs(difference), m)
+			if d.Cmp(one) == 0 {
+				continue
+			}
+			if d.Cmp(m) == 0 {
+				break
+			}
+			return d
+		}
+	}
+	return nil
+}
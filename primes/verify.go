@@ -0,0 +1,193 @@
+package primes
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+// VerifyOptions selects how thoroughly VerifyArchive checks the archive.
+type VerifyOptions struct {
+	// Sample is the fraction of stored primes re-tested with CheckPrimality,
+	// along with the gap below each of them. All overrides it.
+	Sample float64
+	All    bool
+	// Repair rewrites every damaged file, and the directory, with the
+	// problems found removed and any missing primes found inserted.
+	Repair bool
+}
+
+// archiveVerifier carries the state of a walk over the archive.
+type archiveVerifier struct {
+	options        VerifyOptions
+	previous       *big.Int
+	beforePrevious *big.Int
+	problems       int
+	tested         int
+}
+
+// report() prints a problem found in the named file
+func (v *archiveVerifier) report(filename string, format string, a ...interface{}) {
+	fmt.Printf("%s: %s\n", filename, fmt.Sprintf(format, a...))
+	v.problems++
+}
+
+// verifyDirectory() checks that every file listed in the directory exists
+// and is listed once, and that no storage file is left out of it. It
+// returns the files to walk, in order.
+func (v *archiveVerifier) verifyDirectory() ([]string, error) {
+	listed, err := storage.GetFileNames()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var fileNames []string
+	for _, filename := range listed {
+		switch {
+		case seen[filename]:
+			v.report("directory", "%s is listed more than once", filename)
+		case !storage.FileExists(filename):
+			v.report("directory", "%s is listed but missing", filename)
+		default:
+			fileNames = append(fileNames, filename)
+		}
+		seen[filename] = true
+	}
+	unlisted, err := storage.FindUnlistedFiles(listed)
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range unlisted {
+		v.report("directory", "%s is not listed", filename)
+	}
+	if len(unlisted) > 0 {
+		fileNames = mergeByRange(fileNames, unlisted)
+	}
+
+	if v.options.Repair && v.problems > 0 {
+		fmt.Println("Rewriting the directory")
+		if err := storage.RewriteDirectory(fileNames); err != nil {
+			return nil, err
+		}
+	}
+	return fileNames, nil
+}
+
+// mergeByRange() slots unlisted files in among the listed ones by the range
+// in their names, keeping the listed files in their order
+func mergeByRange(listed []string, unlisted []string) []string {
+	var merged []string
+	for _, filename := range listed {
+		start, _, ok := storage.ParseFileRange(filename)
+		for len(unlisted) > 0 && ok {
+			next, _, _ := storage.ParseFileRange(unlisted[0])
+			if next >= start {
+				break
+			}
+			merged = append(merged, unlisted[0])
+			unlisted = unlisted[1:]
+		}
+		merged = append(merged, filename)
+	}
+	return append(merged, unlisted...)
+}
+
+// verifyFile() checks the primes of one storage file against each other and
+// those before them, returning the primes that survive the checks, with any
+// missing primes inserted, and whether anything was wrong
+func (v *archiveVerifier) verifyFile(filename string) (storage.BigIntSlice, bool, error) {
+	var kept storage.BigIntSlice
+	damaged := false
+	err := storage.InspectFile(filename, func(p *big.Int) {
+		if v.previous != nil && p.Cmp(v.previous) == 0 {
+			v.report(filename, "%s is stored more than once", p)
+			damaged = true
+			return
+		}
+		if v.previous != nil && p.Cmp(v.previous) < 0 {
+			damaged = true
+			// A single entry too large for its place holds up every prime
+			// after it, so it is dropped rather than they are.
+			last := len(kept) - 1
+			if last >= 0 && kept[last] == v.previous && (v.beforePrevious == nil || p.Cmp(v.beforePrevious) > 0) {
+				v.report(filename, "%s is out of order before %s", v.previous, p)
+				kept = kept[:last]
+				v.previous = v.beforePrevious
+			} else {
+				v.report(filename, "%s is out of order after %s", p, v.previous)
+				return
+			}
+		}
+		if v.options.All || rand.Float64() < v.options.Sample {
+			v.tested++
+			if !CheckPrimality(p) {
+				v.report(filename, "%s is not prime", p)
+				damaged = true
+				return
+			}
+			if v.previous != nil {
+				for _, missing := range findMissingPrimes(v.previous, p) {
+					v.report(filename, "%s is missing between %s and %s", missing, v.previous, p)
+					kept = append(kept, missing)
+					damaged = true
+				}
+			}
+		}
+		kept = append(kept, p)
+		v.previous, v.beforePrevious = p, v.previous
+	}, func(description string) {
+		v.report(filename, "%s", description)
+		damaged = true
+	})
+	return kept, damaged, err
+}
+
+// findMissingPrimes() returns the primes strictly between two consecutive
+// stored primes, which should be none
+func findMissingPrimes(below *big.Int, above *big.Int) []*big.Int {
+	var missing []*big.Int
+	if below.Cmp(big.NewInt(2)) < 0 && above.Cmp(big.NewInt(2)) > 0 {
+		missing = append(missing, big.NewInt(2))
+	}
+	candidate := new(big.Int).Add(below, big.NewInt(1))
+	candidate.SetBit(candidate, 0, 1)
+	if candidate.Cmp(big.NewInt(3)) < 0 {
+		candidate.SetInt64(3)
+	}
+	for ; candidate.Cmp(above) < 0; candidate.Add(candidate, big.NewInt(2)) {
+		if CheckPrimality(candidate) {
+			missing = append(missing, new(big.Int).Set(candidate))
+		}
+	}
+	return missing
+}
+
+// VerifyArchive walks every storage file checking that the primes are in
+// increasing order with no duplicates, damaged entries, composites or
+// missing primes, and reports whether the archive is sound, or an error if
+// it cannot be read. With options.Repair, damaged files and the directory
+// are rewritten, and the archive counts as sound once repaired.
+func VerifyArchive(options VerifyOptions) (bool, error) {
+	v := &archiveVerifier{options: options}
+	fileNames, err := v.verifyDirectory()
+	if err != nil {
+		return false, err
+	}
+
+	for _, filename := range fileNames {
+		kept, damaged, err := v.verifyFile(filename)
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", filename, err)
+		}
+		if damaged && options.Repair {
+			fmt.Printf("Rewriting %s with %d primes\n", filename, len(kept))
+			if err := storage.RewriteFile(filename, kept); err != nil {
+				return false, fmt.Errorf("%s: %v", filename, err)
+			}
+		}
+	}
+	fmt.Printf("%d files checked, %d primes re-tested, %d problems found\n", len(fileNames), v.tested, v.problems)
+	return v.problems == 0 || options.Repair, nil
+}
@@ -0,0 +1,83 @@
+package primes
+
+import (
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+// useTemporaryArchive points the storage paths at a fresh text archive
+func useTemporaryArchive(t *testing.T) {
+	base, directory, journal, index, format, maxFilesize := config.Base, config.Directory, config.Journal, config.Index, config.Format, config.MaxFilesize
+	t.Cleanup(func() {
+		config.Base, config.Directory, config.Journal, config.Index, config.Format, config.MaxFilesize = base, directory, journal, index, format, maxFilesize
+		storage.NewFileStore()
+	})
+	config.Base = t.TempDir() + "/"
+	config.Directory = config.Base + "directory.txt"
+	config.Journal = config.Base + "journal.txt"
+	config.Index = config.Base + "index.json"
+	config.Format, config.MaxFilesize = "text", 1000
+	storage.NewFileStore()
+}
+
+// readArchive returns every stored prime, in order, as text lines
+func readArchive(t *testing.T) string {
+	t.Helper()
+	var stored []string
+	if err := storage.ReadPrimes(func(p *big.Int) bool {
+		stored = append(stored, p.String())
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(stored, "\n") + "\n"
+}
+
+func TestVerifyArchiveFindsAndRepairsDamage(t *testing.T) {
+	useTemporaryArchive(t)
+	var buffer storage.BigIntSlice
+	for n := int64(2); n < 1000; n++ {
+		if CheckPrimality(big.NewInt(n)) {
+			buffer = append(buffer, big.NewInt(n))
+		}
+	}
+	if err := storage.AppendPrimes(buffer, nil); err != nil {
+		t.Fatal(err)
+	}
+	sound := readArchive(t)
+
+	// Drop 97, store 211 twice and slip the composite 221 in after it.
+	fileNames, err := storage.GetFileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := storage.FormatFilePath(fileNames[0])
+	damaged := strings.Replace(sound, "\n97\n", "\n", 1)
+	damaged = strings.Replace(damaged, "\n211\n", "\n211\n211\n221\n", 1)
+	if err := ioutil.WriteFile(path, []byte(damaged), 0600); err != nil {
+		t.Fatal(err)
+	}
+	storage.NewFileStore()
+
+	if ok, err := VerifyArchive(VerifyOptions{All: true}); err != nil || ok {
+		t.Fatalf("VerifyArchive() of the damaged archive = %t, %v; want damage found", ok, err)
+	}
+	if contents, _ := ioutil.ReadFile(path); string(contents) != damaged {
+		t.Fatalf("VerifyArchive() changed the archive without Repair")
+	}
+	if ok, err := VerifyArchive(VerifyOptions{All: true, Repair: true}); err != nil || !ok {
+		t.Fatalf("VerifyArchive() with Repair = %t, %v; want the archive repaired", ok, err)
+	}
+	storage.NewFileStore()
+	if ok, err := VerifyArchive(VerifyOptions{All: true}); err != nil || !ok {
+		t.Errorf("VerifyArchive() after the repair = %t, %v; want a sound archive", ok, err)
+	}
+	if repaired := readArchive(t); repaired != sound {
+		t.Errorf("The repaired archive holds\n%s\nwant\n%s", repaired, sound)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+// dashboardPage is the status page, which follows the status sent by
+// statusEventsHandler at {{events}}. It needs nothing beyond the server
+// itself, so that it works on a cluster without internet access.
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PrimeNumberGenerator</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: right; }
+th { background: #f4f4f4; }
+td:first-child, th:first-child { text-align: left; }
+.summary td { font-family: monospace; }
+#state { color: #888; }
+.banned { color: #b00; }
+</style>
+</head>
+<body>
+<h1>PrimeNumberGenerator <span id="state">connecting</span></h1>
+<table class="summary">
+<tr><th>Frontier</th><td id="frontier"></td></tr>
+<tr><th>Largest prime</th><td id="largest"></td></tr>
+<tr><th>Primes found</th><td id="count"></td></tr>
+<tr><th>Buffered</th><td id="buffered"></td></tr>
+</table>
+<h2>Clients</h2>
+<table id="clients"></table>
+<h2>Outstanding leases</h2>
+<table id="leases"></table>
+<h2>Recent flushes</h2>
+<table id="flushes"></table>
+<script>
+// Numbers too large for a double are read as strings, so that they are shown
+// exactly.
+function parse(text) {
+  return JSON.parse(text.replace(/([:\[,]\s*)(-?\d{16,})(?=\s*[,\]}])/g, '$1"$2"'));
+}
+
+function ago(time) {
+  var seconds = (Date.now() - new Date(time).getTime()) / 1000;
+  if (new Date(time).getFullYear() < 2) return "never";
+  if (seconds < 60) return Math.max(0, Math.round(seconds)) + "s ago";
+  if (seconds < 3600) return Math.round(seconds / 60) + "m ago";
+  return Math.round(seconds / 3600) + "h ago";
+}
+
+function table(id, headings, rows) {
+  var t = document.getElementById(id);
+  t.textContent = "";
+  var tr = t.insertRow();
+  headings.forEach(function (h) {
+    var th = document.createElement("th");
+    th.textContent = h;
+    tr.appendChild(th);
+  });
+  rows.forEach(function (row) {
+    var tr = t.insertRow();
+    row.cells.forEach(function (cell) {
+      tr.insertCell().textContent = cell;
+    });
+    if (row.className) tr.className = row.className;
+  });
+}
+
+function show(s) {
+  document.getElementById("frontier").textContent = s.Frontier;
+  document.getElementById("largest").textContent = s.LargestPrime === null ? "none" : s.LargestPrime;
+  document.getElementById("count").textContent = s.Count;
+  document.getElementById("buffered").textContent = s.Buffered;
+  table("clients", ["Client", "Outstanding", "Leased", "Returned", "Rejected", "Candidates/s", "Reputation", "Last seen"],
+    (s.Clients || []).map(function (c) {
+      return {
+        cells: [c.Name, c.Outstanding, c.Leased, c.Returned, c.Rejected, Math.round(c.Throughput), c.Reputation, ago(c.LastSeen)],
+        className: c.Banned ? "banned" : ""
+      };
+    }));
+  table("leases", ["Lease", "From", "To", "Client", "Expires"],
+    (s.Outstanding || []).map(function (l) {
+      var expires = new Date(l.Deadline).getFullYear() < 2 ? "now" : new Date(l.Deadline).toLocaleTimeString();
+      return {cells: [l.Seq, l.Start, l.End, l.Client || "(unassigned)", expires]};
+    }));
+  table("flushes", ["Time", "Primes", "Largest", "Took"],
+    (s.Flushes || []).slice().reverse().map(function (f) {
+      return {cells: [new Date(f.Time).toLocaleTimeString(), f.Primes, f.Largest, (f.Duration / 1e6).toFixed(1) + " ms"]};
+    }));
+}
+
+var events = new EventSource("{{events}}");
+events.onopen = function () { document.getElementById("state").textContent = "live"; };
+events.onerror = function () { document.getElementById("state").textContent = "disconnected, retrying"; };
+events.onmessage = function (e) { show(parse(e.data)); };
+</script>
+</body>
+</html>
+`
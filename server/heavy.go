@@ -0,0 +1,243 @@
+package server
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/computation"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// heavyClient is the client Heavy leases its candidates as. Results are
+	// returned to Leases as the client that decided the candidate.
+	heavyClient = "(heavy)"
+	// heavyWindow is the number of candidates Heavy splits between heavy
+	// clients at once.
+	heavyWindow = 16
+	// HeavyRangeDivisors is the number of divisors in each computation.
+	HeavyRangeDivisors = 1 << 16
+)
+
+// divisorRange is a computation handed to a heavy client and not yet
+// returned.
+type divisorRange struct {
+	computation computation.Computation
+	deadline    time.Time
+}
+
+// heavyCandidate is the state of a candidate split into computations,
+// which all carry its hash.
+type heavyCandidate struct {
+	lease     Lease
+	hash      uuid.UUID
+	next      *big.Int
+	limit     *big.Int
+	ranges    int64
+	pending   map[int64]*divisorRange
+	timeTaken time.Duration
+}
+
+// exhausted() reports whether every divisor of the candidate has been
+// handed out
+func (c *heavyCandidate) exhausted() bool {
+	return c.ranges > 0 && c.next.Cmp(c.limit) > 0
+}
+
+// Heavy splits candidates leased from Leases into ranges of trial divisions
+// for heavy clients. A candidate is decided composite as soon as any range
+// finds a divisor, after which its remaining ranges are no longer handed
+// out and late results for it are rejected, and prime once every range has
+// come back without one.
+type Heavy struct {
+	mu         sync.Mutex
+	leases     *Leases
+	divisors   int64
+	candidates map[uuid.UUID]*heavyCandidate
+}
+
+// NewHeavy returns Heavy splitting candidates leased from leases into
+// ranges of divisors divisors each
+func NewHeavy(leases *Leases, divisors int64) *Heavy {
+	return &Heavy{
+		leases:     leases,
+		divisors:   divisors,
+		candidates: make(map[uuid.UUID]*heavyCandidate),
+	}
+}
+
+// ordered() returns the candidates in the order they were leased. The
+// caller must hold h.mu.
+func (h *Heavy) ordered() []*heavyCandidate {
+	var ordered []*heavyCandidate
+	for _, c := range h.candidates {
+		ordered = append(ordered, c)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].lease.Seq < ordered[j].lease.Seq })
+	return ordered
+}
+
+// Assign returns the next computation for client: a computation whose
+// client did not return it in time, or else the next range of the lowest
+// candidate with divisors left, leasing a new candidate if need be. It
+// returns false when every candidate in the window is waiting on results.
+func (h *Heavy) Assign(client string) (computation.Computation, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	ordered := h.ordered()
+
+	for _, c := range ordered {
+		ids := make([]int64, 0, len(c.pending))
+		for id := range c.pending {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			if r := c.pending[id]; now.After(r.deadline) {
+				r.deadline = now.Add(h.leases.timeout)
+				return r.computation, true, nil
+			}
+		}
+	}
+	for _, c := range ordered {
+		if !c.exhausted() {
+			return h.split(c, now), true, nil
+		}
+	}
+
+	for len(h.candidates) < heavyWindow {
+		hash, err := computation.GenerateUUID()
+		if err != nil {
+			return computation.Computation{}, false, err
+		}
+		lease := h.leases.Assign(heavyClient)
+		if h.isTracked(lease.Seq) {
+			continue
+		}
+		c := &heavyCandidate{
+			lease:   lease,
+			hash:    hash,
+			next:    big.NewInt(3),
+			limit:   new(big.Int).Sqrt(lease.Start),
+			pending: make(map[int64]*divisorRange),
+		}
+		h.candidates[c.hash] = c
+		return h.split(c, now), true, nil
+	}
+	return computation.Computation{}, false, nil
+}
+
+// isTracked() reports whether the lease seq is already being split, as
+// Leases hands back expired leases to the client that let them expire. The
+// caller must hold h.mu.
+func (h *Heavy) isTracked(seq uint64) bool {
+	for _, c := range h.candidates {
+		if c.lease.Seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// split() hands out the next range of divisors of a candidate. The first
+// range is handed out even when it is empty, so that every candidate is
+// decided by a returned computation. The caller must hold h.mu.
+func (h *Heavy) split(c *heavyCandidate, now time.Time) computation.Computation {
+	end := new(big.Int).Add(c.next, big.NewInt(2*h.divisors))
+	if beyond := new(big.Int).Add(c.limit, big.NewInt(1)); end.Cmp(beyond) > 0 {
+		end = beyond
+	}
+	if end.Cmp(c.next) < 0 {
+		end.Set(c.next)
+	}
+	comp := computation.Computation{
+		Prime:         primes.Prime{Id: c.lease.Seq, Value: c.lease.Start},
+		Divisor:       new(big.Int).Set(c.next),
+		DivisorEnd:    end,
+		ComputationId: big.NewInt(c.ranges),
+		Hash:          c.hash,
+	}
+	c.pending[c.ranges] = &divisorRange{computation: comp, deadline: now.Add(h.leases.timeout)}
+	c.ranges++
+	c.next.Set(end)
+	c.next.SetBit(c.next, 0, 1)
+	return comp
+}
+
+// Release hands back a computation a client will not finish, so that it is
+// assigned again at once rather than when it expires
+func (h *Heavy) Release(released computation.Computation) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.candidates[released.Hash]
+	if !ok || released.ComputationId == nil || !released.ComputationId.IsInt64() {
+		return fmt.Errorf("candidate %s is not outstanding", released.Hash)
+	}
+	r, ok := c.pending[released.ComputationId.Int64()]
+	if !ok {
+		return fmt.Errorf("computation %s of %s is not outstanding", released.ComputationId, c.lease.Start)
+	}
+	r.deadline = time.Time{}
+	return nil
+}
+
+// Return decides and settles the result client returned for a computation,
+// as Decide, Leases.Check and Leases.Settle do.
+func (h *Heavy) Return(client string, result computation.Computation) ([]primes.Prime, error) {
+	decided, err := h.Decide(client, result)
+	if err != nil || decided == nil {
+		return nil, err
+	}
+	return h.leases.Return(client, *decided)
+}
+
+// Decide records the result client returned for a computation and returns
+// the candidate once it is decided, to be checked and settled by Leases as
+// the result of client, which answers for the candidate. Results for
+// candidates already decided, or for computations not handed out, are
+// rejected, as are results claiming a divisor that does not divide the
+// candidate, for which client is refuted and the computation assigned again.
+func (h *Heavy) Decide(client string, result computation.Computation) (*primes.Prime, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.candidates[result.Hash]
+	if !ok {
+		return nil, fmt.Errorf("candidate %s is not outstanding", result.Hash)
+	}
+	if result.ComputationId == nil || !result.ComputationId.IsInt64() {
+		return nil, fmt.Errorf("computation of %s has no id", c.lease.Start)
+	}
+	r, ok := c.pending[result.ComputationId.Int64()]
+	if !ok {
+		return nil, fmt.Errorf("computation %s of %s is not outstanding", result.ComputationId, c.lease.Start)
+	}
+	if result.Divisor == nil || result.Divisor.Cmp(r.computation.Divisor) != 0 {
+		return nil, fmt.Errorf("computation %s of %s starts at %s, not %s", result.ComputationId, c.lease.Start, r.computation.Divisor, result.Divisor)
+	}
+	if result.IsValid && !computation.IsFactor(result.Factor, c.lease.Start) {
+		h.leases.Refute(client)
+		r.deadline = time.Time{}
+		return nil, fmt.Errorf("%v is not a divisor of %s", result.Factor, c.lease.Start)
+	}
+	delete(c.pending, result.ComputationId.Int64())
+	c.timeTaken += result.TimeTaken
+
+	decided := primes.Prime{Id: c.lease.Seq, Value: c.lease.Start, TimeTaken: c.timeTaken}
+	switch {
+	case result.IsValid:
+		decided.IsValid = false
+	case c.exhausted() && len(c.pending) == 0:
+		decided.IsValid = true
+	default:
+		h.leases.Renew(c.lease.Seq)
+		return nil, nil
+	}
+	delete(h.candidates, c.hash)
+	return &decided, nil
+}
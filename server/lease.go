@@ -0,0 +1,631 @@
+package server
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/computation"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/metrics"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+)
+
+const (
+	// minUnitCandidates is the size of the first work unit given to a
+	// client, before its throughput is known.
+	minUnitCandidates = 64
+	// maxUnitCandidates caps work units however fast a client is, so that
+	// losing one never costs much.
+	maxUnitCandidates = 1 << 20
+
+	// maxReputation caps the reputation a client earns, one point for each
+	// result confirmed by the server or by a second client, so that a long
+	// honest record does not buy many wrong results.
+	maxReputation = 100
+	// reputationPenalty is the reputation a client loses for a wrong result.
+	reputationPenalty = 20
+	// banReputation is the reputation at or below which a client is refused.
+	// Clients below zero are throttled: they are given the smallest units,
+	// all of them checked by a second client.
+	banReputation = -50
+)
+
+// Lease is a range of candidates assigned to a client, the odd numbers from
+// Start up to but not including End, which must be returned by its deadline
+// or it is given to another client. Single candidates are leases with End
+// two above Start.
+type Lease struct {
+	Seq      uint64
+	Start    *big.Int
+	End      *big.Int
+	Client   string
+	Assigned time.Time
+	Deadline time.Time
+	// Copies is 2 for a work unit that two clients must decide before its
+	// result is released. The first result waits in FirstClient and
+	// FirstResult while the unit is leased to another client.
+	Copies      int            `json:",omitempty"`
+	FirstClient string         `json:",omitempty"`
+	FirstResult []primes.Prime `json:",omitempty"`
+}
+
+// isSingle() reports whether the lease covers a single candidate
+func (lease *Lease) isSingle() bool {
+	return new(big.Int).Sub(lease.End, lease.Start).Cmp(big.NewInt(2)) == 0
+}
+
+// Leases hands out candidates to clients and collects their results. A
+// candidate stays outstanding until a result for it comes back, and results
+// are only released in candidate order, so a client that disappears delays
+// the archive by at most one timeout rather than leaving a hole in it.
+type Leases struct {
+	mu          sync.Mutex
+	timeout     time.Duration
+	next        *big.Int
+	nextSeq     uint64
+	outstanding map[uint64]*Lease
+	frontier    uint64
+	decided     map[uint64][]primes.Prime
+	clients     map[string]*ClientStats
+	recheck     bool
+	doubleCheck float64
+}
+
+// ClientStats accounts for the work of one client.
+type ClientStats struct {
+	Leased   uint64
+	Returned uint64
+	Rejected uint64
+	// Throughput is the number of candidates per second the client has been
+	// deciding, which sizes the work units it is given.
+	Throughput float64
+	// Reputation rises with results found to be right and falls with
+	// results found to be wrong, throttling and then banning the client.
+	Reputation int
+	// LastSeen is when the client last made a request.
+	LastSeen time.Time
+}
+
+// throttled() reports whether the client has given enough wrong results
+// that all of its work is checked
+func (stats *ClientStats) throttled() bool {
+	return stats.Reputation < 0
+}
+
+// confirm() credits the client with a result found to be right
+func (stats *ClientStats) confirm() {
+	if stats.Reputation < maxReputation {
+		stats.Reputation++
+	}
+}
+
+// refute() debits the client for a result found to be wrong
+func (stats *ClientStats) refute() {
+	stats.Rejected++
+	stats.Reputation -= reputationPenalty
+}
+
+// NewLeases returns Leases handing out the odd numbers from first onwards,
+// each for timeout. The primes reported by clients are re-checked, and no
+// work units are double-checked, until SetVerification says otherwise.
+func NewLeases(first *big.Int, timeout time.Duration) *Leases {
+	return &Leases{
+		timeout:     timeout,
+		recheck:     true,
+		next:        new(big.Int).Set(first),
+		outstanding: make(map[uint64]*Lease),
+		decided:     make(map[uint64][]primes.Prime),
+		clients:     make(map[string]*ClientStats),
+	}
+}
+
+// SetVerification sets whether the primes reported by clients are re-checked
+// before they are released, and the fraction of work units that are also
+// assigned to a second client to compare their results
+func (l *Leases) SetVerification(recheck bool, doubleCheck float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recheck, l.doubleCheck = recheck, doubleCheck
+}
+
+// Seen records that client has just made a request
+func (l *Leases) Seen(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats(client).LastSeen = time.Now()
+}
+
+// Banned reports whether client has given so many wrong results that its
+// requests are refused
+func (l *Leases) Banned(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats, ok := l.clients[client]
+	return ok && stats.Reputation <= banReputation
+}
+
+// Refute debits client for a wrong result found outside Leases
+func (l *Leases) Refute(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats(client).refute()
+}
+
+// stats() returns the accounting of client. The caller must hold l.mu.
+func (l *Leases) stats(client string) *ClientStats {
+	stats, ok := l.clients[client]
+	if !ok {
+		stats = &ClientStats{}
+		l.clients[client] = stats
+	}
+	return stats
+}
+
+// reassignExpired() hands the lowest expired lease accepted by fits to
+// client, returning nil if there is none. The caller must hold l.mu.
+func (l *Leases) reassignExpired(client string, fits func(*Lease) bool) *Lease {
+	now := time.Now()
+	var expired []uint64
+	for seq, lease := range l.outstanding {
+		if now.After(lease.Deadline) && fits(lease) {
+			expired = append(expired, seq)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	lease := l.outstanding[expired[0]]
+	lease.Client, lease.Assigned, lease.Deadline = client, now, now.Add(l.timeout)
+	l.stats(client).Leased++
+	return lease
+}
+
+// lease() hands the next candidates candidates to client. The caller must
+// hold l.mu.
+func (l *Leases) lease(client string, candidates uint64) *Lease {
+	now := time.Now()
+	end := new(big.Int).SetUint64(2 * candidates)
+	lease := &Lease{
+		Seq:      l.nextSeq,
+		Start:    new(big.Int).Set(l.next),
+		End:      end.Add(end, l.next),
+		Client:   client,
+		Assigned: now,
+		Deadline: now.Add(l.timeout),
+	}
+	l.outstanding[lease.Seq] = lease
+	l.stats(client).Leased++
+	l.nextSeq++
+	l.next.Set(lease.End)
+	return lease
+}
+
+// Assign leases a single candidate to client. Expired single candidates are
+// handed out again before any new candidate, lowest first, since they hold
+// up the frontier. Expired work units are left to clients asking for units.
+func (l *Leases) Assign(client string) Lease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lease := l.reassignExpired(client, (*Lease).isSingle); lease != nil {
+		return *lease
+	}
+	return *l.lease(client, 1)
+}
+
+// AssignUnit leases a work unit to client, sized so that the client should
+// decide it in about a quarter of the lease timeout at the rate it has
+// managed so far. Any expired lease is handed out again first, lowest first,
+// except to the client that already returned it for a double-check. Some
+// units, and every unit of a throttled client, are double-checked.
+func (l *Leases) AssignUnit(client string) Lease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fits := func(lease *Lease) bool { return lease.FirstClient != client }
+	if lease := l.reassignExpired(client, fits); lease != nil {
+		return *lease
+	}
+	stats := l.stats(client)
+	candidates := uint64(stats.Throughput * (l.timeout / 4).Seconds())
+	if candidates < minUnitCandidates || stats.throttled() {
+		candidates = minUnitCandidates
+	} else if candidates > maxUnitCandidates {
+		candidates = maxUnitCandidates
+	}
+	lease := l.lease(client, candidates)
+	if stats.throttled() || rand.Float64() < l.doubleCheck {
+		lease.Copies = 2
+	}
+	return *lease
+}
+
+// Renew pushes back the deadline of the lease seq, for a client still
+// working on it, and reports whether it is still outstanding
+func (l *Leases) Renew(seq uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lease, ok := l.outstanding[seq]
+	if ok {
+		lease.Deadline = time.Now().Add(l.timeout)
+	}
+	return ok
+}
+
+// Release hands back the lease seq from a client that will not finish it,
+// so that it is assigned again at once rather than when it expires
+func (l *Leases) Release(client string, seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lease, ok := l.outstanding[seq]
+	if !ok || lease.Client != client {
+		return fmt.Errorf("candidate %d is not leased to %s", seq, client)
+	}
+	lease.Deadline = time.Time{}
+	return nil
+}
+
+// release() records the primes found in the lease seq, dropping it, and
+// returns every result no longer held back by an outstanding lease. The
+// caller must hold l.mu.
+func (l *Leases) release(seq uint64, found []primes.Prime) []primes.Prime {
+	if lease, ok := l.outstanding[seq]; ok {
+		unit := computation.WorkUnit{Start: lease.Start, End: lease.End}
+		metrics.CandidatesTested.Add(unit.Candidates())
+	}
+	delete(l.outstanding, seq)
+	l.decided[seq] = found
+	var released []primes.Prime
+	for {
+		next, ok := l.decided[l.frontier]
+		if !ok {
+			return released
+		}
+		delete(l.decided, l.frontier)
+		released = append(released, next...)
+		l.frontier++
+	}
+}
+
+// Checked is a result that Check or CheckUnit has verified, holding no lock
+// while the server decided candidates itself, to be settled by Settle or
+// SettleUnit.
+type Checked struct {
+	client string
+	seq    uint64
+	found  []primes.Prime
+	// verdicts is the primality of the results the server decided itself,
+	// along with the first result of a double-checked unit if there was one.
+	verdicts map[string]bool
+	returned time.Time
+}
+
+// Return checks and settles the result client found for the single
+// candidate leased as p.Id, as Check and Settle do.
+func (l *Leases) Return(client string, p primes.Prime) ([]primes.Prime, error) {
+	checked, err := l.Check(client, p)
+	if err != nil {
+		return nil, err
+	}
+	return l.Settle(checked)
+}
+
+// Check verifies the result client found for the single candidate leased
+// as p.Id, to be settled by Settle. Results for candidates that are not
+// outstanding, because another client already returned them, are rejected.
+// The server decides the candidate itself when it re-checks results, and
+// otherwise for the same fraction of results as it double-checks work units
+// and for every result of a throttled client, rejecting a composite reported
+// as prime or a prime reported as composite, after which the candidate is
+// assigned again. Only the lease is read under l.mu, so that the server does
+// not hold up other clients while it decides a candidate.
+func (l *Leases) Check(client string, p primes.Prime) (Checked, error) {
+	lease, check, err := l.leasedCandidate(client, p)
+	if err != nil {
+		return Checked{}, err
+	}
+
+	checked := Checked{client: client, seq: p.Id, found: []primes.Prime{p}, returned: time.Now()}
+	if check {
+		if prime := primes.CheckPrimality(p.Value); prime != p.IsValid {
+			l.refuteChecked(client, lease)
+			if prime {
+				return Checked{}, fmt.Errorf("%s is prime", p.Value)
+			}
+			return Checked{}, fmt.Errorf("%s is not prime", p.Value)
+		}
+		checked.verdicts = map[string]bool{p.Value.String(): p.IsValid}
+	}
+	return checked, nil
+}
+
+// leasedCandidate() returns the lease of the single candidate p.Id returned
+// by client, and whether the server decides it itself, rejecting results
+// that do not match the lease
+func (l *Leases) leasedCandidate(client string, p primes.Prime) (*Lease, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats(client)
+	lease, ok := l.outstanding[p.Id]
+	var err error
+	switch {
+	case !ok:
+		err = fmt.Errorf("candidate %d is not outstanding", p.Id)
+	case !lease.isSingle():
+		err = fmt.Errorf("candidate %d is a work unit", p.Id)
+	case p.Value == nil || p.Value.Cmp(lease.Start) != 0:
+		err = fmt.Errorf("candidate %d is %s, not %s", p.Id, lease.Start, p.Value)
+	}
+	if err != nil {
+		stats.Rejected++
+		return nil, false, err
+	}
+	return lease, l.recheck || stats.throttled() || rand.Float64() < l.doubleCheck, nil
+}
+
+// Settle records a result verified by Check and returns, in order, every
+// result no longer held back by an outstanding candidate. It is rejected if
+// another client returned the candidate in the meantime.
+func (l *Leases) Settle(checked Checked) ([]primes.Prime, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats(checked.client)
+	if _, ok := l.outstanding[checked.seq]; !ok {
+		stats.Rejected++
+		return nil, fmt.Errorf("candidate %d is not outstanding", checked.seq)
+	}
+	if checked.verdicts != nil {
+		stats.confirm()
+	}
+	stats.Returned++
+	return l.release(checked.seq, checked.found), nil
+}
+
+// ReturnUnit checks and settles the primes client found in the work unit
+// r.Id, as CheckUnit and SettleUnit do.
+func (l *Leases) ReturnUnit(client string, r computation.UnitResult) ([]primes.Prime, error) {
+	checked, err := l.CheckUnit(client, r)
+	if err != nil {
+		return nil, err
+	}
+	return l.SettleUnit(checked)
+}
+
+// CheckUnit verifies the primes client found in the work unit r.Id, to be
+// settled by SettleUnit. Results for units that are not outstanding or do not
+// match their range are rejected, as are results listing a composite, after
+// which the unit is assigned again. As with Check, the primes are decided
+// without holding l.mu, along with those of the first result of a
+// double-checked unit when the server decides them itself.
+func (l *Leases) CheckUnit(client string, r computation.UnitResult) (Checked, error) {
+	lease, leased, found, recheck, err := l.leasedUnit(client, r)
+	if err != nil {
+		return Checked{}, err
+	}
+
+	checked := Checked{client: client, seq: r.Id, verdicts: make(map[string]bool), returned: time.Now()}
+	for _, p := range found {
+		checked.found = append(checked.found, primes.Prime{
+			Id:        r.Id,
+			Value:     p,
+			TimeTaken: r.TimeTaken / time.Duration(len(found)),
+			IsValid:   true,
+		})
+	}
+	if recheck {
+		if err := recheckPrimes(checked.found); err != nil {
+			l.refuteChecked(client, lease)
+			return Checked{}, err
+		}
+	} else if leased.FirstClient != "" {
+		decide(checked.verdicts, leased.FirstResult)
+		decide(checked.verdicts, checked.found)
+	}
+	return checked, nil
+}
+
+// leasedUnit() returns the lease of the work unit r.Id returned by client,
+// a copy of it as it stands, the primes found in it and whether they are
+// re-checked, rejecting results that do not match the lease
+func (l *Leases) leasedUnit(client string, r computation.UnitResult) (*Lease, Lease, []*big.Int, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats(client)
+	lease, ok := l.outstanding[r.Id]
+	var err error
+	switch {
+	case !ok:
+		err = fmt.Errorf("unit %d is not outstanding", r.Id)
+	case r.Start == nil || r.End == nil || r.Start.Cmp(lease.Start) != 0 || r.End.Cmp(lease.End) != 0:
+		err = fmt.Errorf("unit %d is %s to %s, not %s to %s", r.Id, lease.Start, lease.End, r.Start, r.End)
+	case lease.FirstClient == client:
+		err = fmt.Errorf("unit %d was already returned by %s", r.Id, client)
+	}
+	var found []*big.Int
+	if err == nil {
+		found, err = r.Found()
+	}
+	if err != nil {
+		stats.Rejected++
+		return nil, Lease{}, nil, false, err
+	}
+	return lease, *lease, found, l.recheck, nil
+}
+
+// SettleUnit records the primes verified by CheckUnit, updating the
+// throughput of the client, and returns them as Settle does. The first
+// result of a double-checked unit is held until a second client returns it
+// too, and where they differ the server decides the primes either left out,
+// or until a lease timeout passes without one.
+func (l *Leases) SettleUnit(checked Checked) ([]primes.Prime, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	client := checked.client
+	stats := l.stats(client)
+	lease, ok := l.outstanding[checked.seq]
+	if !ok {
+		stats.Rejected++
+		return nil, fmt.Errorf("unit %d is not outstanding", checked.seq)
+	}
+	if lease.FirstClient == client {
+		stats.Rejected++
+		return nil, fmt.Errorf("unit %d was already returned by %s", checked.seq, client)
+	}
+
+	unit := computation.WorkUnit{Id: checked.seq, Start: lease.Start, End: lease.End}
+	if elapsed := checked.returned.Sub(lease.Assigned).Seconds(); elapsed > 0 {
+		rate := float64(unit.Candidates()) / elapsed
+		if stats.Throughput > 0 {
+			rate = (stats.Throughput + rate) / 2
+		}
+		stats.Throughput = rate
+	}
+	stats.Returned++
+
+	results := checked.found
+	switch {
+	case lease.Copies > 1 && lease.FirstClient == "":
+		lease.FirstClient, lease.FirstResult = client, results
+		lease.Client, lease.Assigned, lease.Deadline = "", time.Now(), time.Time{}
+		return l.acceptUnchecked(), nil
+	case lease.Copies > 1:
+		results = l.settle(lease, client, results, checked.verdicts)
+	case l.recheck:
+		stats.confirm()
+	}
+	return append(l.acceptUnchecked(), l.release(checked.seq, results)...), nil
+}
+
+// acceptUnchecked() releases the first result of every double-checked unit
+// that no second client has returned within a lease timeout of the first,
+// as happens when a client works alone, rather than hold up the archive. The
+// caller must hold l.mu.
+func (l *Leases) acceptUnchecked() []primes.Prime {
+	now := time.Now()
+	var released []primes.Prime
+	for seq, lease := range l.outstanding {
+		if lease.FirstClient != "" && now.After(lease.Deadline) && now.Sub(lease.Assigned) > l.timeout {
+			config.Logger.Warn("Accepting a unit unchecked, as no other client checked it", "unit", seq, "client", lease.FirstClient)
+			released = append(released, l.release(seq, lease.FirstResult)...)
+		}
+	}
+	return released
+}
+
+// recheckPrimes() returns an error for the first composite among primes
+// found by a client
+func recheckPrimes(found []primes.Prime) error {
+	for _, p := range found {
+		if !primes.CheckPrimality(p.Value) {
+			return fmt.Errorf("%s is not prime", p.Value)
+		}
+	}
+	return nil
+}
+
+// decide() records in verdicts the primality of each of found not already
+// decided
+func decide(verdicts map[string]bool, found []primes.Prime) {
+	for _, p := range found {
+		if _, ok := verdicts[p.Value.String()]; !ok {
+			verdicts[p.Value.String()] = primes.CheckPrimality(p.Value)
+		}
+	}
+}
+
+// refute() rejects a wrong result of the client with stats for lease,
+// leaving the lease to be assigned again at once. The caller must hold l.mu.
+func (l *Leases) refute(stats *ClientStats, lease *Lease) {
+	stats.refute()
+	lease.Client, lease.Deadline = "", time.Time{}
+}
+
+// refuteChecked() refutes a wrong result of client for lease found while
+// l.mu was not held, leaving the lease alone if it was returned meanwhile
+func (l *Leases) refuteChecked(client string, lease *Lease) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.outstanding[lease.Seq] == lease {
+		l.refute(l.stats(client), lease)
+	} else {
+		l.stats(client).refute()
+	}
+}
+
+// settle() compares the second result of a double-checked unit with the
+// first, returning the primes either client found, which verdicts holds to
+// be prime unless they were already re-checked, and crediting or debiting
+// each client by whether it found exactly those. A first result returned
+// while the second was being checked is not in verdicts, and is decided
+// here. The caller must hold l.mu.
+func (l *Leases) settle(lease *Lease, second string, results []primes.Prime, verdicts map[string]bool) []primes.Prime {
+	if !l.recheck {
+		decide(verdicts, lease.FirstResult)
+	}
+	seen := make(map[string]bool)
+	var union []primes.Prime
+	for _, p := range append(append([]primes.Prime(nil), lease.FirstResult...), results...) {
+		key := p.Value.String()
+		if seen[key] || (!l.recheck && !verdicts[key]) {
+			seen[key] = true
+			continue
+		}
+		seen[key] = true
+		union = append(union, p)
+	}
+	sort.Slice(union, func(i, j int) bool { return union[i].Value.Cmp(union[j].Value) < 0 })
+
+	for client, found := range map[string][]primes.Prime{lease.FirstClient: lease.FirstResult, second: results} {
+		if samePrimes(found, union) {
+			l.stats(client).confirm()
+		} else {
+			config.Logger.Warn("Client disagreed on a unit", "client", client, "unit", lease.Seq, "start", lease.Start, "end", lease.End)
+			l.stats(client).refute()
+		}
+	}
+	return union
+}
+
+// samePrimes() reports whether a and b hold the same primes in the same order
+func samePrimes(a []primes.Prime, b []primes.Prime) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Value.Cmp(b[i].Value) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// OutstandingByClient returns the number of leases each client holds and
+// has not yet returned
+func (l *Leases) OutstandingByClient() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	held := make(map[string]int)
+	for _, lease := range l.outstanding {
+		if lease.Client != "" {
+			held[lease.Client]++
+		}
+	}
+	return held
+}
+
+// Outstanding returns the number of leases not yet returned
+func (l *Leases) Outstanding() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.outstanding)
+}
+
+// Frontier returns the number of leases whose results have been released
+func (l *Leases) Frontier() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.frontier
+}
@@ -1,180 +1,416 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/big"
-	"net"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/MaxTheMonster/PrimeNumberGenerator/auth"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/computation"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/metrics"
 	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
-	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
 
 	app "github.com/urfave/cli"
 )
 
 var lock sync.Mutex
 
-// receiveComputationHandler handles a computation being received via POST
-func receiveComputationHandler(w http.ResponseWriter, r *http.Request, computationsReceived chan computation.Computation) {
-	lock.Lock()
-	defer lock.Unlock()
+// maxRequestBody bounds the size of a request, which must be read in full
+// to check its signature
+const maxRequestBody = 64 << 20
+
+// authenticated checks the signature of every request, unless the client is
+// identified by its certificate, and refuses clients banned for wrong
+// results, before passing it on to a handler along with the name of the
+// client it comes from
+func authenticated(tokens *auth.Tokens, leases *Leases, handler func(w http.ResponseWriter, r *http.Request, client string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, ok := auth.CertificateIdentity(r)
+		var err error
+		if !ok {
+			client, err = tokens.Verify(r, maxRequestBody)
+		}
+		if err != nil {
+			config.Logger.Warn("Refused request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "err", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		leases.Seen(client)
+		if leases.Banned(client) {
+			writeError(w, http.StatusForbidden, client+" is banned for returning wrong results")
+			return
+		}
+		handler(w, r, client)
+	}
+}
+
+// errorBody is the JSON body of every error response.
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// writeError responds with status and a JSON body holding message
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Error: message})
+}
+
+// storeReleased buffers released primes on behalf of a handler. Primes that
+// cannot be stored stay buffered, and in the server state, to be stored with
+// the next buffer, so the client is not asked to send them again.
+func storeReleased(pending *pendingPrimes, released []primes.Prime) {
+	if err := pending.add(released); err != nil {
+		config.Logger.Error("Cannot store primes, keeping them buffered", "err", err)
+	}
+}
+
+// shutdownTimeout bounds how long the server waits for requests in progress
+// when it is stopped
+const shutdownTimeout = 10 * time.Second
+
+// receiveComputationHandler receives the result of a computation via POST,
+// buffering every prime no longer held back by an outstanding lease once
+// the computation decides its candidate, which is checked before taking
+// lock as receivePrimeHandler does
+func receiveComputationHandler(w http.ResponseWriter, r *http.Request, client string, heavy *Heavy, leases *Leases, pending *pendingPrimes) {
 	decoder := json.NewDecoder(r.Body)
 	var c computation.Computation
 	err := decoder.Decode(&c)
 	if err != nil {
-		config.Logger.Fatal(err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 	defer r.Body.Close()
-	computationsReceived <- c
+	decided, err := heavy.Decide(client, c)
+	var checked Checked
+	if err == nil && decided != nil {
+		checked, err = leases.Check(client, *decided)
+	}
+	var released []primes.Prime
+	if err == nil && decided != nil {
+		lock.Lock()
+		defer lock.Unlock()
+		released, err = leases.Settle(checked)
+	}
+	if err != nil {
+		config.Logger.Warn("Rejected computation", "client", client, "err", err)
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	config.Logger.Info("Received computation", "client", client, "computation", c.ComputationId, "candidate", c.Prime.Value)
+	storeReleased(pending, released)
 }
 
-// receiveComputationHandler handles a computation to assign
-func assignComputationHandler(w http.ResponseWriter, r *http.Request, c computation.Computation) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+// assignComputationHandler hands the next computation to the client asking
+// for it
+func assignComputationHandler(w http.ResponseWriter, r *http.Request, client string, heavy *Heavy) {
+	c, ok, err := heavy.Assign(client)
 	if err != nil {
-		fmt.Fprintf(w, "userip: %q is not IP:port", r.RemoteAddr)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "every candidate is waiting on computations")
+		return
 	}
 	json, err := json.Marshal(c)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	config.Logger.Printf("Sending %s to %s\n", string(json), ip)
+	config.Logger.Debug("Sending computation", "client", client, "computation", string(json))
 	fmt.Fprintf(w, "%s", json)
 }
 
-// receivePrimeHandler receives POST data from clients
-func receivePrimeHandler(w http.ResponseWriter, r *http.Request, primesReceived chan primes.Prime) {
-	lock.Lock()
-	defer lock.Unlock()
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+// receivePrimeHandler receives POST data from clients, buffering
+// every prime no longer held back by an outstanding lease. The result is
+// checked before taking lock, which is only held while it is settled.
+func receivePrimeHandler(w http.ResponseWriter, r *http.Request, client string, leases *Leases, pending *pendingPrimes) {
 	decoder := json.NewDecoder(r.Body)
 	var p primes.Prime
 	err := decoder.Decode(&p)
 	if err != nil {
-		config.Logger.Fatal(err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	config.Logger.Printf("Received %s as %v from %s", p.Value, p.IsValid, ip)
 	defer r.Body.Close()
-	primesReceived <- p
-}
-
-// assignPrimeHandler returns the next prime needed to be calculated
-func assignPrimeHandler(w http.ResponseWriter, r *http.Request, p primes.Prime) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	checked, err := leases.Check(client, p)
+	var released []primes.Prime
+	if err == nil {
+		lock.Lock()
+		defer lock.Unlock()
+		released, err = leases.Settle(checked)
+	}
 	if err != nil {
-		fmt.Fprintf(w, "userip: %q is not IP:port", r.RemoteAddr)
+		config.Logger.Warn("Rejected candidate", "client", client, "candidate", p.Value, "err", err)
+		writeError(w, http.StatusConflict, err.Error())
+		return
 	}
-	json, err := json.Marshal(p)
+	config.Logger.Info("Received candidate", "client", client, "candidate", p.Value, "prime", p.IsValid)
+	storeReleased(pending, released)
+}
+
+// assignPrimeHandler leases the next candidate needed to be calculated to
+// the client asking for it
+func assignPrimeHandler(w http.ResponseWriter, r *http.Request, client string, leases *Leases) {
+	lease := leases.Assign(client)
+	json, err := json.Marshal(primes.Prime{Id: lease.Seq, Value: lease.Start})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	config.Logger.Printf("Sending %s to %s\n", string(json), ip)
+	config.Logger.Debug("Leasing candidate", "client", client, "candidate", lease.Start, "deadline", lease.Deadline)
 	fmt.Fprintf(w, "%s", json)
 }
 
-// LaunchServer runs a server on the configured IP and port
-func LaunchServer(c *app.Context) {
-	go fmt.Printf("Launching server on port %s...\n", config.Port)
+// releasePrimeHandler takes back a candidate a client will not finish
+func releasePrimeHandler(w http.ResponseWriter, r *http.Request, client string, leases *Leases) {
+	var p primes.Prime
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+	if err := leases.Release(client, p.Id); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	config.Logger.Info("Released candidate", "client", client, "candidate", p.Value)
+}
+
+// releaseComputationHandler takes back a computation a client will not
+// finish
+func releaseComputationHandler(w http.ResponseWriter, r *http.Request, client string, heavy *Heavy) {
+	var c computation.Computation
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+	if err := heavy.Release(c); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	config.Logger.Info("Released computation", "client", client, "computation", c.ComputationId, "candidate", c.Prime.Value)
+}
+
+// receiveUnitHandler receives the primes found in a work unit, buffering
+// every prime no longer held back by an outstanding lease, checking them
+// before taking lock as receivePrimeHandler does
+func receiveUnitHandler(w http.ResponseWriter, r *http.Request, client string, leases *Leases, pending *pendingPrimes) {
+	decoder := json.NewDecoder(r.Body)
+	var result computation.UnitResult
+	err := decoder.Decode(&result)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+	checked, err := leases.CheckUnit(client, result)
+	var released []primes.Prime
+	if err == nil {
+		lock.Lock()
+		defer lock.Unlock()
+		released, err = leases.SettleUnit(checked)
+	}
+	if err != nil {
+		config.Logger.Warn("Rejected unit", "client", client, "unit", result.Id, "err", err)
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	config.Logger.Info("Received unit", "client", client, "unit", result.Id, "took", result.TimeTaken)
+	storeReleased(pending, released)
+}
 
-	numbersToCheck := make(chan *big.Int)
-	validPrimes := make(chan primes.Prime, 100)
-	invalidPrimes := make(chan primes.Prime, 100)
-	primesToBeSent := make(chan primes.Prime)
-	primesReceived := make(chan primes.Prime)
-	computationsToBeSent := make(chan computation.Computation)
-	computationsReceived := make(chan computation.Computation)
-	nOfComputationsForPrime := new(big.Int)
+// assignUnitHandler leases the next work unit, sized to the throughput of
+// the client asking for it
+func assignUnitHandler(w http.ResponseWriter, r *http.Request, client string, leases *Leases) {
+	lease := leases.AssignUnit(client)
+	json, err := json.Marshal(computation.WorkUnit{Id: lease.Seq, Start: lease.Start, End: lease.End})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	config.Logger.Info("Leasing unit", "client", client, "unit", lease.Seq, "start", lease.Start, "end", lease.End, "deadline", lease.Deadline)
+	fmt.Fprintf(w, "%s", json)
+}
 
-	var primeBuffer storage.BigIntSlice
+// handleStatus serves the metrics, the status and the dashboard on mux.
+// They are left unauthenticated, for scrapers and browsers that cannot sign
+// their requests, and so are best served apart from the client endpoints.
+func handleStatus(ctx context.Context, mux *http.ServeMux, leases *Leases, pending *pendingPrimes) {
+	mux.Handle(config.MetricsPoint, metrics.Handler())
+	mux.HandleFunc(config.StatusPoint, func(w http.ResponseWriter, r *http.Request) {
+		statusHandler(w, r, leases, pending)
+	})
+	mux.HandleFunc(config.StatusEventsPoint, func(w http.ResponseWriter, r *http.Request) {
+		statusEventsHandler(ctx, w, r, leases, pending)
+	})
+	mux.HandleFunc(config.DashboardPoint, dashboardHandler)
+}
 
+// serveStatus serves the pages of handleStatus on config.StatusAddr, over
+// plain HTTP and without client certificates, until ctx is cancelled. Like
+// metrics.Serve, it logs rather than stops the server if the address cannot
+// be listened on.
+func serveStatus(ctx context.Context, mux *http.ServeMux) {
+	s := &http.Server{Addr: config.StatusAddr, Handler: mux}
 	go func() {
-		for i := new(big.Int).Add(config.LastPrimeGenerated, big.NewInt(2)); true; i.Add(i, big.NewInt(2)) {
-			numberToTest := big.NewInt(0).Set(i)
-			numbersToCheck <- numberToTest
-		}
+		<-ctx.Done()
+		s.Close()
 	}()
+	config.Logger.Info("Serving the status", "addr", config.StatusAddr, "dashboard", config.DashboardPoint)
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		config.Logger.Error("Cannot serve the status", "err", err)
+	}
+}
 
-	go func() {
-		for i := range numbersToCheck {
-			currentSolvingPrime := primes.Prime{
-				TimeTaken: 0 * time.Second,
-				Value:     i,
-				IsValid:   false,
-			}
-			currentComputationsToPerform := computation.GetComputationsToPerform(currentSolvingPrime)
-			nOfComputationsForPrime = new(big.Int).Sub(big.NewInt(int64(len(currentComputationsToPerform))), big.NewInt(1))
-			for _, c := range currentComputationsToPerform {
-				computationsToBeSent <- c
-			}
-		}
-	}()
+// LaunchServer runs a server on the configured IP and port until ctx is
+// cancelled, then waits for the requests in progress, stores the buffered
+// primes and saves the server state. It returns an error if the server
+// cannot be started, or the primes stored and the state saved.
+func LaunchServer(ctx context.Context, c *app.Context) error {
+	config.Logger.Info("Launching server", "port", config.Port, "tls", config.TLSCert != "")
 
-	go func() {
-		for c := range computationsReceived {
-			if c.IsValid {
-				invalidPrimes <- c.Prime
-			} else if nOfComputationsForPrime.Cmp(c.ComputationId) == 0 {
-				validPrimes <- c.Prime
-			}
+	state := loadServerState()
+	first := new(big.Int).Add(config.LastPrimeGenerated, big.NewInt(1))
+	first.SetBit(first, 0, 1)
+	leases, released := RestoreLeases(state.Leases, first, config.LeaseTimeout)
+	leases.SetVerification(config.Recheck, config.DoubleCheck)
+	heavy := NewHeavy(leases, HeavyRangeDivisors)
+	pending := &pendingPrimes{}
+	for _, p := range state.Buffer {
+		if p.Cmp(first) >= 0 {
+			pending.buffer = append(pending.buffer, p)
 		}
-	}()
+	}
+	storeReleased(pending, released)
 
+	save := func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		return saveServerState(leases, pending)
+	}
 	go func() {
-		for p := range validPrimes {
-			primes.DisplayPrimePretty(p.Value, p.TimeTaken)
-			primeBuffer = append(primeBuffer, p.Value)
-			if len(primeBuffer) == config.MaxBufferSize {
-				storage.FlushBufferToFile(primeBuffer)
-				primeBuffer = nil
+		ticker := time.NewTicker(stateSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := save(); err != nil {
+					config.Logger.Error("Cannot save the server state", "err", err)
+				}
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 
-	go func() {
-		for i := range numbersToCheck {
-			primeToCheck := primes.Prime{
-				TimeTaken: 0 * time.Second,
-				Value:     i,
-				IsValid:   false,
-			}
-			primesToBeSent <- primeToCheck
+	tokens := auth.NewTokens()
+	if tokens.Count() == 0 && config.TLSCA == "" {
+		config.Logger.Warn("No client tokens exist yet, so every client will be refused. Create one with `server token create`.")
+	}
+
+	metrics.NewGaugeFunc("primegenerator_outstanding_leases", "Leases handed to a client and not yet returned.", "client", func() []metrics.Sample {
+		var samples []metrics.Sample
+		for client, held := range leases.OutstandingByClient() {
+			samples = append(samples, metrics.Sample{Label: client, Value: float64(held)})
 		}
-	}()
+		return samples
+	})
+	metrics.NewGaugeFunc("primegenerator_buffered_primes", "Primes received and waiting to be stored.", "", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(len(pending.primes()))}}
+	})
 
-	go func() {
-		for p := range primesReceived {
-			if p.IsValid {
-				validPrimes <- p
-			} else {
-				invalidPrimes <- p
-			}
+	mux := http.NewServeMux()
+	if config.StatusAddr != "" {
+		status := http.NewServeMux()
+		handleStatus(ctx, status, leases, pending)
+		go serveStatus(ctx, status)
+	} else {
+		handleStatus(ctx, mux, leases, pending)
+		if config.TLSCA != "" {
+			config.Logger.Warn("The dashboard, status and metrics are only served to clients with a certificate. Serve them to browsers with --status-addr.")
 		}
-	}()
+	}
+	mux.HandleFunc(config.HeavyAssignmentPoint, authenticated(tokens, leases, func(w http.ResponseWriter, r *http.Request, client string) {
+		assignComputationHandler(w, r, client, heavy)
+	}))
 
-	http.HandleFunc(config.HeavyAssignmentPoint, func(w http.ResponseWriter, r *http.Request) {
-		c := <-computationsToBeSent
-		assignComputationHandler(w, r, c)
-	})
+	mux.HandleFunc(config.HeavyReturnPoint, authenticated(tokens, leases, func(w http.ResponseWriter, r *http.Request, client string) {
+		receiveComputationHandler(w, r, client, heavy, leases, pending)
+	}))
 
-	http.HandleFunc(config.HeavyReturnPoint, func(w http.ResponseWriter, r *http.Request) {
-		receiveComputationHandler(w, r, computationsReceived)
-	})
+	mux.HandleFunc(config.AssignmentPoint, authenticated(tokens, leases, func(w http.ResponseWriter, r *http.Request, client string) {
+		assignPrimeHandler(w, r, client, leases)
+	}))
 
-	http.HandleFunc(config.AssignmentPoint, func(w http.ResponseWriter, r *http.Request) {
-		p := <-primesToBeSent
-		assignPrimeHandler(w, r, p)
-	})
+	mux.HandleFunc(config.ReturnPoint, authenticated(tokens, leases, func(w http.ResponseWriter, r *http.Request, client string) {
+		receivePrimeHandler(w, r, client, leases, pending)
+	}))
 
-	http.HandleFunc(config.ReturnPoint, func(w http.ResponseWriter, r *http.Request) {
-		receivePrimeHandler(w, r, primesReceived)
-	})
+	mux.HandleFunc(config.UnitAssignmentPoint, authenticated(tokens, leases, func(w http.ResponseWriter, r *http.Request, client string) {
+		assignUnitHandler(w, r, client, leases)
+	}))
+
+	mux.HandleFunc(config.UnitReturnPoint, authenticated(tokens, leases, func(w http.ResponseWriter, r *http.Request, client string) {
+		receiveUnitHandler(w, r, client, leases, pending)
+	}))
+
+	mux.HandleFunc(config.ReleasePoint, authenticated(tokens, leases, func(w http.ResponseWriter, r *http.Request, client string) {
+		releasePrimeHandler(w, r, client, leases)
+	}))
 
-	http.ListenAndServe(":"+config.Port, nil)
+	mux.HandleFunc(config.HeavyReleasePoint, authenticated(tokens, leases, func(w http.ResponseWriter, r *http.Request, client string) {
+		releaseComputationHandler(w, r, client, heavy)
+	}))
+
+	httpServer := &http.Server{Addr: ":" + config.Port, Handler: mux}
+	if config.TLSCert != "" {
+		tlsConfig, err := auth.ServerTLSConfig(config.TLSCA)
+		if err != nil {
+			return fmt.Errorf("cannot set up TLS: %v", err)
+		}
+		httpServer.TLSConfig = tlsConfig
+	}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdown); err != nil {
+			config.Logger.Error("Cannot stop the server cleanly", "err", err)
+		}
+	}()
+	var err error
+	if config.TLSCert != "" {
+		err = httpServer.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		// The state is saved all the same, for whatever was received.
+		if err := save(); err != nil {
+			config.Logger.Error("Cannot save the server state", "err", err)
+		}
+		return fmt.Errorf("cannot serve: %v", err)
+	}
+
+	lock.Lock()
+	flushErr := pending.flush()
+	lock.Unlock()
+	if err := save(); err != nil {
+		return fmt.Errorf("cannot save the server state: %v", err)
+	}
+	config.Logger.Info("Saved the outstanding leases for the next run", "leases", leases.Outstanding())
+	if flushErr != nil {
+		return fmt.Errorf("cannot store the last primes received, which are kept in the server state: %v", flushErr)
+	}
+	return nil
 }
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/metrics"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+// stateSaveInterval is how often the server state is saved while running
+const stateSaveInterval = 10 * time.Second
+
+// LeasesState is the part of Leases kept in the server state file.
+type LeasesState struct {
+	Next        *big.Int
+	NextSeq     uint64
+	Frontier    uint64
+	Outstanding []Lease
+	Decided     map[uint64][]primes.Prime
+	Clients     map[string]ClientStats
+}
+
+// serverState is everything the server needs to carry on after a restart.
+type serverState struct {
+	Saved  time.Time
+	Leases LeasesState
+	Buffer storage.BigIntSlice
+}
+
+// State returns a copy of the leases and results held by l
+func (l *Leases) State() LeasesState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state := LeasesState{
+		Next:     new(big.Int).Set(l.next),
+		NextSeq:  l.nextSeq,
+		Frontier: l.frontier,
+		Decided:  make(map[uint64][]primes.Prime),
+		Clients:  make(map[string]ClientStats),
+	}
+	for _, lease := range l.outstanding {
+		state.Outstanding = append(state.Outstanding, *lease)
+	}
+	sort.Slice(state.Outstanding, func(i, j int) bool { return state.Outstanding[i].Seq < state.Outstanding[j].Seq })
+	for seq, found := range l.decided {
+		state.Decided[seq] = append([]primes.Prime(nil), found...)
+	}
+	for client, stats := range l.clients {
+		state.Clients[client] = *stats
+	}
+	return state
+}
+
+// RestoreLeases returns Leases carrying on from a saved state, for an
+// archive whose next odd candidate is first. The state may be older than the
+// archive, so leases below first, which were already returned, are dropped,
+// and results no longer held back by them are returned to be stored.
+// Outstanding leases get a fresh deadline, as the time the server was down
+// is no fault of their clients, except those held by Heavy, which lost its
+// progress on them, and those held by no client, which must be leased again.
+func RestoreLeases(state LeasesState, first *big.Int, timeout time.Duration) (*Leases, []primes.Prime) {
+	l := NewLeases(first, timeout)
+	if state.Next != nil && state.Next.Cmp(first) > 0 {
+		l.next.Set(state.Next)
+	}
+	l.nextSeq, l.frontier = state.NextSeq, state.Frontier
+	for client, stats := range state.Clients {
+		stats := stats
+		l.clients[client] = &stats
+	}
+
+	now := time.Now()
+	for _, lease := range state.Outstanding {
+		if lease.Start == nil || lease.Start.Cmp(first) < 0 {
+			continue
+		}
+		lease := lease
+		lease.Deadline = now.Add(timeout)
+		if lease.Client == heavyClient || lease.Client == "" {
+			lease.Deadline = time.Time{}
+		}
+		l.outstanding[lease.Seq] = &lease
+	}
+	for seq, found := range state.Decided {
+		l.decided[seq] = aboveArchive(found, first)
+	}
+
+	var released []primes.Prime
+	for l.frontier < l.nextSeq {
+		if _, ok := l.outstanding[l.frontier]; ok {
+			break
+		}
+		released = append(released, l.decided[l.frontier]...)
+		delete(l.decided, l.frontier)
+		l.frontier++
+	}
+	return l, released
+}
+
+// aboveArchive() drops the primes below first, which are already stored
+func aboveArchive(found []primes.Prime, first *big.Int) []primes.Prime {
+	var kept []primes.Prime
+	for _, p := range found {
+		if p.Value != nil && p.Value.Cmp(first) >= 0 {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// flushHistory is the number of recent flushes the status page shows.
+const flushHistory = 20
+
+// Flush is a buffer of primes stored by the server.
+type Flush struct {
+	Time     time.Time
+	Primes   int
+	Largest  *big.Int
+	Duration time.Duration
+}
+
+// pendingPrimes holds released primes until there are enough to store.
+type pendingPrimes struct {
+	mu      sync.Mutex
+	buffer  storage.BigIntSlice
+	flushes []Flush
+}
+
+// store() stores the buffer and records the flush, leaving the buffer as
+// it is if it cannot be stored. The caller must hold b.mu.
+func (b *pendingPrimes) store() error {
+	start := time.Now()
+	if err := storage.AppendPrimes(b.buffer, nil); err != nil {
+		return err
+	}
+	b.flushes = append(b.flushes, Flush{
+		Time:     start,
+		Primes:   len(b.buffer),
+		Largest:  b.buffer[len(b.buffer)-1],
+		Duration: time.Since(start),
+	})
+	if len(b.flushes) > flushHistory {
+		b.flushes = b.flushes[len(b.flushes)-flushHistory:]
+	}
+	b.buffer = nil
+	return nil
+}
+
+// add() displays and buffers the primes among released results, storing
+// the buffer whenever it fills up. Every prime is buffered even if the
+// buffer cannot be stored, which is then tried again with the next prime.
+func (b *pendingPrimes) add(released []primes.Prime) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for _, p := range released {
+		if !p.IsValid {
+			continue
+		}
+		metrics.PrimesFound.Add(1)
+		metrics.TestDuration.Observe(p.TimeTaken)
+		primes.DisplayPrimePretty(p.Value, p.TimeTaken)
+		b.buffer = append(b.buffer, p.Value)
+		if len(b.buffer) >= config.MaxBufferSize {
+			err = b.store()
+		}
+	}
+	return err
+}
+
+// flush() stores the buffered primes, however few
+func (b *pendingPrimes) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.buffer) > 0 {
+		config.Logger.Info("Storing the last primes received", "primes", len(b.buffer))
+		return b.store()
+	}
+	return nil
+}
+
+// primes() returns a copy of the buffered primes
+func (b *pendingPrimes) primes() storage.BigIntSlice {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append(storage.BigIntSlice(nil), b.buffer...)
+}
+
+// recentFlushes() returns the most recent flushes, oldest first
+func (b *pendingPrimes) recentFlushes() []Flush {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Flush(nil), b.flushes...)
+}
+
+// loadServerState() reads the state saved by a previous run of the server.
+// A missing or unreadable state file leaves the server to start afresh from
+// the archive, which loses nothing but recomputation.
+func loadServerState() serverState {
+	var state serverState
+	contents, err := ioutil.ReadFile(config.ServerState)
+	if os.IsNotExist(err) {
+		return state
+	}
+	if err == nil {
+		err = json.Unmarshal(contents, &state)
+	}
+	if err != nil {
+		config.Logger.Warn("Ignoring the saved server state", "err", err)
+		return serverState{}
+	}
+	config.Logger.Info("Restoring the server state", "saved", state.Saved)
+	return state
+}
+
+// saveServerState() writes the leases and buffered primes to the state
+// file. The caller must hold lock, so that no results are released while
+// they are read.
+func saveServerState(leases *Leases, pending *pendingPrimes) error {
+	contents, err := json.Marshal(serverState{
+		Saved:  time.Now(),
+		Leases: leases.State(),
+		Buffer: pending.primes(),
+	})
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomically(config.ServerState, contents)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+// statusInterval is how often the status page is sent a new status.
+const statusInterval = 2 * time.Second
+
+// Status is the progress of the server, served as JSON at /status.
+type Status struct {
+	Time time.Time
+	// Frontier is the candidate below which every result has been
+	// released to be stored.
+	Frontier     *big.Int
+	LargestPrime *big.Int
+	// Count is the exact number of primes found, stored or buffered.
+	Count       uint64
+	Buffered    int
+	Clients     []ClientStatus
+	Outstanding []Lease
+	Flushes     []Flush
+}
+
+// ClientStatus is the accounting of one client, with the number of leases
+// it holds.
+type ClientStatus struct {
+	Name string
+	ClientStats
+	Outstanding int
+	Banned      bool
+}
+
+// currentStatus() returns the status of the server. It takes lock, so that
+// no primes are released or stored while it is read.
+func currentStatus(leases *Leases, pending *pendingPrimes) (Status, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	largest, err := storage.GetLargestPrime()
+	if err != nil {
+		return Status{}, err
+	}
+	count, err := storage.GetPrimeCount()
+	if err != nil {
+		return Status{}, err
+	}
+	state := leases.State()
+	buffered := pending.primes()
+	status := Status{
+		Time:         time.Now(),
+		Frontier:     state.Next,
+		LargestPrime: largest,
+		Count:        count + uint64(len(buffered)),
+		Buffered:     len(buffered),
+		Flushes:      pending.recentFlushes(),
+	}
+	if len(buffered) > 0 {
+		status.LargestPrime = buffered[len(buffered)-1]
+	}
+
+	held := make(map[string]int)
+	for i, lease := range state.Outstanding {
+		if i == 0 {
+			status.Frontier = lease.Start
+		}
+		held[lease.Client]++
+		lease.FirstResult = nil
+		status.Outstanding = append(status.Outstanding, lease)
+	}
+	for name, stats := range state.Clients {
+		status.Clients = append(status.Clients, ClientStatus{
+			Name:        name,
+			ClientStats: stats,
+			Outstanding: held[name],
+			Banned:      stats.Reputation <= banReputation,
+		})
+	}
+	sort.Slice(status.Clients, func(i, j int) bool { return status.Clients[i].Name < status.Clients[j].Name })
+	return status, nil
+}
+
+// statusHandler serves the status of the server as JSON
+func statusHandler(w http.ResponseWriter, r *http.Request, leases *Leases, pending *pendingPrimes) {
+	status, err := currentStatus(leases, pending)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json, err := json.Marshal(status)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// statusEventsHandler sends the status of the server as a server-sent event
+// every statusInterval, until the client goes away or ctx is cancelled
+func statusEventsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, leases *Leases, pending *pendingPrimes) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		status, err := currentStatus(leases, pending)
+		if err != nil {
+			config.Logger.Error("Cannot read the status", "err", err)
+			return
+		}
+		json, err := json.Marshal(status)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", json)
+		flusher.Flush()
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dashboardHandler serves the status page
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, strings.Replace(dashboardPage, "{{events}}", config.StatusEventsPoint, -1))
+}
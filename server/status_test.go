@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/primes"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/storage"
+)
+
+// serveTestStatus serves the status of an archive holding the primes up to
+// 7, with 11 leased to a and 13 returned by b, until the test ends or
+// stop is called
+func serveTestStatus(t *testing.T) (server *httptest.Server, stop func()) {
+	base, directory, journal, index, id := config.Base, config.Directory, config.Journal, config.Index, config.Id
+	format, maxFilesize := config.Format, config.MaxFilesize
+	t.Cleanup(func() {
+		config.Base, config.Directory, config.Journal, config.Index, config.Id = base, directory, journal, index, id
+		config.Format, config.MaxFilesize = format, maxFilesize
+		storage.NewFileStore()
+	})
+	config.Base = t.TempDir() + "/"
+	config.Directory = config.Base + "directory.txt"
+	config.Journal = config.Base + "journal.txt"
+	config.Index = config.Base + "index.json"
+	config.Format, config.MaxFilesize = "text", 1000
+	storage.NewFileStore()
+	if err := storage.AppendPrimes(storage.BigIntSlice{big.NewInt(2), big.NewInt(3), big.NewInt(5), big.NewInt(7)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	leases := NewLeases(big.NewInt(11), time.Minute)
+	leases.Assign("a")
+	thirteen := leases.Assign("b")
+	if _, err := leases.Return("b", primes.Prime{Id: thirteen.Seq, Value: thirteen.Start, IsValid: true}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	handleStatus(ctx, mux, leases, &pendingPrimes{})
+	server = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+	})
+	return server, cancel
+}
+
+// checkStatus fails the test unless status is that of serveTestStatus
+func checkStatus(t *testing.T, status Status) {
+	t.Helper()
+	if status.Count != 4 || status.LargestPrime.Int64() != 7 || status.Frontier.Int64() != 11 {
+		t.Errorf("Status counts %d primes up to %s with the frontier at %s; want 4 up to 7 and 11", status.Count, status.LargestPrime, status.Frontier)
+	}
+	if len(status.Outstanding) != 1 || status.Outstanding[0].Client != "a" {
+		t.Errorf("Status lists the outstanding leases %+v; want 11 leased to a", status.Outstanding)
+	}
+	if len(status.Clients) != 2 || status.Clients[0].Name != "a" || status.Clients[0].Outstanding != 1 || status.Clients[1].Name != "b" || status.Clients[1].Returned != 1 {
+		t.Errorf("Status lists the clients %+v; want a holding 11 and b having returned 13", status.Clients)
+	}
+}
+
+func TestStatusJSON(t *testing.T) {
+	server, _ := serveTestStatus(t)
+	resp, err := http.Get(server.URL + config.StatusPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("GET %s answered %s with %q", config.StatusPoint, resp.Status, resp.Header.Get("Content-Type"))
+	}
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, status)
+}
+
+func TestStatusEvents(t *testing.T) {
+	server, stop := serveTestStatus(t)
+	resp, err := http.Get(server.URL + config.StatusEventsPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET %s answered %q; want an event stream", config.StatusEventsPoint, resp.Header.Get("Content-Type"))
+	}
+
+	events := bufio.NewReader(resp.Body)
+	line, err := events.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("The stream began with %q, %v; want a status event", line, err)
+	}
+	var status Status
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &status); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, status)
+
+	// Stopping the server ends the stream rather than leaving it open.
+	stop()
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, events)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Errorf("The stream ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The stream stayed open after the server stopped")
+	}
+}
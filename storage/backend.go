@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+// Backend is the on-disk format of a storage file. The files listed in the
+// directory may be in any backend; new files are written in the one
+// selected by the format: configuration key.
+type Backend interface {
+	// Name is the value of the format: key that selects the backend.
+	Name() string
+	// Extension is appended to a file's name to give its path.
+	Extension() string
+	// Encode returns the bytes appending a sorted chunk of primes to the
+	// file described by entry, and the bytes to append to its block index,
+	// if the backend keeps one. Every prime must be larger than the one
+	// before it.
+	Encode(entry FileIndex, chunk BigIntSlice) ([]byte, []byte, error)
+	// Decode streams each prime read from r to fn, and reports whether fn
+	// accepted every prime.
+	Decode(r io.Reader, fn func(*big.Int) bool) (bool, error)
+	// Inspect streams each prime read from r to fn like Decode, but carries
+	// on past damaged data where it can, describing each damaged part to
+	// damaged.
+	Inspect(r io.Reader, fn func(*big.Int), damaged func(description string)) error
+	// Nth returns the k-th prime of the file, counting from 0.
+	Nth(entry FileIndex, k uint64) (*big.Int, error)
+	// CountNotExceeding returns the number of primes in the file that do
+	// not exceed x.
+	CountNotExceeding(entry FileIndex, x *big.Int) (uint64, error)
+}
+
+var backends = []Backend{textBackend{}, deltaBackend{}}
+
+// GetBackend returns the backend selected by name
+func GetBackend(name string) (Backend, error) {
+	for _, backend := range backends {
+		if backend.Name() == name {
+			return backend, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown storage format %q", name)
+}
+
+// getConfiguredBackend() returns the backend new files are written in.
+// flushToFiles() refuses an unknown format before writing anything, so one
+// only reaches here to look up files that exist already, which are looked
+// for in every backend anyway.
+func getConfiguredBackend() Backend {
+	backend, err := GetBackend(config.Format)
+	if err != nil {
+		return backends[0]
+	}
+	return backend
+}
+
+// getFileBackend() returns the backend the named file is stored in, which
+// is the configured one for files that do not exist yet
+func getFileBackend(filename string) Backend {
+	if compression := getCompression(filename); compression != CompressionNone {
+		inner := strings.TrimSuffix(filename, compressionExtensions[compression])
+		for _, backend := range backends {
+			if strings.HasSuffix(inner, backend.Extension()) {
+				return backend
+			}
+		}
+	}
+	configured := getConfiguredBackend()
+	if _, err := os.Stat(config.Base + filename + configured.Extension()); err == nil {
+		return configured
+	}
+	for _, backend := range backends {
+		if _, err := os.Stat(config.Base + filename + backend.Extension()); err == nil {
+			return backend
+		}
+	}
+	return configured
+}
+
+// formatBlockIndexPath() formats inputted filename to create the path of
+// the sidecar file holding its block index, for backends that keep one
+func formatBlockIndexPath(filename string) string {
+	return config.Base + baseFileName(filename) + ".blocks"
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// primesBucket maps each position to the prime stored there.
+	primesBucket = []byte("primes")
+	// valuesBucket maps each prime, as a key that sorts in numeric order,
+	// back to its position.
+	valuesBucket = []byte("values")
+	// certificatesBucket maps the position of each proven prime to its
+	// certificate.
+	certificatesBucket = []byte("certificates")
+)
+
+// boltStore keeps the archive in a single bbolt database, so that it can be
+// queried by value and by position without scanning any files.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the bbolt database at path, creating it if needed
+func OpenBoltStore(path string) (Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{primesBucket, valuesBucket, certificatesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+// Close releases the database
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// positionKey() encodes a position so that keys sort in position order
+func positionKey(position uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, position)
+	return key
+}
+
+// valueKey() encodes a prime so that keys sort in numeric order: by length
+// first, then by the bytes themselves
+func valueKey(p *big.Int) []byte {
+	bytes := p.Bytes()
+	key := make([]byte, 2, 2+len(bytes))
+	binary.BigEndian.PutUint16(key, uint16(len(bytes)))
+	return append(key, bytes...)
+}
+
+// countStored() returns the number of primes in the primes bucket
+func countStored(tx *bolt.Tx) uint64 {
+	last, _ := tx.Bucket(primesBucket).Cursor().Last()
+	if last == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(last) + 1
+}
+
+func (s *boltStore) Append(buffer BigIntSlice, certificates map[string][]byte) error {
+	sort.Sort(buffer)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		primes, values := tx.Bucket(primesBucket), tx.Bucket(valuesBucket)
+		proofs := tx.Bucket(certificatesBucket)
+		var last *big.Int
+		if _, value := primes.Cursor().Last(); value != nil {
+			last = new(big.Int).SetBytes(value)
+		}
+		if err := checkIncreasing(buffer, last); err != nil {
+			return err
+		}
+		position := countStored(tx)
+		for _, prime := range buffer {
+			key := positionKey(position)
+			if err := primes.Put(key, prime.Bytes()); err != nil {
+				return err
+			}
+			if err := values.Put(valueKey(prime), key); err != nil {
+				return err
+			}
+			if certificate, ok := certificates[prime.String()]; ok {
+				if err := proofs.Put(key, certificate); err != nil {
+					return err
+				}
+			}
+			position++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&config.Id, uint64(len(buffer)))
+	return nil
+}
+
+func (s *boltStore) Last() (*big.Int, error) {
+	var largest *big.Int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if _, value := tx.Bucket(primesBucket).Cursor().Last(); value != nil {
+			largest = new(big.Int).SetBytes(value)
+		}
+		return nil
+	})
+	return largest, err
+}
+
+func (s *boltStore) Count() (uint64, error) {
+	var count uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = countStored(tx)
+		return nil
+	})
+	return count, err
+}
+
+func (s *boltStore) Nth(k uint64) (*big.Int, bool, error) {
+	var found *big.Int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(primesBucket).Get(positionKey(k)); value != nil {
+			found = new(big.Int).SetBytes(value)
+		}
+		return nil
+	})
+	return found, found != nil, err
+}
+
+func (s *boltStore) CountNotExceeding(x *big.Int) (uint64, error) {
+	var count uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if x.Sign() < 0 {
+			return nil
+		}
+		key, position := tx.Bucket(valuesBucket).Cursor().Seek(valueKey(x))
+		switch {
+		case key == nil:
+			count = countStored(tx)
+		case new(big.Int).SetBytes(key[2:]).Cmp(x) == 0:
+			count = binary.BigEndian.Uint64(position) + 1
+		default:
+			count = binary.BigEndian.Uint64(position)
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (s *boltStore) Range(from *big.Int, to *big.Int, fn func(position uint64, p *big.Int) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		start := from
+		if start.Sign() < 0 {
+			start = new(big.Int)
+		}
+		cursor := tx.Bucket(valuesBucket).Cursor()
+		for key, position := cursor.Seek(valueKey(start)); key != nil; key, position = cursor.Next() {
+			p := new(big.Int).SetBytes(key[2:])
+			if (to != nil && p.Cmp(to) > 0) || !fn(binary.BigEndian.Uint64(position), p) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) WalkCertificates(fn func(p *big.Int, certificate []byte) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		proofs := tx.Bucket(certificatesBucket)
+		cursor := tx.Bucket(primesBucket).Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			var certificate []byte
+			if stored := proofs.Get(key); stored != nil {
+				certificate = append([]byte(nil), stored...)
+			}
+			if !fn(new(big.Int).SetBytes(value), certificate) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// CompressionNone leaves sealed files as they were written.
+	CompressionNone = "none"
+	// CompressionGzip compresses sealed files with gzip.
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses sealed files with zstd.
+	CompressionZstd = "zstd"
+)
+
+// compressionExtensions maps each compression to the extension appended to
+// the full name of a file compressed with it.
+var compressionExtensions = map[string]string{
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+var (
+	// sealedFiles queues the names of files that have just filled up for the
+	// compressor, and is guarded by mu.
+	sealedFiles []string
+	// sealedReady wakes the compressor when files are queued, and is nil
+	// while no compressor is running.
+	sealedReady chan struct{}
+)
+
+// getCompression() returns the compression of the named file, which the
+// directory lists under its full compressed name, or CompressionNone
+func getCompression(filename string) string {
+	for compression, extension := range compressionExtensions {
+		if strings.HasSuffix(filename, extension) {
+			return compression
+		}
+	}
+	return CompressionNone
+}
+
+// baseFileName() strips the backend and compression extensions from a name
+// in the directory, leaving the name sidecar files are kept under
+func baseFileName(filename string) string {
+	compression := getCompression(filename)
+	if compression == CompressionNone {
+		return filename
+	}
+	filename = strings.TrimSuffix(filename, compressionExtensions[compression])
+	for _, backend := range backends {
+		filename = strings.TrimSuffix(filename, backend.Extension())
+	}
+	return filename
+}
+
+// IsValidCompression reports whether name selects a compression
+func IsValidCompression(name string) bool {
+	_, ok := compressionExtensions[name]
+	return ok || name == CompressionNone
+}
+
+// decompress() wraps the raw contents of the named storage file in a
+// decompressor, if it is compressed
+func decompress(filename string, r io.Reader) (io.ReadCloser, error) {
+	switch getCompression(filename) {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// openFile() opens the named storage file for reading, decompressing it if
+// it is compressed
+func openFile(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(FormatFilePath(filename))
+	if err != nil {
+		return nil, err
+	}
+	reader, err := decompress(filename, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &storageFile{reader, file}, nil
+}
+
+// storageFile closes both a decompressor and the file under it.
+type storageFile struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (f *storageFile) Close() error {
+	f.ReadCloser.Close()
+	return f.file.Close()
+}
+
+// compressData() compresses the contents of a file
+func compressData(compression string, data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	var writer io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		writer = gzip.NewWriter(&compressed)
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(&compressed)
+		if err != nil {
+			return nil, err
+		}
+		writer = encoder
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// StartCompressor compresses every sealed file that is not compressed yet,
+// then keeps compressing files as they fill up, in a background goroutine
+func StartCompressor(compression string) {
+	mu.Lock()
+	sealedReady = make(chan struct{}, 1)
+	ready := sealedReady
+	mu.Unlock()
+
+	go func() {
+		index, err := GetIndex()
+		if err != nil {
+			config.Logger.Error("Cannot look for files to compress", "err", err)
+		}
+		for _, entry := range index {
+			if entry.Count >= uint64(config.MaxFilesize) && getCompression(entry.Name) == CompressionNone {
+				compressSealedFile(entry.Name, compression)
+			}
+		}
+		for range ready {
+			for _, filename := range takeSealed() {
+				compressSealedFile(filename, compression)
+			}
+		}
+	}()
+}
+
+// notifySealed() queues a file that has just filled up for the compressor,
+// if one is running, without waiting for it. The caller must hold mu.
+func notifySealed(filename string) {
+	if sealedReady == nil {
+		return
+	}
+	sealedFiles = append(sealedFiles, filename)
+	select {
+	case sealedReady <- struct{}{}:
+	default:
+		// The compressor is already due to drain the queue.
+	}
+}
+
+// takeSealed() empties the queue of files for the compressor
+func takeSealed() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	taken := sealedFiles
+	sealedFiles = nil
+	return taken
+}
+
+// compressSealedFile() logs the failure of compressFile, which is retried
+// the next time the compressor starts
+func compressSealedFile(filename string, compression string) {
+	if err := compressFile(filename, compression); err != nil {
+		config.Logger.Error("Cannot compress", "file", filename, "err", err)
+	}
+}
+
+// compressFile() replaces a sealed file with a compressed copy. The copy is
+// written in full before the directory and index are pointed at it, and the
+// original is only removed after that, so every step leaves a readable file
+// listed.
+func compressFile(filename string, compression string) error {
+	original := FormatFilePath(filename)
+	data, err := ioutil.ReadFile(original)
+	if err != nil {
+		return err
+	}
+	compressed, err := compressData(compression, data)
+	if err != nil {
+		return err
+	}
+	compressedName := filename + getFileBackend(filename).Extension() + compressionExtensions[compression]
+	path := config.Base + compressedName
+	if err := writeFileSynced(path+".tmp", compressed); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	err = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		index, err := loadIndex()
+		if err != nil {
+			return err
+		}
+		if err := renameListedFile(filename, compressedName); err != nil {
+			return err
+		}
+		for i := range index {
+			if index[i].Name == filename {
+				fileIndex[i].Name, fileIndex[i].Size = compressedName, int64(len(compressed))
+				fileIndex[i].Checksum = crc32.ChecksumIEEE(compressed)
+			}
+		}
+		return saveIndex()
+	}()
+	if err != nil {
+		return err
+	}
+	config.Logger.Info("Compressed", "file", filename, "to", compressedName)
+	os.Remove(formatBlockIndexPath(filename))
+	return os.Remove(original)
+}
+
+// renameListedFile() points the directory entry of a file at a new name
+// holding the same primes. The caller must hold mu.
+func renameListedFile(filename string, newName string) error {
+	fileNames, err := GetFileNames()
+	if err != nil {
+		return err
+	}
+	for i := range fileNames {
+		if fileNames[i] == filename {
+			fileNames[i] = newName
+		}
+	}
+	return writeDirectory(fileNames)
+}
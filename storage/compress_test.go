@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+func TestCompressedFilesReadBack(t *testing.T) {
+	for _, format := range []string{"text", "delta"} {
+		for _, compression := range []string{CompressionGzip, CompressionZstd} {
+			t.Run(format+"/"+compression, func(t *testing.T) {
+				useTemporaryArchive(t, format, 100)
+				stored := primesBetween(2, 2000)
+				if err := flushToFiles(append(BigIntSlice{}, stored...), nil); err != nil {
+					t.Fatal(err)
+				}
+				index, err := GetIndex()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, entry := range index[:len(index)-1] {
+					if err := compressFile(entry.Name, compression); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := os.Stat(config.Base + entry.Name + getFileBackend(entry.Name).Extension()); !os.IsNotExist(err) {
+						t.Errorf("%s was left behind after compressing it", entry.Name)
+					}
+				}
+
+				invalidateIndex()
+				checkArchive(t, stored)
+				if p, _, err := GetStoredPrime(150); err != nil || p.Cmp(stored[150]) != 0 {
+					t.Errorf("GetStoredPrime(150) = %v, %v; want %s", p, err, stored[150])
+				}
+				if count, err := CountStoredPrimes(big.NewInt(1000)); err != nil || count != 168 {
+					t.Errorf("CountStoredPrimes(1000) = %d, %v; want 168", count, err)
+				}
+				compressed, _ := GetIndex()
+				if getCompression(compressed[0].Name) != compression || getCompression(compressed[len(compressed)-1].Name) != CompressionNone {
+					t.Errorf("Indexed %s and %s; want the sealed files compressed with %s and the last left alone", compressed[0].Name, compressed[len(compressed)-1].Name, compression)
+				}
+			})
+		}
+	}
+}
+
+func TestCompressorKeepsUpWithManySealedFiles(t *testing.T) {
+	useTemporaryArchive(t, "text", 20)
+	StartCompressor(CompressionGzip)
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		close(sealedReady)
+		sealedReady, sealedFiles = nil, nil
+	})
+
+	// One flush seals far more files than the compressor can take at once.
+	stored := primesBetween(2, 5000)
+	if err := flushToFiles(append(BigIntSlice{}, stored...), nil); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		files, uncompressed, err := countUncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uncompressed == 0 {
+			if files < 20 {
+				t.Fatalf("Flushed %d files; want more than the compressor can take at once", files)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d sealed files were never compressed", uncompressed, files-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	invalidateIndex()
+	checkArchive(t, stored)
+}
+
+// countUncompressed returns how many files the archive lists and how many of
+// the sealed ones are not compressed yet
+func countUncompressed() (int, int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	index, err := loadIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	uncompressed := 0
+	for _, entry := range index[:len(index)-1] {
+		if getCompression(entry.Name) == CompressionNone {
+			uncompressed++
+		}
+	}
+	return len(index), uncompressed, nil
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+)
+
+// deltaBlockSize is the number of primes in each block of a delta file.
+const deltaBlockSize = 1024
+
+// deltaBackend stores each prime as the varint-encoded gap from the one
+// before it. Every deltaBlockSize primes a new block starts with a 0 marker
+// followed by the prime in full, so that a block can be decoded without
+// those before it, and the block's offset is appended to the file's block
+// index as a little-endian uint64.
+type deltaBackend struct{}
+
+func (deltaBackend) Name() string      { return "delta" }
+func (deltaBackend) Extension() string { return ".bin" }
+
+// Encode rejects a prime that does not exceed the one before it, whose gap
+// of 0 would be read back as a block marker.
+func (deltaBackend) Encode(entry FileIndex, chunk BigIntSlice) ([]byte, []byte, error) {
+	var data, blocks []byte
+	previous, _ := new(big.Int).SetString(entry.Last, 10)
+	varint := make([]byte, binary.MaxVarintLen64)
+	offset := make([]byte, 8)
+	gap := new(big.Int)
+
+	for i, prime := range chunk {
+		if previous != nil {
+			gap.Sub(prime, previous)
+			if gap.Sign() <= 0 {
+				return nil, nil, fmt.Errorf("%s does not exceed the prime before it, %s", prime, previous)
+			}
+		}
+		if (entry.Count+uint64(i))%deltaBlockSize == 0 {
+			binary.LittleEndian.PutUint64(offset, uint64(entry.Size)+uint64(len(data)))
+			blocks = append(blocks, offset...)
+			bytes := prime.Bytes()
+			data = append(data, varint[:binary.PutUvarint(varint, 0)]...)
+			data = append(data, varint[:binary.PutUvarint(varint, uint64(len(bytes)))]...)
+			data = append(data, bytes...)
+		} else {
+			if !gap.IsUint64() {
+				return nil, nil, fmt.Errorf("the gap from %s to %s is too large", previous, prime)
+			}
+			data = append(data, varint[:binary.PutUvarint(varint, gap.Uint64())]...)
+		}
+		previous = prime
+	}
+	return data, blocks, nil
+}
+
+// decodeDelta() streams primes from a delta file positioned at the start
+// of a block
+func decodeDelta(reader *bufio.Reader, fn func(*big.Int) bool) (bool, error) {
+	var previous *big.Int
+	for {
+		value, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		var prime *big.Int
+		if value == 0 {
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return false, fmt.Errorf("truncated block header: %v", err)
+			}
+			bytes := make([]byte, length)
+			if _, err := io.ReadFull(reader, bytes); err != nil {
+				return false, fmt.Errorf("truncated block header: %v", err)
+			}
+			prime = new(big.Int).SetBytes(bytes)
+		} else if previous == nil {
+			return false, fmt.Errorf("gap before the first block")
+		} else {
+			prime = new(big.Int).Add(previous, new(big.Int).SetUint64(value))
+		}
+		if !fn(prime) {
+			return false, nil
+		}
+		previous = prime
+	}
+}
+
+func (deltaBackend) Decode(r io.Reader, fn func(*big.Int) bool) (bool, error) {
+	return decodeDelta(bufio.NewReader(r), fn)
+}
+
+// Inspect cannot resynchronise after damage, since gaps carry no markers, so
+// everything after the first undecodable byte is reported as one part.
+func (deltaBackend) Inspect(r io.Reader, fn func(*big.Int), damaged func(description string)) error {
+	count := 0
+	_, err := decodeDelta(bufio.NewReader(r), func(p *big.Int) bool {
+		fn(p)
+		count++
+		return true
+	})
+	if err != nil {
+		damaged(fmt.Sprintf("data after prime %d cannot be decoded: %v", count, err))
+	}
+	return nil
+}
+
+// readBlockOffsets() loads the block index of a delta file
+func readBlockOffsets(filename string) ([]int64, error) {
+	contents, err := ioutil.ReadFile(formatBlockIndexPath(filename))
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, len(contents)/8)
+	for i := range offsets {
+		offsets[i] = int64(binary.LittleEndian.Uint64(contents[i*8:]))
+	}
+	return offsets, nil
+}
+
+// decodeBlocksFrom() streams the primes of a delta file starting at the
+// block beginning at offset
+func decodeBlocksFrom(entry FileIndex, offset int64, fn func(*big.Int) bool) error {
+	file, err := os.Open(FormatFilePath(entry.Name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = decodeDelta(bufio.NewReader(io.NewSectionReader(file, offset, entry.Size-offset)), fn)
+	return err
+}
+
+func (deltaBackend) Nth(entry FileIndex, k uint64) (*big.Int, error) {
+	offsets, err := readBlockOffsets(entry.Name)
+	if err != nil {
+		return nil, err
+	}
+	block := k / deltaBlockSize
+	if block >= uint64(len(offsets)) {
+		return nil, fmt.Errorf("%s holds fewer primes than its index entry", entry.Name)
+	}
+
+	var found *big.Int
+	position := block * deltaBlockSize
+	err = decodeBlocksFrom(entry, offsets[block], func(p *big.Int) bool {
+		if position == k {
+			found = p
+			return false
+		}
+		position++
+		return true
+	})
+	if err == nil && found == nil {
+		err = fmt.Errorf("%s holds fewer primes than its index entry", entry.Name)
+	}
+	return found, err
+}
+
+func (deltaBackend) CountNotExceeding(entry FileIndex, x *big.Int) (uint64, error) {
+	offsets, err := readBlockOffsets(entry.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	// Find the last block starting at or below x from the primes heading
+	// each block.
+	var searchErr error
+	block := sort.Search(len(offsets), func(i int) bool {
+		var first *big.Int
+		if err := decodeBlocksFrom(entry, offsets[i], func(p *big.Int) bool {
+			first = p
+			return false
+		}); err != nil {
+			searchErr = err
+		}
+		return first == nil || first.Cmp(x) > 0
+	}) - 1
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	if block < 0 {
+		return 0, nil
+	}
+
+	count := uint64(block) * deltaBlockSize
+	err = decodeBlocksFrom(entry, offsets[block], func(p *big.Int) bool {
+		if p.Cmp(x) > 0 {
+			return false
+		}
+		count++
+		return true
+	})
+	return count, err
+}
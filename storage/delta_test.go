@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+func TestDeltaRejectsNonIncreasingPrimes(t *testing.T) {
+	chunk := BigIntSlice{big.NewInt(11), big.NewInt(13), big.NewInt(13), big.NewInt(17)}
+	if _, _, err := (deltaBackend{}).Encode(FileIndex{}, chunk); err == nil {
+		t.Errorf("Encoded a duplicated prime, which would read back as a block marker")
+	}
+	if _, _, err := (deltaBackend{}).Encode(FileIndex{Count: 1, Last: "13"}, BigIntSlice{big.NewInt(13)}); err == nil {
+		t.Errorf("Encoded a prime equal to the last one in the file")
+	}
+
+	useTemporaryArchive(t, "delta", 1000)
+	stored := primesBetween(2, 100)
+	if err := flushToFiles(append(BigIntSlice{}, stored...), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, buffer := range []BigIntSlice{{big.NewInt(101), big.NewInt(101)}, {big.NewInt(97), big.NewInt(101)}} {
+		if err := flushToFiles(buffer, nil); err == nil {
+			t.Errorf("Stored %v after the primes up to 97", buffer)
+		}
+	}
+	checkArchive(t, stored)
+}
+
+func TestMigrateRoundTrip(t *testing.T) {
+	useTemporaryArchive(t, "text", 500)
+	stored := primesBetween(2, 20000)
+	if err := flushToFiles(append(BigIntSlice{}, stored...), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []Backend{deltaBackend{}, textBackend{}} {
+		if converted, err := Migrate(target); err != nil || converted != 5 {
+			t.Fatalf("Migrate(%s) converted %d files, %v; want 5", target.Name(), converted, err)
+		}
+		invalidateIndex()
+		checkArchive(t, stored)
+		if p, _, err := GetStoredPrime(1234); err != nil || p.Cmp(stored[1234]) != 0 {
+			t.Errorf("After migrating to %s, prime 1234 is %v, %v; want %s", target.Name(), p, err, stored[1234])
+		}
+		if leftover, _ := filepath.Glob(config.Base + "*.tmp"); len(leftover) != 0 {
+			t.Errorf("Migrating to %s left %v behind", target.Name(), leftover)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// fileStore keeps the archive in the numbered storage files listed in the
+// directory, each in one of the backends.
+type fileStore struct{}
+
+// NewFileStore returns the store kept in files under config.Base, dropping
+// any index cached from a previous base
+func NewFileStore() Store {
+	mu.Lock()
+	defer mu.Unlock()
+	invalidateIndex()
+	return fileStore{}
+}
+
+func (fileStore) Append(buffer BigIntSlice, certificates map[string][]byte) error {
+	return flushToFiles(buffer, certificates)
+}
+
+func (fileStore) Last() (*big.Int, error) {
+	index, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	return lastIndexedPrime(index), nil
+}
+
+// lastIndexedPrime() returns the largest prime in the index, or nil if it
+// holds none
+func lastIndexedPrime(index []FileIndex) *big.Int {
+	for i := len(index) - 1; i >= 0; i-- {
+		if index[i].Count > 0 {
+			largest, _ := new(big.Int).SetString(index[i].Last, 10)
+			return largest
+		}
+	}
+	return nil
+}
+
+func (fileStore) Count() (uint64, error) {
+	index, err := readIndex()
+	if err != nil {
+		return 0, err
+	}
+	var count uint64
+	for _, entry := range index {
+		count += entry.Count
+	}
+	return count, nil
+}
+
+func (fileStore) Nth(k uint64) (*big.Int, bool, error) {
+	index, err := readIndex()
+	if err != nil {
+		return nil, false, err
+	}
+	i, before, ok := locateStoredPrime(index, k)
+	if !ok {
+		return nil, false, nil
+	}
+	var found *big.Int
+	if getCompression(index[i].Name) != CompressionNone {
+		found, err = nthByStreaming(index[i], k-before)
+	} else {
+		found, err = getFileBackend(index[i].Name).Nth(index[i], k-before)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return found, true, nil
+}
+
+func (fileStore) CountNotExceeding(x *big.Int) (uint64, error) {
+	index, err := readIndex()
+	if err != nil {
+		return 0, err
+	}
+	var count uint64
+	for _, entry := range index {
+		if entry.Count == 0 {
+			continue
+		}
+		last, _ := new(big.Int).SetString(entry.Last, 10)
+		if last.Cmp(x) <= 0 {
+			count += entry.Count
+			continue
+		}
+		first, _ := new(big.Int).SetString(entry.First, 10)
+		if first.Cmp(x) <= 0 {
+			var inFile uint64
+			if getCompression(entry.Name) != CompressionNone {
+				inFile, err = countByStreaming(entry, x)
+			} else {
+				inFile, err = getFileBackend(entry.Name).CountNotExceeding(entry, x)
+			}
+			if err != nil {
+				return 0, err
+			}
+			count += inFile
+		}
+		break
+	}
+	return count, nil
+}
+
+// Range skips files entirely outside the range using the index, and streams
+// the rest rather than loading them whole.
+func (fileStore) Range(from *big.Int, to *big.Int, fn func(position uint64, p *big.Int) bool) error {
+	index, err := readIndex()
+	if err != nil {
+		return err
+	}
+	var position uint64
+	for _, entry := range index {
+		if entry.Count == 0 {
+			continue
+		}
+		last, _ := new(big.Int).SetString(entry.Last, 10)
+		if last.Cmp(from) < 0 {
+			position += entry.Count
+			continue
+		}
+		first, _ := new(big.Int).SetString(entry.First, 10)
+		if to != nil && first.Cmp(to) > 0 {
+			return nil
+		}
+
+		stopped := false
+		_, err := ReadPrimesFromFile(entry.Name, func(p *big.Int) bool {
+			defer func() { position++ }()
+			if p.Cmp(from) < 0 {
+				return true
+			}
+			if (to != nil && p.Cmp(to) > 0) || !fn(position, p) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkCertificates matches the primes of each file with the certificates in
+// its sidecar file.
+func (fileStore) WalkCertificates(fn func(p *big.Int, certificate []byte) bool) error {
+	fileNames, err := GetFileNames()
+	if err != nil {
+		return err
+	}
+	for _, filename := range fileNames {
+		certificates := make(map[string][]byte)
+		file, err := os.Open(FormatCertificatePath(filename))
+		if err == nil {
+			scanner := bufio.NewScanner(file)
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			for scanner.Scan() {
+				var keyed struct {
+					N *big.Int `json:"n"`
+				}
+				if err := json.Unmarshal(scanner.Bytes(), &keyed); err != nil || keyed.N == nil {
+					file.Close()
+					return fmt.Errorf("%s: unreadable certificate %q", filename, scanner.Text())
+				}
+				certificates[keyed.N.String()] = append([]byte(nil), scanner.Bytes()...)
+			}
+			file.Close()
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+		}
+
+		completed, err := ReadPrimesFromFile(filename, func(p *big.Int) bool {
+			return fn(p, certificates[p.String()])
+		})
+		if err != nil || !completed {
+			return err
+		}
+	}
+	return nil
+}
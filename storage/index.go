@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+// FileIndex summarises one storage file so that counting and locating
+// primes never has to read the file itself.
+type FileIndex struct {
+	Name     string `json:"name"`
+	First    string `json:"first"`
+	Last     string `json:"last"`
+	Count    uint64 `json:"count"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+var (
+	fileIndex   []FileIndex
+	indexLoaded bool
+)
+
+// scanFile() builds the index entry of a storage file from its contents
+func scanFile(filename string) (FileIndex, error) {
+	entry := FileIndex{Name: filename}
+	file, err := os.Open(FormatFilePath(filename))
+	if err != nil {
+		return entry, err
+	}
+	defer file.Close()
+
+	// The checksum covers the bytes on disk, compressed or not.
+	checksum := crc32.NewIEEE()
+	raw := io.TeeReader(file, checksum)
+	reader, err := decompress(filename, raw)
+	if err != nil {
+		return entry, fmt.Errorf("%s: %v", filename, err)
+	}
+	defer reader.Close()
+	var last *big.Int
+	_, err = getFileBackend(filename).Decode(reader, func(p *big.Int) bool {
+		if entry.Count == 0 {
+			entry.First = p.String()
+		}
+		last = p
+		entry.Count++
+		return true
+	})
+	if err != nil {
+		return entry, fmt.Errorf("%s: %v", filename, err)
+	}
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return entry, err
+	}
+	if last != nil {
+		entry.Last = last.String()
+	}
+	entry.Size = getFileSize(FormatFilePath(filename))
+	entry.Checksum = checksum.Sum32()
+	return entry, nil
+}
+
+// add() accounts for a sorted chunk of primes appended to the file
+func (entry *FileIndex) add(chunk BigIntSlice, data []byte) {
+	if entry.Count == 0 {
+		entry.First = chunk[0].String()
+	}
+	entry.Last = chunk[len(chunk)-1].String()
+	entry.Count += uint64(len(chunk))
+	entry.Size += int64(len(data))
+	entry.Checksum = crc32.Update(entry.Checksum, crc32.IEEETable, data)
+}
+
+// saveIndex() atomically replaces the index file with the in-memory index
+func saveIndex() error {
+	contents, err := json.MarshalIndent(fileIndex, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := config.Index + ".tmp"
+	if err := writeFileSynced(temporary, contents); err != nil {
+		return err
+	}
+	return os.Rename(temporary, config.Index)
+}
+
+// loadIndex() reads the index into memory, rescanning any file the index
+// is missing or whose size no longer matches. The caller must hold mu.
+func loadIndex() ([]FileIndex, error) {
+	if indexLoaded {
+		return fileIndex, nil
+	}
+	saved := make(map[string]FileIndex)
+	if contents, err := ioutil.ReadFile(config.Index); err == nil {
+		var entries []FileIndex
+		if json.Unmarshal(contents, &entries) == nil {
+			for _, entry := range entries {
+				saved[entry.Name] = entry
+			}
+		}
+	}
+
+	fileNames, err := GetFileNames()
+	if err != nil {
+		return nil, err
+	}
+	var loaded []FileIndex
+	rebuilt := false
+	for _, filename := range fileNames {
+		entry, ok := saved[filename]
+		if !ok || entry.Size != getFileSize(FormatFilePath(filename)) {
+			config.Logger.Info("Indexing", "file", filename)
+			scanned, err := scanFile(filename)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			entry, rebuilt = scanned, true
+		}
+		loaded = append(loaded, entry)
+	}
+	fileIndex, indexLoaded = loaded, true
+	if rebuilt || len(saved) != len(loaded) {
+		return fileIndex, saveIndex()
+	}
+	return fileIndex, nil
+}
+
+// readIndex() returns a copy of the index, loading it first if needed
+func readIndex() ([]FileIndex, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	index, err := loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return append([]FileIndex(nil), index...), nil
+}
+
+// GetIndex returns the index entry of every storage file, in directory order
+func GetIndex() ([]FileIndex, error) {
+	return readIndex()
+}
+
+// invalidateIndex() forces the index to be checked against the files again
+// the next time it is used
+func invalidateIndex() {
+	fileIndex, indexLoaded = nil, false
+}
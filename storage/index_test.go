@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+// readSavedIndex returns the index as saved on disk
+func readSavedIndex(t *testing.T) []FileIndex {
+	t.Helper()
+	contents, err := ioutil.ReadFile(config.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []FileIndex
+	if err := json.Unmarshal(contents, &saved); err != nil {
+		t.Fatal(err)
+	}
+	return saved
+}
+
+// writeSavedIndex replaces the index on disk and drops the one in memory,
+// as if the program had restarted
+func writeSavedIndex(t *testing.T, index []FileIndex) {
+	t.Helper()
+	contents, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config.Index, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalidateIndex()
+}
+
+func TestIndexIsTrustedWhileSizesMatch(t *testing.T) {
+	useTemporaryArchive(t, "text", 1000)
+	if err := flushToFiles(primesBetween(2, 500), nil); err != nil {
+		t.Fatal(err)
+	}
+	saved := readSavedIndex(t)
+	saved[0].Count = 12345
+	writeSavedIndex(t, saved)
+
+	// Only the index is read, so its count stands.
+	if count, err := GetPrimeCount(); err != nil || count != 12345 {
+		t.Errorf("GetPrimeCount() = %d, %v; want the indexed 12345", count, err)
+	}
+}
+
+func TestIndexRebuildsFilesWhoseSizeChanged(t *testing.T) {
+	useTemporaryArchive(t, "text", 1000)
+	first, second := primesBetween(2, 500), primesBetween(500, 1000)
+	if err := flushToFiles(first, nil); err != nil {
+		t.Fatal(err)
+	}
+	stale := readSavedIndex(t)
+	if err := flushToFiles(second, nil); err != nil {
+		t.Fatal(err)
+	}
+	stale[0].Count = 12345
+	writeSavedIndex(t, stale)
+
+	if count, err := GetPrimeCount(); err != nil || count != uint64(len(first)+len(second)) {
+		t.Errorf("GetPrimeCount() = %d, %v; want %d rescanned from the file", count, err, len(first)+len(second))
+	}
+	if largest, err := GetLargestPrime(); err != nil || largest.Cmp(second[len(second)-1]) != 0 {
+		t.Errorf("GetLargestPrime() = %v, %v; want %s", largest, err, second[len(second)-1])
+	}
+	rebuilt := readSavedIndex(t)
+	if len(rebuilt) != 1 || rebuilt[0].Count != uint64(len(first)+len(second)) || rebuilt[0].Size != getFileSize(FormatFilePath(rebuilt[0].Name)) {
+		t.Errorf("Saved the rebuilt index %+v; want the rescanned file", rebuilt)
+	}
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+// journalRecord describes a buffer flush before it is applied, so that a
+// flush interrupted by a crash can be rolled forward or back on startup.
+type journalRecord struct {
+	File              string `json:"file"`
+	Offset            int64  `json:"offset"`
+	Size              int64  `json:"size"`
+	Checksum          uint32 `json:"checksum"`
+	CertificateOffset int64  `json:"certificateoffset"`
+	CertificateSize   int64  `json:"certificatesize"`
+	BlockOffset       int64  `json:"blockoffset"`
+	BlockSize         int64  `json:"blocksize"`
+	First             string `json:"first"`
+	Last              string `json:"last"`
+	Count             int    `json:"count"`
+}
+
+// writeJournal() durably records a flush about to be applied, one record
+// per file it touches
+func writeJournal(records []journalRecord) error {
+	var contents []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		contents = append(append(contents, line...), '\n')
+	}
+	return writeFileSynced(config.Journal, contents)
+}
+
+// clearJournal() marks the last recorded flush as fully applied
+func clearJournal() error {
+	return writeFileSynced(config.Journal, nil)
+}
+
+// writeFileSynced() replaces the contents of a file and waits for them to
+// reach the disk
+func writeFileSynced(path string, contents []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(contents); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// WriteFileAtomically replaces the contents of a file by writing them
+// alongside it and renaming them into place, so that a crash leaves either
+// the old contents or the new
+func WriteFileAtomically(path string, contents []byte) error {
+	if err := writeFileSynced(path+".tmp", contents); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// appendSynced() appends data to a file and waits for it to reach the disk
+func appendSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// getFileSize() returns the size of a file, or 0 if it does not exist
+func getFileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// isRangeIntact() reports whether a file holds size bytes at offset whose
+// checksum matches
+func isRangeIntact(path string, offset int64, size int64, checksum uint32) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, offset); err != nil && !(err == io.EOF && size == 0) {
+		return false
+	}
+	return crc32.ChecksumIEEE(data) == checksum
+}
+
+// truncateSynced() cuts a file back to size, if it is any longer
+func truncateSynced(path string, size int64) error {
+	if getFileSize(path) <= size {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// ErrMissingFiles is returned by RepairJournal when the directory lists
+// files that are missing, other than one started by an interrupted flush,
+// which leaves a hole in the archive for verify --repair to deal with.
+var ErrMissingFiles = errors.New("files listed in the directory are missing")
+
+// repairDirectory() drops the last directory entry if its file is missing
+// and the flush in journal started it, as files are created before they are
+// listed. Any other missing file is left listed and reported as
+// ErrMissingFiles.
+func repairDirectory(journal []journalRecord) (bool, error) {
+	fileNames, err := GetFileNames()
+	if err != nil {
+		return false, err
+	}
+	var missing []string
+	for _, filename := range fileNames {
+		if !FileExists(filename) {
+			missing = append(missing, filename)
+		}
+	}
+	repaired := false
+	if last := len(fileNames) - 1; len(missing) > 0 && len(journal) > 0 && missing[len(missing)-1] == fileNames[last] && journal[len(journal)-1].File == fileNames[last] {
+		config.Logger.Warn("Dropping the missing file of an interrupted flush from the directory", "file", fileNames[last])
+		if err := writeDirectory(fileNames[:last]); err != nil {
+			return true, err
+		}
+		missing, repaired = missing[:len(missing)-1], true
+	}
+	if len(missing) > 0 {
+		return repaired, fmt.Errorf("%w: %s; run verify --repair", ErrMissingFiles, strings.Join(missing, ", "))
+	}
+	return repaired, nil
+}
+
+// RepairJournal() brings the archive back to a consistent state after a
+// crash. A flush that reached the disk in full is kept; one that did not is
+// rolled back, along with the file it started if that is missing. It
+// reports whether anything had to be repaired, and returns ErrMissingFiles
+// once it has if any other listed file is missing.
+func RepairJournal() (bool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	contents, err := ioutil.ReadFile(config.Journal)
+	if os.IsNotExist(err) || (err == nil && len(strings.TrimSpace(string(contents))) == 0) {
+		repaired, err := repairDirectory(nil)
+		if repaired {
+			invalidateIndex()
+		}
+		return repaired, err
+	}
+	if err != nil {
+		return false, err
+	}
+	var records []journalRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var record journalRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return false, fmt.Errorf("unreadable journal %s: %v", config.Journal, err)
+		}
+		records = append(records, record)
+	}
+
+	applied := true
+	for _, record := range records {
+		dataPath := FormatFilePath(record.File)
+		certificatePath := FormatCertificatePath(record.File)
+		applied = applied &&
+			getFileSize(dataPath) >= record.Offset+record.Size &&
+			isRangeIntact(dataPath, record.Offset, record.Size, record.Checksum) &&
+			getFileSize(certificatePath) >= record.CertificateOffset+record.CertificateSize &&
+			getFileSize(formatBlockIndexPath(record.File)) >= record.BlockOffset+record.BlockSize
+	}
+	for _, record := range records {
+		dataPath := FormatFilePath(record.File)
+		certificatePath := FormatCertificatePath(record.File)
+		if applied {
+			config.Logger.Info("Journal: interrupted flush had completed", "primes", record.Count, "first", record.First, "last", record.Last, "file", record.File)
+			err = truncateSynced(dataPath, record.Offset+record.Size)
+			if err == nil {
+				err = truncateSynced(certificatePath, record.CertificateOffset+record.CertificateSize)
+			}
+			if err == nil {
+				err = truncateSynced(formatBlockIndexPath(record.File), record.BlockOffset+record.BlockSize)
+			}
+		} else {
+			config.Logger.Warn("Journal: rolling back interrupted flush", "primes", record.Count, "first", record.First, "last", record.Last, "file", record.File)
+			err = truncateSynced(dataPath, record.Offset)
+			if err == nil {
+				err = truncateSynced(certificatePath, record.CertificateOffset)
+			}
+			if err == nil {
+				err = truncateSynced(formatBlockIndexPath(record.File), record.BlockOffset)
+			}
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	invalidateIndex()
+	if err := clearJournal(); err != nil {
+		return true, err
+	}
+	_, err = repairDirectory(records)
+	return true, err
+}
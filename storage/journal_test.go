@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+// useTemporaryArchive points the storage paths at a fresh directory, in the
+// given format, with files of at most maxFilesize primes
+func useTemporaryArchive(t *testing.T, format string, maxFilesize int) {
+	base, directory, journal, index, format0, maxFilesize0 := config.Base, config.Directory, config.Journal, config.Index, config.Format, config.MaxFilesize
+	t.Cleanup(func() {
+		config.Base, config.Directory, config.Journal, config.Index, config.Format, config.MaxFilesize = base, directory, journal, index, format0, maxFilesize0
+		invalidateIndex()
+	})
+	config.Base = t.TempDir() + "/"
+	config.Directory = config.Base + "directory.txt"
+	config.Journal = config.Base + "journal.txt"
+	config.Index = config.Base + "index.json"
+	config.Format, config.MaxFilesize = format, maxFilesize
+	invalidateIndex()
+}
+
+// primesBetween returns the primes p with from <= p < to
+func primesBetween(from, to int64) BigIntSlice {
+	var found BigIntSlice
+	for n := from; n < to; n++ {
+		if big.NewInt(n).ProbablyPrime(20) {
+			found = append(found, big.NewInt(n))
+		}
+	}
+	return found
+}
+
+// checkArchive fails the test unless the archive holds exactly want
+func checkArchive(t *testing.T, want BigIntSlice) {
+	t.Helper()
+	var stored BigIntSlice
+	if err := ReadPrimes(func(p *big.Int) bool {
+		stored = append(stored, p)
+		return true
+	}); err != nil {
+		t.Fatalf("Cannot read the archive back: %v", err)
+	}
+	count, err := GetPrimeCount()
+	if err != nil || count != uint64(len(want)) || len(stored) != len(want) {
+		t.Fatalf("The archive holds %d primes, counted %d, %v; want %d", len(stored), count, err, len(want))
+	}
+	for i := range want {
+		if stored[i].Cmp(want[i]) != 0 {
+			t.Fatalf("Prime %d is %s; want %s", i, stored[i], want[i])
+		}
+	}
+}
+
+// crashDuringFlush flushes buffer, then puts the archive back the way a
+// crash would have left it after keep bytes of the primes reached the file:
+// the journal still records the flush and the index predates it
+func crashDuringFlush(t *testing.T, buffer BigIntSlice, keep func(size int64) int64) {
+	fileNames, err := GetFileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := fileNames[len(fileNames)-1]
+	dataPath, blockPath := FormatFilePath(filename), formatBlockIndexPath(filename)
+	offset, blockOffset := getFileSize(dataPath), getFileSize(blockPath)
+	index, err := ioutil.ReadFile(config.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flushToFiles(buffer, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := journalRecord{
+		File:        filename,
+		Offset:      offset,
+		Size:        int64(len(data)) - offset,
+		Checksum:    crc32.ChecksumIEEE(data[offset:]),
+		BlockOffset: blockOffset,
+		BlockSize:   getFileSize(blockPath) - blockOffset,
+		First:       buffer[0].String(),
+		Last:        buffer[len(buffer)-1].String(),
+		Count:       len(buffer),
+	}
+	if err := writeJournal([]journalRecord{record}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dataPath, offset+keep(record.Size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config.Index, index, 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalidateIndex()
+}
+
+func TestRepairJournalReplaysTornFlush(t *testing.T) {
+	useTemporaryArchive(t, "delta", 1000)
+	first, second := primesBetween(2, 500), primesBetween(500, 1000)
+	if err := flushToFiles(first, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	crashDuringFlush(t, second, func(size int64) int64 { return size / 2 })
+	if repaired, err := RepairJournal(); err != nil || !repaired {
+		t.Fatalf("RepairJournal() = %t, %v; want the torn flush rolled back", repaired, err)
+	}
+	checkArchive(t, first)
+
+	// The buffer is computed again after the crash and flushed in full.
+	if err := flushToFiles(second, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkArchive(t, append(append(BigIntSlice{}, first...), second...))
+}
+
+func TestRepairJournalKeepsCompletedFlush(t *testing.T) {
+	useTemporaryArchive(t, "delta", 1000)
+	first, second := primesBetween(2, 500), primesBetween(500, 1000)
+	if err := flushToFiles(first, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	crashDuringFlush(t, second, func(size int64) int64 { return size })
+	if repaired, err := RepairJournal(); err != nil || !repaired {
+		t.Fatalf("RepairJournal() = %t, %v; want the completed flush kept", repaired, err)
+	}
+	checkArchive(t, append(append(BigIntSlice{}, first...), second...))
+}
+
+func TestRepairJournalDropsOnlyTheFileOfAnInterruptedFlush(t *testing.T) {
+	useTemporaryArchive(t, "text", 100)
+	if err := flushToFiles(primesBetween(2, 2000), nil); err != nil {
+		t.Fatal(err)
+	}
+	fileNames, err := GetFileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := fileNames[len(fileNames)-1]
+	if err := writeJournal([]journalRecord{{File: last, Size: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(FormatFilePath(last)); err != nil {
+		t.Fatal(err)
+	}
+	if repaired, err := RepairJournal(); err != nil || !repaired {
+		t.Fatalf("RepairJournal() = %t, %v; want the file of the interrupted flush dropped", repaired, err)
+	}
+	if kept, _ := GetFileNames(); len(kept) != len(fileNames)-1 {
+		t.Errorf("The directory lists %v; want %v without %s", kept, fileNames, last)
+	}
+}
+
+func TestRepairJournalRefusesAHoleInTheArchive(t *testing.T) {
+	useTemporaryArchive(t, "text", 100)
+	if err := flushToFiles(primesBetween(2, 2000), nil); err != nil {
+		t.Fatal(err)
+	}
+	fileNames, err := GetFileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(FormatFilePath(fileNames[1])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RepairJournal(); !errors.Is(err, ErrMissingFiles) {
+		t.Fatalf("RepairJournal() = %v with %s missing; want ErrMissingFiles", err, fileNames[1])
+	}
+	if listed, _ := GetFileNames(); len(listed) != len(fileNames) {
+		t.Errorf("The directory lists %v; want %v left for verify to repair", listed, fileNames)
+	}
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"math/big"
+	"os"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+// Migrate rewrites every storage file that is not already in the target
+// backend. Each file is written in full alongside the original and renamed
+// into place before the original is removed, so an interrupted migration
+// leaves every file readable in one backend or the other. Compressed files
+// stay compressed, under a name with the new backend's extension. It
+// returns the number of files converted.
+func Migrate(target Backend) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	index, err := loadIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	converted := 0
+	for i, entry := range index {
+		source := getFileBackend(entry.Name)
+		if source == target {
+			continue
+		}
+		config.Logger.Info("Migrating", "file", entry.Name, "from", source.Name(), "to", target.Name())
+
+		var chunk BigIntSlice
+		if _, err := ReadPrimesFromFile(entry.Name, func(p *big.Int) bool {
+			chunk = append(chunk, p)
+			return true
+		}); err != nil {
+			return converted, err
+		}
+		name, targetPath := entry.Name, config.Base+entry.Name+target.Extension()
+		if compression := getCompression(entry.Name); compression != CompressionNone {
+			name = baseFileName(entry.Name) + target.Extension() + compressionExtensions[compression]
+			targetPath = config.Base + name
+		}
+		migrated, data, blocks, err := encodeWholeFile(name, target, chunk)
+		if err != nil {
+			return converted, err
+		}
+
+		// The block index goes into place just before the file it belongs
+		// to, and no backend other than the target reads it.
+		sourcePath, blocksPath := FormatFilePath(entry.Name), formatBlockIndexPath(entry.Name)
+		if blocks != nil {
+			if err := writeFileSynced(blocksPath+".tmp", blocks); err != nil {
+				return converted, err
+			}
+		}
+		if err := writeFileSynced(targetPath+".tmp", data); err != nil {
+			return converted, err
+		}
+		if blocks != nil {
+			if err := os.Rename(blocksPath+".tmp", blocksPath); err != nil {
+				return converted, err
+			}
+		}
+		if err := os.Rename(targetPath+".tmp", targetPath); err != nil {
+			return converted, err
+		}
+		if name != entry.Name {
+			if err := renameListedFile(entry.Name, name); err != nil {
+				return converted, err
+			}
+		}
+		fileIndex[i] = migrated
+		if err := saveIndex(); err != nil {
+			return converted, err
+		}
+		if err := os.Remove(sourcePath); err != nil {
+			return converted, err
+		}
+		if blocks == nil {
+			os.Remove(blocksPath)
+		}
+		converted++
+	}
+	return converted, nil
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseFileRange returns the range of prime indices encoded in a file name
+// by getNewFileName
+func ParseFileRange(filename string) (uint64, uint64, bool) {
+	bounds := strings.SplitN(baseFileName(filename), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseUint(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err := strconv.ParseUint(bounds[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// nthByStreaming() returns the k-th prime of a file, counting from 0, by
+// reading it from the start
+func nthByStreaming(entry FileIndex, k uint64) (*big.Int, error) {
+	var found *big.Int
+	position := uint64(0)
+	_, err := ReadPrimesFromFile(entry.Name, func(p *big.Int) bool {
+		if position == k {
+			found = p
+			return false
+		}
+		position++
+		return true
+	})
+	if err == nil && found == nil {
+		err = fmt.Errorf("%s holds fewer primes than its index entry", entry.Name)
+	}
+	return found, err
+}
+
+// countByStreaming() counts the primes of a sorted file that do not exceed
+// x by reading it from the start
+func countByStreaming(entry FileIndex, x *big.Int) (uint64, error) {
+	var count uint64
+	_, err := ReadPrimesFromFile(entry.Name, func(p *big.Int) bool {
+		if p.Cmp(x) > 0 {
+			return false
+		}
+		count++
+		return true
+	})
+	return count, err
+}
+
+// locateStoredPrime() returns the position in the index of the file holding
+// the k-th stored prime, counting from 0, and the number of primes stored
+// before that file. The ranges in the file names are used to jump straight
+// to the file; archives whose names do not match their contents are
+// searched by their counts instead.
+func locateStoredPrime(index []FileIndex, k uint64) (int, uint64, bool) {
+	before := make([]uint64, len(index))
+	var total uint64
+	namesMatch := true
+	for i, entry := range index {
+		start, _, ok := ParseFileRange(entry.Name)
+		namesMatch = namesMatch && ok && start == total
+		before[i] = total
+		total += entry.Count
+	}
+	if k >= total {
+		return 0, 0, false
+	}
+
+	var i int
+	if namesMatch {
+		i = sort.Search(len(index), func(i int) bool {
+			start, _, _ := ParseFileRange(index[i].Name)
+			return start > k
+		}) - 1
+	} else {
+		i = sort.Search(len(index), func(i int) bool {
+			return before[i] > k
+		}) - 1
+	}
+	for index[i].Count == 0 {
+		i--
+	}
+	return i, before[i], true
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+)
+
+// FileExists reports whether the named storage file exists in any backend
+func FileExists(filename string) bool {
+	_, err := os.Stat(FormatFilePath(filename))
+	return err == nil
+}
+
+// FindUnlistedFiles returns the names of the storage files under
+// config.Base that the directory does not list, ordered by the range in
+// their names
+func FindUnlistedFiles(listed []string) ([]string, error) {
+	isListed := make(map[string]bool)
+	for _, filename := range listed {
+		isListed[baseFileName(filename)] = true
+	}
+	entries, err := ioutil.ReadDir(config.Base)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlisted []string
+	for _, entry := range entries {
+		for _, backend := range backends {
+			name := strings.TrimSuffix(entry.Name(), backend.Extension())
+			if getCompression(entry.Name()) != CompressionNone {
+				name = entry.Name()
+			} else if name == entry.Name() {
+				continue
+			}
+			if isListed[baseFileName(name)] {
+				continue
+			}
+			if _, _, ok := ParseFileRange(name); ok {
+				isListed[baseFileName(name)] = true
+				unlisted = append(unlisted, name)
+			}
+		}
+	}
+	sort.Slice(unlisted, func(i, j int) bool {
+		a, _, _ := ParseFileRange(unlisted[i])
+		b, _, _ := ParseFileRange(unlisted[j])
+		return a < b
+	})
+	return unlisted, nil
+}
+
+// InspectFile streams the primes of the named file to fn, in the order
+// stored, carrying on past damaged data where its backend can and
+// describing each damaged part to damaged
+func InspectFile(filename string, fn func(*big.Int), damaged func(description string)) error {
+	file, err := openFile(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return getFileBackend(filename).Inspect(file, fn, damaged)
+}
+
+// writeDirectory() atomically replaces the directory with the given names
+func writeDirectory(fileNames []string) error {
+	contents := ""
+	if len(fileNames) > 0 {
+		contents = strings.Join(fileNames, "\n") + "\n"
+	}
+	temporary := config.Directory + ".tmp"
+	if err := writeFileSynced(temporary, []byte(contents)); err != nil {
+		return err
+	}
+	return os.Rename(temporary, config.Directory)
+}
+
+// RewriteDirectory replaces the directory with the given names, and has the
+// index rebuilt to match
+func RewriteDirectory(fileNames []string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	invalidateIndex()
+	return writeDirectory(fileNames)
+}
+
+// encodeWholeFile() lays out a sorted chunk of primes as the entire contents
+// of the named file in a backend, compressed if the name says so, along with
+// its block index and its index entry
+func encodeWholeFile(filename string, backend Backend, chunk BigIntSlice) (FileIndex, []byte, []byte, error) {
+	entry := FileIndex{Name: filename}
+	var data, blocks []byte
+	if len(chunk) > 0 {
+		var err error
+		if data, blocks, err = backend.Encode(entry, chunk); err != nil {
+			return entry, nil, nil, err
+		}
+		entry.add(chunk, data)
+	}
+	if compression := getCompression(filename); compression != CompressionNone {
+		compressed, err := compressData(compression, data)
+		if err != nil {
+			return entry, nil, nil, err
+		}
+		// Compressed files are read from the start, so they keep no block
+		// index.
+		data, blocks = compressed, nil
+		entry.Size, entry.Checksum = int64(len(data)), crc32.ChecksumIEEE(data)
+	}
+	return entry, data, blocks, nil
+}
+
+// RewriteFile replaces the contents of the named storage file with a sorted
+// chunk of primes, in the backend it is already stored in, and updates its
+// index entry. The new contents are written alongside the old and renamed
+// into place. When other files are too damaged for the index to load, the
+// index is discarded to be rebuilt once they are repaired.
+func RewriteFile(filename string, chunk BigIntSlice) error {
+	mu.Lock()
+	defer mu.Unlock()
+	index, indexErr := loadIndex()
+
+	rewritten, data, blocks, err := encodeWholeFile(filename, getFileBackend(filename), chunk)
+	if err != nil {
+		return err
+	}
+	if blocks != nil {
+		if err := writeFileSynced(formatBlockIndexPath(filename)+".tmp", blocks); err != nil {
+			return err
+		}
+	}
+	path := FormatFilePath(filename)
+	if err := writeFileSynced(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if blocks != nil {
+		if err := os.Rename(formatBlockIndexPath(filename)+".tmp", formatBlockIndexPath(filename)); err != nil {
+			return err
+		}
+	}
+
+	if indexErr != nil {
+		invalidateIndex()
+		if err := os.Remove(config.Index); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := range index {
+		if index[i].Name == filename {
+			fileIndex[i] = rewritten
+		}
+	}
+	return saveIndex()
+}
@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"log"
+	"hash/crc32"
 	"math/big"
 	"os"
 	"sort"
@@ -22,59 +22,101 @@ func (s BigIntSlice) Len() int           { return len(s) }
 func (s BigIntSlice) Less(i, j int) bool { return s[i].Cmp(s[j]) < 0 }
 func (s BigIntSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
-// convertPrimesToWritableFormat() takes a buffer of primes and converts them to a string
-// with each prime separated by a newline
-func convertPrimesToWritableFormat(buffer []*big.Int) string {
-	var formattedBuffer bytes.Buffer
-	for _, prime := range buffer {
-		formattedBuffer.WriteString(prime.String() + "\n")
+// FormatFilePath formats inputted filename to create a proper file path,
+// with the extension of the backend the file is stored in.
+func FormatFilePath(filename string) string {
+	if getCompression(filename) != CompressionNone {
+		return config.Base + filename
 	}
-	return formattedBuffer.String()
+	return config.Base + filename + getFileBackend(filename).Extension()
 }
 
-// FormatFilePath formats inputted filename to create a proper file path.
-func FormatFilePath(filename string) string {
-	return config.Base + filename + ".txt"
+// FormatCertificatePath formats inputted filename to create the path of the
+// sidecar file holding the certificates of the primes stored in it.
+func FormatCertificatePath(filename string) string {
+	return config.Base + baseFileName(filename) + ".cert"
 }
 
 // createPrimesBase makes the base directory
-func createPrimesBase() {
-	log.Print("Creating base directory")
-	os.Mkdir(config.Base, os.ModePerm)
+func createPrimesBase() error {
+	config.Logger.Info("Creating base directory", "dir", config.Base)
+	if err := os.Mkdir(config.Base, os.ModePerm); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
 }
 
 // createDirectory creates the directory.txt file as defined
 // in settings.go
-func createDirectory() {
-	_, err := os.Create(config.Directory)
+func createDirectory() error {
+	file, err := os.Create(config.Directory)
 	if err != nil {
-		createPrimesBase()
-		_, err := os.Create(config.Directory)
-		if err != nil {
-			panic(err)
+		if err := createPrimesBase(); err != nil {
+			return err
+		}
+		if file, err = os.Create(config.Directory); err != nil {
+			return err
 		}
 	}
+	return file.Close()
 }
 
 // OpenDirectory returns an open os.File of the directory.txt
 // as defined in settings.go
-func OpenDirectory(flag int, perm os.FileMode) *os.File {
+func OpenDirectory(flag int, perm os.FileMode) (*os.File, error) {
 	openDirectory, err := os.OpenFile(config.Directory, flag, perm)
 	if err != nil {
-		createDirectory()
-		openedCreatedDirectory, err := os.OpenFile(config.Directory, flag, perm)
-		if err != nil {
-			panic(err)
+		if err := createDirectory(); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(config.Directory, flag, perm)
+	}
+	return openDirectory, nil
+}
+
+// GetFileNames returns the names of every storage file listed in the
+// directory, in the order in which they were created.
+func GetFileNames() ([]string, error) {
+	directory, err := OpenDirectory(os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer directory.Close()
+
+	var fileNames []string
+	scanner := bufio.NewScanner(directory)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
 		}
-		return openedCreatedDirectory
+		fileNames = append(fileNames, scanner.Text())
 	}
-	return openDirectory
+	return fileNames, scanner.Err()
+}
+
+// ReadPrimesFromFile streams each prime stored in the named file to fn,
+// whatever its backend, and reports whether fn accepted every prime.
+func ReadPrimesFromFile(filename string, fn func(*big.Int) bool) (bool, error) {
+	file, err := openFile(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	completed, err := getFileBackend(filename).Decode(file, fn)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", filename, err)
+	}
+	return completed, nil
 }
 
 // getLastFileWritten() searches the directory for the final line,
 // and returns it.
-func getLastFileWritten() string {
-	directory := OpenDirectory(os.O_RDONLY, 0600)
+func getLastFileWritten() (string, error) {
+	directory, err := OpenDirectory(os.O_RDONLY, 0600)
+	if err != nil {
+		return "", err
+	}
 	defer directory.Close()
 
 	var latestFile string
@@ -86,66 +128,210 @@ func getLastFileWritten() string {
 		}
 		latestFile = scanner.Text()
 	}
-	return latestFile
+	return latestFile, scanner.Err()
 }
 
 // isNewFileNeeded() checks whether a new file is needed by asserting that
-// the id is divisible by maxFilesize - as defined in settings.go
-func isNewFileNeeded(id uint64) bool {
-	modulusIdAndMaxFilesize := big.NewInt(0).Mod(big.NewInt(int64(id)), big.NewInt(int64(config.MaxFilesize)))
-	divisibleByMaxFilesize := modulusIdAndMaxFilesize.Int64() == 0
-	return divisibleByMaxFilesize
+// the latest file already holds maxFilesize primes - as defined in settings.go -
+// or is stored in a different backend from the configured one
+func isNewFileNeeded(latest FileIndex) bool {
+	return latest.Count >= uint64(config.MaxFilesize) || getFileBackend(latest.Name) != getConfiguredBackend()
 }
 
-// openLatestFile() returns an open os.File of the latest written to file
-func OpenLatestFile(flag int, perm os.FileMode) *os.File {
-	lastFileWritten := getLastFileWritten()
-
-	file, err := os.OpenFile(FormatFilePath(lastFileWritten), flag, perm)
-	newFileNeeded := isNewFileNeeded(config.Id)
-	if err != nil || newFileNeeded {
-		newFileName := getNewFileName(config.Id)
-		createNextFile(newFileName)
-		createdNextFile, err := os.OpenFile(FormatFilePath(newFileName), flag, perm)
-		if err != nil {
-			panic(err)
+// getLatestFileName() returns the name of the file to write to next,
+// creating a new one when the latest is full. The caller must hold mu.
+func getLatestFileName() (string, error) {
+	index, err := loadIndex()
+	if err != nil {
+		return "", err
+	}
+	if len(index) > 0 && index[len(index)-1].Count == 0 && isNewFileNeeded(index[len(index)-1]) {
+		// An empty file in another backend is recreated in the configured one
+		// under the same name.
+		latest := index[len(index)-1].Name
+		if err := os.Remove(FormatFilePath(latest)); err != nil {
+			return "", err
+		}
+		if _, err := os.Create(FormatFilePath(latest)); err != nil {
+			return "", err
+		}
+		return latest, nil
+	}
+	if len(index) == 0 || isNewFileNeeded(index[len(index)-1]) {
+		var total uint64
+		for _, entry := range index {
+			total += entry.Count
+		}
+		newFileName := getNewFileName(total)
+		if err := createNextFile(newFileName); err != nil {
+			return "", err
 		}
-		return createdNextFile
+		fileIndex = append(fileIndex, FileIndex{Name: newFileName})
+		return newFileName, nil
 	}
-	return file
+	return index[len(index)-1].Name, nil
 }
 
-// getNextFileName() generates the name of the possible file
+// openLatestFile() returns an open os.File of the latest written to file
+func OpenLatestFile(flag int, perm os.FileMode) (*os.File, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	latestFileName, err := getLatestFileName()
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(FormatFilePath(latestFileName), flag, perm)
+}
+
+// getNextFileName() generates the name of the possible file, which holds
+// the primes from the id-th onwards
 func getNewFileName(id uint64) string {
 	nextFile := fmt.Sprintf("%d-%d", id, id+uint64(config.MaxFilesize))
 	return nextFile
 }
 
-// createNextFile() creates the next file to be written to
-// and writes its name to the directory
-func createNextFile(newFileName string) {
-	directory := OpenDirectory(os.O_APPEND|os.O_WRONLY, 0600)
-	defer directory.Close()
-	directory.WriteString(newFileName + "\n")
-	log.Print("Creating next file. ", newFileName)
-	_, err := os.Create(FormatFilePath(newFileName))
+// createNextFile() creates the next file to be written to, then writes its
+// name to the directory, so that the directory never lists a file that was
+// not created
+func createNextFile(newFileName string) error {
+	config.Logger.Info("Creating next file", "file", newFileName)
+	file, err := os.Create(FormatFilePath(newFileName))
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	directory, err := OpenDirectory(os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer directory.Close()
+	_, err = directory.WriteString(newFileName + "\n")
+	return err
+}
+
+// flushChunk is the part of a buffer flush that lands in a single file
+type flushChunk struct {
+	record       journalRecord
+	primes       BigIntSlice
+	data         []byte
+	blocks       []byte
+	certificates []byte
 }
 
-// FlushBufferToFile() takes a buffer of primes and flushes them to the latest file
-func FlushBufferToFile(buffer BigIntSlice) {
+// flushToFiles() takes a buffer of primes and flushes them to the latest
+// file, and appends the certificate of each prime, keyed by its decimal
+// value, to the sidecar file of the file the primes were written to. A
+// buffer that overflows the latest file carries on in a new one. Each flush
+// is recorded in the journal first, and the id and index only advance once
+// the primes are safely on disk, so a failed flush leaves the index to be
+// rebuilt from the files.
+func flushToFiles(buffer BigIntSlice, certificates map[string][]byte) (err error) {
 	mu.Lock()
 	defer mu.Unlock()
-	fmt.Println("Writing buffer....")
+	defer func() {
+		if err != nil {
+			invalidateIndex()
+		}
+	}()
+	config.Logger.Debug("Writing buffer", "primes", len(buffer))
+	if _, err := GetBackend(config.Format); err != nil {
+		return err
+	}
 	sort.Sort(buffer)
-	atomic.AddUint64(&config.Id, uint64(config.MaxBufferSize))
+	index, err := loadIndex()
+	if err != nil {
+		return err
+	}
+	if err := checkIncreasing(buffer, lastIndexedPrime(index)); err != nil {
+		return err
+	}
 
-	file := OpenLatestFile(os.O_APPEND|os.O_WRONLY, 0600)
-	defer file.Close()
-	readableBuffer := convertPrimesToWritableFormat(buffer)
+	var chunks []flushChunk
+	var records []journalRecord
+	var sealed []string
+	for remaining := buffer; len(remaining) > 0; {
+		var latestFileName string
+		if latestFileName, err = getLatestFileName(); err != nil {
+			return err
+		}
+		entry := &fileIndex[len(fileIndex)-1]
+		n := uint64(config.MaxFilesize) - entry.Count
+		if n > uint64(len(remaining)) {
+			n = uint64(len(remaining))
+		}
+		chunk := flushChunk{primes: remaining[:n]}
+		remaining = remaining[n:]
 
-	file.WriteString(readableBuffer)
-	fmt.Println("Finished writing buffer.")
+		if chunk.data, chunk.blocks, err = getConfiguredBackend().Encode(*entry, chunk.primes); err != nil {
+			return err
+		}
+		if certificates != nil {
+			chunk.certificates = convertCertificatesToWritableFormat(chunk.primes, certificates)
+		}
+		chunk.record = journalRecord{
+			File:              latestFileName,
+			Offset:            entry.Size,
+			Size:              int64(len(chunk.data)),
+			Checksum:          crc32.ChecksumIEEE(chunk.data),
+			CertificateOffset: getFileSize(FormatCertificatePath(latestFileName)),
+			CertificateSize:   int64(len(chunk.certificates)),
+			BlockOffset:       getFileSize(formatBlockIndexPath(latestFileName)),
+			BlockSize:         int64(len(chunk.blocks)),
+			First:             chunk.primes[0].String(),
+			Last:              chunk.primes[len(chunk.primes)-1].String(),
+			Count:             len(chunk.primes),
+		}
+		entry.add(chunk.primes, chunk.data)
+		if isNewFileNeeded(*entry) {
+			sealed = append(sealed, latestFileName)
+		}
+		chunks = append(chunks, chunk)
+		records = append(records, chunk.record)
+	}
+	if err := writeJournal(records); err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		if err := appendSynced(FormatFilePath(chunk.record.File), chunk.data); err != nil {
+			return err
+		}
+		if chunk.blocks != nil {
+			if err := appendSynced(formatBlockIndexPath(chunk.record.File), chunk.blocks); err != nil {
+				return err
+			}
+		}
+		if chunk.certificates != nil {
+			if err := appendSynced(FormatCertificatePath(chunk.record.File), chunk.certificates); err != nil {
+				return err
+			}
+		}
+	}
+	if err := saveIndex(); err != nil {
+		return err
+	}
+	atomic.AddUint64(&config.Id, uint64(len(buffer)))
+	if err := clearJournal(); err != nil {
+		return err
+	}
+	for _, filename := range sealed {
+		notifySealed(filename)
+	}
+	config.Logger.Debug("Finished writing buffer")
+	return nil
+}
+
+// convertCertificatesToWritableFormat() lays out the certificates of a sorted
+// buffer of primes one per line
+func convertCertificatesToWritableFormat(buffer BigIntSlice, certificates map[string][]byte) []byte {
+	var formattedCertificates bytes.Buffer
+	for _, prime := range buffer {
+		if certificate, ok := certificates[prime.String()]; ok {
+			formattedCertificates.Write(certificate)
+			formattedCertificates.WriteString("\n")
+		}
+	}
+	return formattedCertificates.Bytes()
 }
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MaxTheMonster/PrimeNumberGenerator/config"
+	"github.com/MaxTheMonster/PrimeNumberGenerator/metrics"
+)
+
+const (
+	// StoreFiles keeps the archive in numbered files under config.Base,
+	// listed in directory.txt.
+	StoreFiles = "files"
+	// StoreBolt keeps the archive in a single bbolt database.
+	StoreBolt = "bolt"
+)
+
+// Store is where the archive of primes lives. Primes are stored in the order
+// they are appended, and each has a position counting from 0.
+type Store interface {
+	// Append durably stores a buffer of primes after those already stored,
+	// along with the certificate of each proven prime, keyed by its decimal
+	// value. certificates may be nil.
+	Append(buffer BigIntSlice, certificates map[string][]byte) error
+	// Last returns the largest stored prime, or nil if there is none.
+	Last() (*big.Int, error)
+	// Count returns the number of stored primes.
+	Count() (uint64, error)
+	// Range passes every stored prime p with from <= p <= to to fn, in
+	// ascending order, along with its position, until fn returns false. A
+	// nil to leaves the range open.
+	Range(from *big.Int, to *big.Int, fn func(position uint64, p *big.Int) bool) error
+	// Nth returns the prime at position k, and false if fewer primes are
+	// stored.
+	Nth(k uint64) (*big.Int, bool, error)
+}
+
+// counter is implemented by stores that can count the primes not exceeding
+// x without searching through them with Nth.
+type counter interface {
+	CountNotExceeding(x *big.Int) (uint64, error)
+}
+
+// certificateWalker is implemented by stores that keep certificates.
+type certificateWalker interface {
+	WalkCertificates(fn func(p *big.Int, certificate []byte) bool) error
+}
+
+var (
+	store   Store
+	storeMu sync.Mutex
+)
+
+// OpenStore returns the store selected by name
+func OpenStore(name string) (Store, error) {
+	switch name {
+	case StoreFiles, "":
+		return NewFileStore(), nil
+	case StoreBolt:
+		return OpenBoltStore(config.Database)
+	}
+	return nil, fmt.Errorf("unknown store %q", name)
+}
+
+// GetStore returns the store selected by the store: configuration key,
+// opening it on first use. A store that cannot be opened is tried again on
+// the next use.
+func GetStore() (Store, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if store == nil {
+		opened, err := OpenStore(config.Store)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open the %s store: %v", config.Store, err)
+		}
+		store = opened
+	}
+	return store, nil
+}
+
+// checkIncreasing() rejects a sorted buffer holding a prime twice, or a
+// prime not above last, the largest already stored, which may be nil
+func checkIncreasing(buffer BigIntSlice, last *big.Int) error {
+	for i, prime := range buffer {
+		if i > 0 && prime.Cmp(buffer[i-1]) == 0 {
+			return fmt.Errorf("%s is in the buffer twice", prime)
+		}
+	}
+	if len(buffer) > 0 && last != nil && buffer[0].Cmp(last) <= 0 {
+		return fmt.Errorf("%s is not above %s, which is already stored", buffer[0], last)
+	}
+	return nil
+}
+
+// AppendPrimes stores a buffer of primes, and the certificates of those
+// that were proven, in the configured store
+func AppendPrimes(buffer BigIntSlice, certificates map[string][]byte) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := s.Append(buffer, certificates); err != nil {
+		return fmt.Errorf("cannot store primes: %v", err)
+	}
+	metrics.FlushDuration.Observe(time.Since(start))
+	return nil
+}
+
+// GetPrimeCount returns the exact number of primes stored
+func GetPrimeCount() (uint64, error) {
+	s, err := GetStore()
+	if err != nil {
+		return 0, err
+	}
+	return s.Count()
+}
+
+// GetLargestPrime returns the largest prime stored, or nil if there is none
+func GetLargestPrime() (*big.Int, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.Last()
+}
+
+// GetFirstPrime returns the first prime stored, or nil if there is none
+func GetFirstPrime() (*big.Int, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
+	}
+	first, _, err := s.Nth(0)
+	return first, err
+}
+
+// GetStoredPrime returns the k-th stored prime, counting from 0, and false
+// if fewer primes are stored.
+func GetStoredPrime(k uint64) (*big.Int, bool, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, false, err
+	}
+	return s.Nth(k)
+}
+
+// CountStoredPrimes returns the number of stored primes that do not exceed x
+func CountStoredPrimes(x *big.Int) (uint64, error) {
+	s, err := GetStore()
+	if err != nil {
+		return 0, err
+	}
+	if c, ok := s.(counter); ok {
+		return c.CountNotExceeding(x)
+	}
+	total, err := s.Count()
+	if err != nil {
+		return 0, err
+	}
+	var searchErr error
+	count := sort.Search(int(total), func(k int) bool {
+		p, _, err := s.Nth(uint64(k))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return p.Cmp(x) > 0
+	})
+	return uint64(count), searchErr
+}
+
+// WalkStoredPrimes passes every stored prime p with from <= p <= to to fn,
+// in ascending order, along with its position in the archive counting from
+// 0. A nil to leaves the range open.
+func WalkStoredPrimes(from *big.Int, to *big.Int, fn func(position uint64, p *big.Int) bool) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	return s.Range(from, to, fn)
+}
+
+// ReadPrimes streams every stored prime to fn in the order stored, stopping
+// as soon as fn returns false.
+func ReadPrimes(fn func(*big.Int) bool) error {
+	return WalkStoredPrimes(big.NewInt(0), nil, func(position uint64, p *big.Int) bool {
+		return fn(p)
+	})
+}
+
+// WalkCertificates passes every stored prime to fn along with its
+// certificate, which is nil for primes stored without one.
+func WalkCertificates(fn func(p *big.Int, certificate []byte) bool) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	walker, ok := s.(certificateWalker)
+	if !ok {
+		return fmt.Errorf("the %s store does not keep certificates", config.Store)
+	}
+	return walker.WalkCertificates(fn)
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+)
+
+// textBackend stores each prime as a decimal line, the original format.
+type textBackend struct{}
+
+func (textBackend) Name() string      { return "text" }
+func (textBackend) Extension() string { return ".txt" }
+
+// convertPrimesToWritableFormat() takes a buffer of primes and converts them to a string
+// with each prime separated by a newline
+func convertPrimesToWritableFormat(buffer []*big.Int) string {
+	var formattedBuffer bytes.Buffer
+	for _, prime := range buffer {
+		formattedBuffer.WriteString(prime.String() + "\n")
+	}
+	return formattedBuffer.String()
+}
+
+func (textBackend) Encode(entry FileIndex, chunk BigIntSlice) ([]byte, []byte, error) {
+	return []byte(convertPrimesToWritableFormat(chunk)), nil, nil
+}
+
+func (textBackend) Decode(r io.Reader, fn func(*big.Int) bool) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		prime, ok := new(big.Int).SetString(scanner.Text(), 10)
+		if !ok {
+			return false, fmt.Errorf("malformed line %q", scanner.Text())
+		}
+		if !fn(prime) {
+			return false, nil
+		}
+	}
+	return true, scanner.Err()
+}
+
+func (textBackend) Inspect(r io.Reader, fn func(*big.Int), damaged func(description string)) error {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if text != "" {
+				damaged(fmt.Sprintf("line %d is truncated: %q", line, text))
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		prime, ok := new(big.Int).SetString(strings.TrimSuffix(text, "\n"), 10)
+		if !ok {
+			damaged(fmt.Sprintf("line %d is malformed: %q", line, strings.TrimSuffix(text, "\n")))
+			continue
+		}
+		fn(prime)
+	}
+}
+
+func (textBackend) Nth(entry FileIndex, k uint64) (*big.Int, error) {
+	return nthLine(FormatFilePath(entry.Name), entry.Size, k)
+}
+
+func (textBackend) CountNotExceeding(entry FileIndex, x *big.Int) (uint64, error) {
+	return countLinesNotExceeding(FormatFilePath(entry.Name), entry.Size, x)
+}
+
+// readLineAt() returns the line of a text file starting at offset, without
+// its newline
+func readLineAt(file *os.File, offset int64, size int64) (string, error) {
+	line, err := bufio.NewReader(io.NewSectionReader(file, offset, size-offset)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// firstLineGreater() returns where the first line of a sorted text file
+// greater than x begins, or size if there is none, binary searching on byte
+// offsets rather than parsing every line.
+func firstLineGreater(file *os.File, path string, size int64, x *big.Int) (int64, error) {
+	// lineStart returns where the first line starting at or after offset
+	// begins, and whether that line is greater than x.
+	var searchErr error
+	lineStart := func(offset int64) (int64, bool) {
+		start := int64(0)
+		reader := bufio.NewReader(io.NewSectionReader(file, 0, size))
+		if offset > 0 {
+			reader = bufio.NewReader(io.NewSectionReader(file, offset-1, size-offset+1))
+			skipped, err := reader.ReadString('\n')
+			if err != nil {
+				return size, true
+			}
+			start = offset - 1 + int64(len(skipped))
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			searchErr = err
+		}
+		if start >= size || line == "" {
+			return size, true
+		}
+		value, ok := new(big.Int).SetString(strings.TrimSpace(line), 10)
+		if !ok {
+			searchErr = fmt.Errorf("%s: malformed line at offset %d", path, start)
+			return start, true
+		}
+		return start, value.Cmp(x) > 0
+	}
+
+	offset := sort.Search(int(size)+1, func(o int) bool {
+		_, greater := lineStart(int64(o))
+		return greater
+	})
+	boundary, _ := lineStart(int64(offset))
+	return boundary, searchErr
+}
+
+// nthLine() returns the k-th prime of a sorted text file, counting from 0.
+// The lines of primes with the same number of digits are all as long, so
+// each run of them is skipped in one step, with firstLineGreater finding
+// where the next, longer run begins.
+func nthLine(path string, size int64, k uint64) (*big.Int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	for offset := int64(0); offset < size; {
+		line, err := readLineAt(file, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		width := int64(len(line) + 1)
+		largest := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(len(line))), nil)
+		end, err := firstLineGreater(file, path, size, largest.Sub(largest, big.NewInt(1)))
+		if err != nil {
+			return nil, err
+		}
+		if lines := uint64((end - offset) / width); k >= lines {
+			k -= lines
+			offset = end
+			continue
+		}
+		line, err = readLineAt(file, offset+int64(k)*width, size)
+		if err != nil {
+			return nil, err
+		}
+		prime, ok := new(big.Int).SetString(line, 10)
+		if !ok {
+			return nil, fmt.Errorf("%s: malformed line %q", path, line)
+		}
+		return prime, nil
+	}
+	return nil, fmt.Errorf("%s holds fewer primes than its index entry", path)
+}
+
+// countLinesNotExceeding() counts the primes in a sorted storage file that
+// do not exceed x, searching for the first line greater than x rather than
+// parsing every line.
+func countLinesNotExceeding(path string, size int64, x *big.Int) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	boundary, err := firstLineGreater(file, path, size, x)
+	if err != nil {
+		return 0, err
+	}
+
+	var count uint64
+	buf := make([]byte, 32*1024)
+	reader := io.NewSectionReader(file, 0, boundary)
+	for {
+		n, err := reader.Read(buf)
+		count += uint64(bytes.Count(buf[:n], []byte{'\n'}))
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestTextNthSeeksAcrossDigitLengths(t *testing.T) {
+	useTemporaryArchive(t, "text", 100000)
+	stored := primesBetween(2, 20000)
+	if err := flushToFiles(stored, nil); err != nil {
+		t.Fatal(err)
+	}
+	index, err := GetIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range stored {
+		if p, err := (textBackend{}).Nth(index[0], uint64(k)); err != nil || p.Cmp(want) != 0 {
+			t.Fatalf("Nth(%d) = %v, %v; want %s", k, p, err, want)
+		}
+	}
+	if _, err := (textBackend{}).Nth(index[0], uint64(len(stored))); err == nil {
+		t.Errorf("Nth(%d) found a prime past the end of the file", len(stored))
+	}
+}